@@ -252,6 +252,12 @@ func run() error {
 		}
 	}
 
+	// Undo what a previous tailscaled did to resolv.conf if it
+	// exited uncleanly. A no-op unless it left a recovery manifest.
+	if err := dns.RecoverFromManifest(logf); err != nil {
+		logf("dns recovery: %v", err)
+	}
+
 	e, useNetstack, err := createEngine(logf, linkMon)
 	if err != nil {
 		logf("wgengine.New: %v", err)
@@ -369,6 +375,8 @@ func tryEngine(logf logger.Logf, linkMon *monitor.Mon, name string) (e wgengine.
 		}
 		d, err := dns.NewOSConfigurator(logf, devName)
 		if err != nil {
+			r.Close()
+			dev.Close()
 			return nil, false, err
 		}
 		conf.DNS = d
@@ -1888,7 +1888,7 @@ func (b *LocalBackend) authReconfig() {
 		}
 	}
 
-	err = b.e.Reconfig(cfg, rcfg, &dcfg, nm.Debug)
+	err = b.e.Reconfig(cfg, rcfg, &dcfg, engineDebug(nm.Debug))
 	if err == wgengine.ErrNoChanges {
 		return
 	}
@@ -1897,6 +1897,16 @@ func (b *LocalBackend) authReconfig() {
 	b.initPeerAPIListener()
 }
 
+// engineDebug returns the subset of d that wgengine acts on, or nil if
+// there's none. The other fields are handled by controlclient and
+// LocalBackend, and would be rejected by an engine with StrictDebug.
+func engineDebug(d *tailcfg.Debug) *tailcfg.Debug {
+	if d == nil || !d.RandomizeClientPort {
+		return nil
+	}
+	return &tailcfg.Debug{RandomizeClientPort: true}
+}
+
 func parseResolver(cfg dnstype.Resolver) (netaddr.IPPort, error) {
 	ip, err := netaddr.ParseIP(cfg.Addr)
 	if err != nil {
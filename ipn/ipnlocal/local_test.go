@@ -493,3 +493,16 @@ func TestFileTargets(t *testing.T) {
 	}
 	// (other cases handled by TestPeerAPIBase above)
 }
+
+func TestEngineDebug(t *testing.T) {
+	if got := engineDebug(nil); got != nil {
+		t.Errorf("engineDebug(nil) = %+v; want nil", got)
+	}
+	if got := engineDebug(&tailcfg.Debug{SleepSeconds: 1, LogHeapPprof: true}); got != nil {
+		t.Errorf("engineDebug with only non-engine fields = %+v; want nil", got)
+	}
+	got := engineDebug(&tailcfg.Debug{SleepSeconds: 1, RandomizeClientPort: true})
+	if want := (&tailcfg.Debug{RandomizeClientPort: true}); !reflect.DeepEqual(got, want) {
+		t.Errorf("engineDebug = %+v; want %+v", got, want)
+	}
+}
@@ -119,7 +119,7 @@ func (m *resolvconfManager) SetDNS(config OSConfig) error {
 		}
 	} else {
 		stdin := new(bytes.Buffer)
-		writeResolvConf(stdin, config.Nameservers, config.SearchDomains) // dns_direct.go
+		writeResolvConf(stdin, config.Nameservers, config.NameserverSources, config.SearchDomains, config.resolvOptions(), LineEndingLF) // dns_direct.go
 
 		// This resolvconf implementation doesn't support exclusive
 		// mode or interface priorities, so it will end up blending
@@ -140,6 +140,14 @@ func (m *resolvconfManager) SupportsSplitDNS() bool {
 	return false
 }
 
+func (m *resolvconfManager) Features() ManagerFeatures {
+	return FeatureResolvConf | FeatureMultiInterface
+}
+
+func (m *resolvconfManager) CanRepresent(cfg OSConfig) bool {
+	return m.Features().CanRepresent(cfg)
+}
+
 func (m *resolvconfManager) GetBaseConfig() (OSConfig, error) {
 	var bs bytes.Buffer
 
@@ -7,17 +7,31 @@ package dns
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/rand"
+	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"golang.org/x/net/dns/dnsmessage"
 	"inet.af/netaddr"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/types/logger"
 	"tailscale.com/util/dnsname"
 )
 
@@ -26,14 +40,238 @@ const (
 	resolvConf = "/etc/resolv.conf"
 )
 
+// legacyTailscaleConf is where older Tailscale versions wrote their
+// config, with /etc/resolv.conf a symlink to it. DirectOptions.UseSymlink
+// brings that layout back.
+const legacyTailscaleConf = "/etc/resolv.tailscale.conf"
+
+// defaultReadTimeout is how long directManager waits for resolv.conf
+// (or its backup) to be stat'd or read before giving up. It guards
+// against /etc living on a hung network filesystem, where those calls
+// can block forever.
+const defaultReadTimeout = 5 * time.Second
+
+// defaultMaxFileSize is the largest resolv.conf directManager will
+// read. Real-world files are well under a kilobyte; anything much
+// bigger is a mistake (or a symlink to something like /dev/zero), and
+// we don't want to hold it all in memory. Reads stop just past the
+// limit rather than reading the whole file first.
+const defaultMaxFileSize = 16 << 10
+
+// flapWindow and flapMaxWrites bound how often SetDNS rewrites
+// resolv.conf when the config keeps flipping back to one it recently
+// wrote, as happens when a confused caller (or another DNS manager)
+// fights with us. Past flapMaxWrites writes in flapWindow, such
+// reverting writes are deferred until the window clears, at which
+// point the most recent config is written. Removing our config (a
+// zero OSConfig) is never deferred.
+const (
+	flapWindow    = 10 * time.Second
+	flapMaxWrites = 5
+)
+
+// ErrFileTooLarge is returned by WholeFileFS.ReadFile when a file
+// exceeds the requested maximum size.
+var ErrFileTooLarge = errors.New("file too large")
+
+// Counters of apparent misdetections of resolv.conf ownership, or lost
+// backups.
+var (
+	// metricBackupInvalid counts GetBaseConfig calls that found
+	// resolv.conf to be ours but its backup missing or unparseable.
+	metricBackupInvalid = expvar.NewInt("counter_dns_direct_backup_invalid")
+	// metricRestoreNotOwned counts restores that found resolv.conf
+	// replaced by a file that isn't ours.
+	metricRestoreNotOwned = expvar.NewInt("counter_dns_direct_restore_not_owned")
+)
+
+// errNotRegularFile is returned when resolv.conf exists but is
+// something other than a regular file (or a symlink to one), such as
+// a FIFO or device node, which we can't safely read or replace.
+var errNotRegularFile = errors.New("not a regular file")
+
+// errNotOwned is returned by operations that edit Tailscale's
+// resolv.conf in place when resolv.conf isn't Tailscale's.
+var errNotOwned = errors.New("not managed by Tailscale")
+
+// errClosed is returned by directManager.SetDNS when it lost a race
+// with Close: Close has already restored the original resolv.conf,
+// and writing now would leave Tailscale's config behind with nothing
+// left to clean it up.
+var errClosed = errors.New("DNS manager is closed")
+
+// errResolvedActive is returned by SetDNS when systemd-resolved is
+// running and DirectOptions.RefuseWhenResolvedActive is set.
+var errResolvedActive = errors.New("systemd-resolved is running and should manage DNS instead")
+
+// sanitizeComment returns s made safe to write as a comment at the end
+// of a resolv.conf line: on one line, and trimmed.
+func sanitizeComment(s string) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\r' {
+			return ' '
+		}
+		return r
+	}, s))
+}
+
+// backupEnvelopeMagic starts the first line of an enveloped backup
+// (see DirectOptions.BackupMetadata). The rest of the line holds the
+// original file's metadata as space-separated key=value pairs, and
+// the original file's bytes follow it. Being a comment, the header
+// doesn't stop the backup from parsing as a resolv.conf.
+const backupEnvelopeMagic = "# tailscale resolv.conf backup v1"
+
+// fileMeta is the metadata of a file that an enveloped backup
+// records and restores.
+type fileMeta struct {
+	Mode os.FileMode
+	// UID and GID are the owner, or -1 if unknown.
+	UID, GID int
+	ModTime  time.Time
+}
+
+// encodeBackup returns an enveloped backup of a file with the given
+// metadata and contents.
+func encodeBackup(meta fileMeta, contents []byte) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s mode=%#o uid=%d gid=%d mtime=%d\n", backupEnvelopeMagic, meta.Mode.Perm(), meta.UID, meta.GID, meta.ModTime.UnixNano())
+	buf.Write(contents)
+	return buf.Bytes()
+}
+
+// decodeBackup parses an enveloped backup made by encodeBackup. It
+// reports ok=false for anything else, such as a raw backup.
+func decodeBackup(b []byte) (meta fileMeta, contents []byte, ok bool) {
+	if !bytes.HasPrefix(b, []byte(backupEnvelopeMagic+" ")) {
+		return fileMeta{}, nil, false
+	}
+	nl := bytes.IndexByte(b, '\n')
+	if nl < 0 {
+		return fileMeta{}, nil, false
+	}
+	meta = fileMeta{Mode: 0644, UID: -1, GID: -1}
+	for _, kv := range strings.Fields(string(b[len(backupEnvelopeMagic):nl])) {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			return fileMeta{}, nil, false
+		}
+		k, v := kv[:i], kv[i+1:]
+		var err error
+		switch k {
+		case "mode":
+			var mode uint64
+			mode, err = strconv.ParseUint(v, 0, 32)
+			meta.Mode = os.FileMode(mode).Perm()
+		case "uid":
+			meta.UID, err = strconv.Atoi(v)
+		case "gid":
+			meta.GID, err = strconv.Atoi(v)
+		case "mtime":
+			var ns int64
+			ns, err = strconv.ParseInt(v, 10, 64)
+			meta.ModTime = time.Unix(0, ns)
+		}
+		// Unknown keys are from a newer version; skip them.
+		if err != nil {
+			return fileMeta{}, nil, false
+		}
+	}
+	return meta, b[nl+1:], true
+}
+
+// resolvConfHeader starts every file writeResolvConf writes.
+const resolvConfHeader = "# resolv.conf(5) file generated by tailscale\n" +
+	"# DO NOT EDIT THIS FILE BY HAND -- CHANGES WILL BE OVERWRITTEN\n\n"
+
+// LineEnding is how lines end in the resolv.conf files
+// writeResolvConf writes.
+type LineEnding string
+
+const (
+	// LineEndingLF ends lines with "\n", as Unix resolvers expect.
+	// It's the default; the empty LineEnding means the same.
+	LineEndingLF LineEnding = "lf"
+	// LineEndingCRLF ends lines with "\r\n", for files consumed on
+	// the Windows side of WSL.
+	LineEndingCRLF LineEnding = "crlf"
+)
+
+// newline returns the line terminator for e.
+func (e LineEnding) newline() string {
+	if e == LineEndingCRLF {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+// apply returns s, whose lines end in "\n", with e's line endings.
+func (e LineEnding) apply(s string) string {
+	if e == LineEndingCRLF {
+		return strings.ReplaceAll(s, "\n", "\r\n")
+	}
+	return s
+}
+
+// trailingComments returns the run of comment lines that ends the
+// resolv.conf contents b, not counting blank lines after it.
+func trailingComments(b []byte) []string {
+	lines := strings.Split(string(b), "\n")
+	end := len(lines)
+	for end > 0 && strings.TrimSpace(lines[end-1]) == "" {
+		end--
+	}
+	start := end
+	for start > 0 {
+		line := strings.TrimSpace(lines[start-1])
+		if !strings.HasPrefix(line, "#") && !strings.HasPrefix(line, ";") {
+			break
+		}
+		start--
+	}
+	if start == end {
+		return nil
+	}
+	ret := make([]string, 0, end-start)
+	for _, line := range lines[start:end] {
+		ret = append(ret, strings.TrimSpace(line))
+	}
+	return ret
+}
+
+// insertComments returns contents, as written by writeResolvConf
+// with line endings eol, with comments added below its header.
+func insertComments(contents []byte, comments []string, eol LineEnding) []byte {
+	header := eol.apply(resolvConfHeader)
+	if len(comments) == 0 || !bytes.HasPrefix(contents, []byte(header)) {
+		return contents
+	}
+	var buf bytes.Buffer
+	buf.WriteString(header)
+	for _, c := range comments {
+		buf.WriteString(c)
+		buf.WriteString(eol.newline())
+	}
+	buf.WriteString(eol.newline())
+	buf.Write(contents[len(header):])
+	return buf.Bytes()
+}
+
 // writeResolvConf writes DNS configuration in resolv.conf format to the given writer.
-func writeResolvConf(w io.Writer, servers []netaddr.IP, domains []dnsname.FQDN) {
-	io.WriteString(w, "# resolv.conf(5) file generated by tailscale\n")
-	io.WriteString(w, "# DO NOT EDIT THIS FILE BY HAND -- CHANGES WILL BE OVERWRITTEN\n\n")
+// Nameservers and search domains are written in exactly the order
+// given. Nameservers with an entry in sources get it as a trailing
+// comment; sources may be nil. Lines end as eol says.
+func writeResolvConf(w io.Writer, servers []netaddr.IP, sources map[netaddr.IP]string, domains []dnsname.FQDN, options []string, eol LineEnding) {
+	nl := eol.newline()
+	io.WriteString(w, eol.apply(resolvConfHeader))
 	for _, ns := range servers {
 		io.WriteString(w, "nameserver ")
 		io.WriteString(w, ns.String())
-		io.WriteString(w, "\n")
+		if src := sanitizeComment(sources[ns]); src != "" {
+			io.WriteString(w, " # ")
+			io.WriteString(w, src)
+		}
+		io.WriteString(w, nl)
 	}
 	if len(domains) > 0 {
 		io.WriteString(w, "search")
@@ -41,19 +279,72 @@ func writeResolvConf(w io.Writer, servers []netaddr.IP, domains []dnsname.FQDN)
 			io.WriteString(w, " ")
 			io.WriteString(w, domain.WithoutTrailingDot())
 		}
-		io.WriteString(w, "\n")
+		io.WriteString(w, nl)
 	}
+	if len(options) > 0 {
+		io.WriteString(w, "options ")
+		io.WriteString(w, strings.Join(options, " "))
+		io.WriteString(w, nl)
+	}
+}
+
+// RenderResolvConf returns the resolv.conf contents that SetDNS would
+// write for config. Nameserver ports aren't representable and are
+// ignored.
+func RenderResolvConf(config OSConfig) []byte {
+	buf := new(bytes.Buffer)
+	writeResolvConf(buf, config.Nameservers, config.NameserverSources, config.SearchDomains, config.resolvOptions(), LineEndingLF)
+	return buf.Bytes()
+}
+
+// ParseResolvConf parses resolv.conf(5) contents from r, the same way
+// the resolv.conf-writing configurators read the system's file.
+// Nameservers, search domains and options are returned; other
+// directives are ignored. An unparseable nameserver address or search
+// domain is an error.
+func ParseResolvConf(r io.Reader) (OSConfig, error) {
+	return readResolv(r)
+}
+
+func readResolv(r io.Reader) (OSConfig, error) {
+	return parseResolv(r, nil)
+}
+
+// readBaseResolv is like readResolv, but for files Tailscale didn't
+// write, where an odd search domain (say, with an underscore label
+// used internally) shouldn't cost us every other setting: a search
+// domain that dnsname.ToFQDN rejects is skipped, with a warning to
+// logf, rather than failing the parse.
+func readBaseResolv(r io.Reader, logf logger.Logf) (OSConfig, error) {
+	return parseResolv(r, logf)
 }
 
-func readResolv(r io.Reader) (config OSConfig, err error) {
+// parseResolv implements readResolv and, if skipLogf is non-nil,
+// readBaseResolv.
+func parseResolv(r io.Reader, skipLogf logger.Logf) (config OSConfig, err error) {
 	scanner := bufio.NewScanner(r)
+	first := true
 	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
+		line := scanner.Text()
+		if first {
+			// Some Windows editors start files with a UTF-8 byte
+			// order mark, which would hide the first line's keyword.
+			line = strings.TrimPrefix(line, "\ufeff")
+			first = false
+		}
+		keyword, rest := resolvKeyword(line)
 
-		if strings.HasPrefix(line, "nameserver") {
-			nameserver := strings.TrimPrefix(line, "nameserver")
-			nameserver = strings.TrimSpace(nameserver)
+		if keyword == "nameserver" {
+			// Like glibc, use the first word and ignore the rest,
+			// such as a trailing comment.
+			nameserver := rest
+			if f := strings.Fields(nameserver); len(f) > 0 {
+				nameserver = f[0]
+			}
 			ip, err := netaddr.ParseIP(nameserver)
+			if err != nil && looksLikeHostname(nameserver) {
+				return OSConfig{}, fmt.Errorf("nameserver %q is a hostname; nameservers must be IP addresses", nameserver)
+			}
 			if err != nil {
 				return OSConfig{}, err
 			}
@@ -61,43 +352,103 @@ func readResolv(r io.Reader) (config OSConfig, err error) {
 			continue
 		}
 
-		if strings.HasPrefix(line, "search") {
-			domain := strings.TrimPrefix(line, "search")
-			domain = strings.TrimSpace(domain)
-			fqdn, err := dnsname.ToFQDN(domain)
-			if err != nil {
-				return OSConfig{}, fmt.Errorf("parsing search domains %q: %w", line, err)
+		if keyword == "search" {
+			for _, domain := range strings.Fields(rest) {
+				fqdn, err := dnsname.ToFQDN(domain)
+				if err != nil && skipLogf != nil {
+					skipLogf("warning: ignoring invalid search domain %q: %v", domain, err)
+					continue
+				}
+				if err != nil {
+					return OSConfig{}, fmt.Errorf("parsing search domains %q: %w", line, err)
+				}
+				if fqdn == "." {
+					// Searching the root is the same as not
+					// searching; writeResolvConf can't express it.
+					continue
+				}
+				config.SearchDomains = append(config.SearchDomains, fqdn)
 			}
-			config.SearchDomains = append(config.SearchDomains, fqdn)
 			continue
 		}
+
+		if keyword == "options" {
+			config.Options = append(config.Options, strings.Fields(rest)...)
+			continue
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return OSConfig{}, err
 	}
 
 	return config, nil
 }
 
-func (m directManager) readResolvFile(path string) (OSConfig, error) {
-	b, err := m.fs.ReadFile(path)
+// resolvKeyword splits a resolv.conf line into its keyword and the
+// rest of the line. As in glibc, the keyword is separated from its
+// arguments by any run of spaces or tabs, and leading whitespace is
+// ignored.
+func resolvKeyword(line string) (keyword, rest string) {
+	line = strings.TrimSpace(line)
+	i := strings.IndexAny(line, " \t")
+	if i < 0 {
+		return line, ""
+	}
+	return line[:i], strings.TrimSpace(line[i:])
+}
+
+func (m *directManager) readResolvFile(path string) (OSConfig, error) {
+	b, err := m.readFile(path)
 	if err != nil {
 		return OSConfig{}, err
 	}
 	return readResolv(bytes.NewReader(b))
 }
 
+// readBaseResolvFile is readResolvFile for files Tailscale didn't
+// write; see readBaseResolv.
+func (m *directManager) readBaseResolvFile(path string) (OSConfig, error) {
+	b, err := m.readFile(path)
+	if err != nil {
+		return OSConfig{}, err
+	}
+	return readBaseResolv(bytes.NewReader(b), m.logf)
+}
+
 // readResolvConf reads DNS configuration from /etc/resolv.conf.
-func (m directManager) readResolvConf() (OSConfig, error) {
-	return m.readResolvFile(resolvConf)
+func (m *directManager) readResolvConf() (OSConfig, error) {
+	return m.readResolvFile(m.resolvConfPath)
 }
 
 // resolvOwner returns the apparent owner of the resolv.conf
-// configuration in bs - one of "resolvconf", "systemd-resolved" or
-// "NetworkManager", or "" if no known owner was found.
+// configuration in bs - one of "resolvconf", "systemd-resolved",
+// "NetworkManager" or "cloud-init", or "" if no known owner was found.
 func resolvOwner(bs []byte) string {
+	return parseResolvOwner(bs).Owner
+}
+
+// resolvOwnerInfo describes the apparent owner of a resolv.conf file,
+// as guessed from its comment header.
+type resolvOwnerInfo struct {
+	// Owner is the owning tool, as returned by resolvOwner.
+	Owner string
+	// Detail is a space-separated list of version numbers and
+	// absolute paths mentioned in the comment header, if any. It's
+	// only a hint, for diagnostics.
+	Detail string
+}
+
+// parseResolvOwner is like resolvOwner, but also collects version
+// and path hints from the comment header of bs.
+func parseResolvOwner(bs []byte) resolvOwnerInfo {
+	var info resolvOwnerInfo
+	var details []string
+	seen := map[string]bool{}
 	b := bytes.NewBuffer(bs)
 	for {
 		line, err := b.ReadString('\n')
 		if err != nil {
-			return ""
+			break
 		}
 		line = strings.TrimSpace(line)
 		if line == "" {
@@ -106,17 +457,70 @@ func resolvOwner(bs []byte) string {
 		if line[0] != '#' {
 			// First non-empty, non-comment line. Assume the owner
 			// isn't hiding further down.
-			return ""
+			break
+		}
+
+		if info.Owner == "" {
+			if strings.Contains(strings.ToLower(line), "cloud-init") {
+				info.Owner = "cloud-init"
+			} else if strings.Contains(line, "systemd-resolved") {
+				info.Owner = "systemd-resolved"
+			} else if strings.Contains(line, "NetworkManager") {
+				info.Owner = "NetworkManager"
+			} else if strings.Contains(line, "resolvconf") {
+				info.Owner = "resolvconf"
+			}
+		}
+		for _, word := range strings.Fields(line[1:]) {
+			word = strings.Trim(word, `.,;:()"'`)
+			if (strings.HasPrefix(word, "/") || looksLikeVersion(word)) && !seen[word] {
+				seen[word] = true
+				details = append(details, word)
+			}
+		}
+	}
+	info.Detail = strings.Join(details, " ")
+	return info
+}
+
+// looksLikeVersion reports whether s looks like a dotted version
+// number such as "1.26.6" or "v2.0". IP addresses don't count.
+func looksLikeVersion(s string) bool {
+	s = strings.TrimPrefix(s, "v")
+	if !strings.Contains(s, ".") {
+		return false
+	}
+	for _, c := range s {
+		if c != '.' && (c < '0' || c > '9') {
+			return false
 		}
+	}
+	if _, err := netaddr.ParseIP(s); err == nil {
+		return false
+	}
+	return true
+}
 
-		if strings.Contains(line, "systemd-resolved") {
-			return "systemd-resolved"
-		} else if strings.Contains(line, "NetworkManager") {
-			return "NetworkManager"
-		} else if strings.Contains(line, "resolvconf") {
-			return "resolvconf"
+// looksLikeHostname reports whether s, which failed to parse as an IP
+// address, is instead a DNS name such as "dns.google", a common
+// mistake in resolv.conf-like config since resolv.conf(5) only
+// accepts addresses.
+func looksLikeHostname(s string) bool {
+	if strings.ContainsAny(s, ":%") {
+		return false
+	}
+	hasLetter := false
+	for _, c := range s {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+			hasLetter = true
+			break
 		}
 	}
+	if !hasLetter {
+		return false
+	}
+	_, err := dnsname.ToFQDN(s)
+	return err == nil
 }
 
 // isResolvedRunning reports whether systemd-resolved is running on the system,
@@ -138,6 +542,57 @@ func isResolvedRunning() bool {
 	return err == nil
 }
 
+// hasMuslLoader reports whether the system under root uses musl libc,
+// going by the presence of its dynamic loader.
+func hasMuslLoader(root string) bool {
+	matches, _ := filepath.Glob(filepath.Join(root, "/lib/ld-musl-*"))
+	return len(matches) > 0
+}
+
+// muslOptions are the resolv.conf options musl's resolver reads. It
+// silently ignores the rest, and other tools parsing the file on a
+// musl system can choke on glibc-only ones.
+var muslOptions = []string{"ndots:", "attempts:", "timeout:"}
+
+// isMuslOption reports whether musl supports the resolv.conf option opt.
+func isMuslOption(opt string) bool {
+	for _, prefix := range muslOptions {
+		if strings.HasPrefix(opt, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// muslCompat returns config with its resolv.conf options, flags
+// included, cut down to those musl supports, and the names of the
+// options it dropped.
+func muslCompat(config OSConfig) (_ OSConfig, dropped []string) {
+	var keep []string
+	for _, opt := range config.resolvOptions() {
+		if isMuslOption(opt) {
+			keep = append(keep, opt)
+		} else {
+			dropped = append(dropped, opt)
+		}
+	}
+	config.Options = keep
+	config.TrustAD = false
+	config.NoAAAA = false
+	config.SingleRequest = false
+	config.SingleRequestReopen = false
+	config.Debug = false
+	return config, dropped
+}
+
+// restartResolved restarts systemd-resolved if it's running, so that
+// it picks up changes to resolv.conf. It's best-effort.
+func restartResolved() {
+	if isResolvedRunning() {
+		exec.Command("systemctl", "restart", "systemd-resolved.service").Run()
+	}
+}
+
 // directManager is an OSConfigurator which replaces /etc/resolv.conf with a file
 // generated from the given configuration, creating a backup of its old state.
 //
@@ -146,21 +601,583 @@ func isResolvedRunning() bool {
 // The caller must call Down before program shutdown
 // or as cleanup if the program terminates unexpectedly.
 type directManager struct {
-	fs wholeFileFS
+	logf logger.Logf
+	fs   WholeFileFS
+	// resolvConfPath is the file being managed, normally resolvConf.
+	resolvConfPath string
+
+	// readTimeout bounds how long reads of resolv.conf and its backup
+	// may take. If zero, reads never time out.
+	readTimeout time.Duration
+	// maxFileSize is the largest file, in bytes, that readFile will
+	// read. If zero, there is no limit.
+	maxFileSize int
+	// restartResolved is called after SetDNS writes our config to
+	// resolv.conf, but not when the backup is restored. It's
+	// restartResolved, except in tests.
+	restartResolved func()
+	// resolvedRunning is isResolvedRunning, except in tests.
+	resolvedRunning func() bool
+	// tempNameFunc returns the name of the temporary file that
+	// atomicWriteFile writes before renaming it to filename. It's
+	// randomTempName, except in tests.
+	tempNameFunc func(filename string) (string, error)
+	// isMusl reports whether the system's libc is musl, in which case
+	// SetDNS writes only the options musl understands. It's
+	// hasMuslLoader on a directFS, and false on other filesystems
+	// unless a test says otherwise.
+	isMusl func() bool
+	// dropInDir is DirectOptions.DropInDir.
+	dropInDir string
+	// filterCGNATBase is DirectOptions.FilterCGNATBaseResolvers.
+	filterCGNATBase bool
+	// logDiffs is DirectOptions.LogDiffs.
+	logDiffs bool
+	// fileMode is the mode resolv.conf is written with.
+	fileMode os.FileMode
+	// backupPath is where the pre-Tailscale resolv.conf is kept:
+	// DirectOptions.BackupFile, or backupConf by default.
+	backupPath string
+	// otherBackups are the paths checked for a backup after
+	// backupPath: backupConf, if DirectOptions.BackupFile moved the
+	// backup elsewhere, and the backup named by a recovery manifest.
+	// A backup found there is restored like one at backupPath, and
+	// removed once a newer one supersedes it.
+	otherBackups []string
+	// baseConfigFile is DirectOptions.BaseConfigFile.
+	baseConfigFile string
+	// probeNameservers is DirectOptions.ProbeNameservers.
+	probeNameservers bool
+	// dial is the dialer used for nameserver probes.
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+	// probeTimeout bounds each nameserver probe.
+	probeTimeout time.Duration
+	// approveConfig is DirectOptions.ApproveConfig.
+	approveConfig func(OSConfig) (OSConfig, error)
+	// backupMetadata is DirectOptions.BackupMetadata.
+	backupMetadata bool
+	// protectedNameservers is DirectOptions.ProtectedNameservers.
+	protectedNameservers []netaddr.IP
+	// mirrorFiles is DirectOptions.MirrorFiles.
+	mirrorFiles []string
+	// familyOrder is DirectOptions.FamilyOrder.
+	familyOrder FamilyOrder
+	// onBackup and onRestore are DirectOptions.OnBackup and
+	// DirectOptions.OnRestore.
+	onBackup, onRestore func(path string)
+	// manifestPath is where the recovery manifest lives, normally
+	// recoveryManifest. See RecoverFromManifest. Tests that count
+	// writes set it to "" to do without one.
+	manifestPath string
+	// preserveComments is DirectOptions.PreserveTrailingComments.
+	preserveComments bool
+	// lineEnding is how lines end in the resolv.conf SetDNS writes:
+	// what m.fs asks for, if it's a lineEndingFS, or LineEndingLF.
+	lineEnding LineEnding
+	// useSymlink is DirectOptions.UseSymlink, if m.fs can make
+	// symlinks.
+	useSymlink bool
+	// symlinkTarget is the file resolv.conf links to when useSymlink
+	// is set, normally legacyTailscaleConf.
+	symlinkTarget string
+	// noBackup and noBackupDefault are DirectOptions.NoBackup and
+	// DirectOptions.NoBackupDefault.
+	noBackup        bool
+	noBackupDefault []byte
+	// refuseResolved is DirectOptions.RefuseWhenResolvedActive.
+	refuseResolved bool
+	// searchWarnThreshold is DirectOptions.SearchDomainWarnThreshold,
+	// or defaultSearchWarnThreshold.
+	searchWarnThreshold int
+	// verifyName is DirectOptions.VerifyName.
+	verifyName string
+	// lookupHost resolves names for verifyResolution. It's
+	// net.DefaultResolver.LookupHost, except in tests.
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+
+	mu sync.Mutex // guards the following, and serializes writes
+	// suspended is whether Suspend was called without a matching
+	// Resume. While suspended, SetDNS records its config but doesn't
+	// write it.
+	suspended bool
+	// lastConfig is the most recent config passed to SetDNS, which
+	// Resume re-applies.
+	lastConfig OSConfig
+	// effective is the config last written to resolv.conf, after
+	// SetDNS's transformations, or zero if resolv.conf doesn't hold
+	// ours. See EffectiveConfig.
+	effective OSConfig
+	// lastSearchIn and lastSearchOut are the search domains last
+	// passed to SetDNS, before and after normalization. Configs often
+	// differ only in their nameservers, so this saves normalizing the
+	// same search list again.
+	lastSearchIn, lastSearchOut []dnsname.FQDN
+	// recentWrites are the configs written within the last
+	// flapWindow, oldest first.
+	recentWrites []recentWrite
+	// throttled is whether SetDNS is currently deferring writes
+	// because the config is flapping.
+	throttled bool
+	// closed is whether Close has completed successfully.
+	closed bool
+	// renameBroken is whether a rename has failed, forcing a write
+	// to fall back to copying or writing in place, as happens when
+	// resolv.conf is bind-mounted into a container. Such writes
+	// aren't atomic. See UsingCopyFallback.
+	renameBroken bool
+	// pending is whether lastConfig was deferred due to flapping and
+	// still needs writing.
+	pending bool
+	// stopFlush, if non-nil, cancels the scheduled flushPending call.
+	stopFlush func() bool
+	// conflictInterval is DirectOptions.ConflictCheckInterval.
+	conflictInterval time.Duration
+	// wroteOurs is whether resolv.conf was last left holding our
+	// config, as far as we know. See checkConflict.
+	wroteOurs bool
+	// conflictWarned is whether checkConflict has warned about
+	// resolv.conf being taken over since we last wrote it.
+	conflictWarned bool
+	// stopConflictCheck, if non-nil, cancels the scheduled
+	// checkConflict call.
+	stopConflictCheck func() bool
+	// noBackupBase is the config in resolv.conf before it was taken
+	// over without a backup, if haveNoBackupBase. See
+	// DirectOptions.NoBackup.
+	noBackupBase     OSConfig
+	haveNoBackupBase bool
+	// keptComments are the trailing comments of the pre-Tailscale
+	// resolv.conf, if preserveComments is set and keptCommentsLoaded
+	// is true. See keptCommentsLocked.
+	keptComments       []string
+	keptCommentsLoaded bool
+
+	timeNow func() time.Time
+	// afterFunc is time.AfterFunc, returning the timer's Stop
+	// method, except in tests.
+	afterFunc func(d time.Duration, f func()) (stop func() bool)
+}
+
+// recentWrite is a config written by directManager.SetDNS, and when.
+type recentWrite struct {
+	at     time.Time
+	config OSConfig
+}
+
+// DirectOptions are optional settings for the DNS manager that
+// writes /etc/resolv.conf directly, on platforms that use it. The
+// zero value is the default configuration.
+type DirectOptions struct {
+	// Root, if non-empty, is an alternate root directory, such as
+	// an installer's "/mnt/sysimage". resolv.conf and its backup are
+	// then read and written under Root instead of under /.
+	Root string
+	// ReadTimeout bounds how long stats and reads of resolv.conf and
+	// its backup may take. If zero, defaultReadTimeout is used. If
+	// negative, they never time out.
+	ReadTimeout time.Duration
+	// BaseConfigFile, if non-empty, is the absolute path of a file in
+	// resolv.conf format holding the intended upstream resolvers,
+	// such as one maintained by orchestration. When it exists and
+	// parses, GetBaseConfig returns its contents instead of reading
+	// resolv.conf or its backup.
+	BaseConfigFile string
+	// ProbeNameservers, if true, makes SetDNS send each nameserver a
+	// DNS query before writing resolv.conf and log a warning about
+	// any that don't answer within a couple of seconds. The config is
+	// written regardless. It's off by default as it delays SetDNS.
+	ProbeNameservers bool
+	// ApproveConfig, if non-nil, is called at the start of every
+	// SetDNS with the requested config, as a final veto point over
+	// what's written to resolv.conf. It returns the config to apply
+	// instead, or an error to make SetDNS fail without writing
+	// anything.
+	ApproveConfig func(OSConfig) (OSConfig, error)
+	// BackupFile, if non-empty, is the absolute path at which to
+	// keep the pre-Tailscale resolv.conf, such as
+	// "/var/lib/tailscale/resolv.pre-tailscale-backup.conf" on
+	// systems where /etc is read-only. It's under Root, if set.
+	// If empty, the backup is kept next to resolv.conf.
+	BackupFile string
+	// DropInDir, if non-empty, is the absolute path of a directory of
+	// resolv.conf fragments, such as "/etc/resolv.conf.d", which some
+	// distros assemble resolv.conf from. GetBaseConfig then appends
+	// the settings of each "*.conf" file in it, in lexical order, to
+	// the base config. Fragments are only read from file systems that
+	// can list directories.
+	DropInDir string
+	// FilterCGNATBaseResolvers, if true, makes GetBaseConfig drop
+	// nameservers in the CGNAT range (100.64.0.0/10), which Tailscale
+	// uses, as well as 100.100.100.100, which it always drops.
+	FilterCGNATBaseResolvers bool
+	// LogDiffs, if true, makes SetDNS log a line-level diff of
+	// resolv.conf whenever it rewrites it, as verbose ("[v1]") logs.
+	LogDiffs bool
+	// FileMode is the permission bits of the resolv.conf that SetDNS
+	// writes, such as 0600 or 0444 on hardened hosts. If zero, 0644
+	// is used.
+	FileMode os.FileMode
+	// VerifyName, if non-empty, is a DNS name that SetDNS looks up
+	// through the system resolver after each rewrite of resolv.conf,
+	// logging whether that worked, as a functional check of the new
+	// config. A failed lookup doesn't make SetDNS fail.
+	VerifyName string
+	// BackupMetadata, if true, makes SetDNS keep the pre-Tailscale
+	// resolv.conf in an envelope that also records its mode, owner
+	// and modification time, so that Close can restore those too.
+	// It needs a file system that can read and set metadata; others
+	// keep raw backups. Either kind of backup is restored regardless
+	// of this setting.
+	BackupMetadata bool
+	// ProtectedNameservers, if non-empty, makes SetDNS cut configs
+	// down to the maxResolvNameservers nameservers that glibc uses,
+	// dropping unprotected ones from the end of the list first, so
+	// that these resolvers (such as a corporate security DNS) are
+	// never among the ones ignored. Without it, all nameservers are
+	// written, and the resolver ignores any past the limit.
+	ProtectedNameservers []netaddr.IP
+	// Namespace, if non-empty, is the path of a Linux mount
+	// namespace, such as "/proc/1234/ns/mnt", whose resolv.conf is
+	// to be managed instead of the caller's own. Every file
+	// operation then enters the namespace first, on a dedicated OS
+	// thread, which makes them slower.
+	Namespace string
+	// Backend, if non-empty, is the name of an OSConfigurator
+	// registered with RegisterManager for NewOSConfiguratorWithOptions
+	// to return, instead of picking one of the built-in ones. The
+	// other options don't apply to it.
+	Backend string
+	// MirrorFiles are absolute paths of further files to keep in
+	// step with resolv.conf, such as "/run/resolvconf/resolv.conf",
+	// for systems where other software reads those. SetDNS writes
+	// the same config to each, and restoring the backup copies the
+	// restored resolv.conf to them. Only resolv.conf is backed up or
+	// checked for ownership. If writing any of them fails, those
+	// already written are put back as they were.
+	MirrorFiles []string
+	// FamilyOrder reorders nameservers by address family before
+	// they're written, for hosts whose policy is to try IPv6 (or
+	// IPv4) resolvers first. Within each family, the given order is
+	// kept. It applies before ProtectedNameservers truncation, so
+	// with FamilyOrderV6First, IPv4 servers are dropped first.
+	FamilyOrder FamilyOrder
+	// OnBackup and OnRestore, if non-nil, are called with the backup
+	// file's path right after the pre-Tailscale resolv.conf has been
+	// backed up, or restored from that backup, for audit logging.
+	// They're called only when a file was actually saved or put back,
+	// not when resolv.conf was already Tailscale's or there was
+	// nothing to restore. They run with the manager locked, so they
+	// mustn't call back into it.
+	OnBackup  func(path string)
+	OnRestore func(path string)
+	// PreserveTrailingComments, if true, carries the comment lines
+	// that end the pre-Tailscale resolv.conf, such as "# managed by
+	// corp policy", over into the file SetDNS writes, below its own
+	// header. They're taken from the file being backed up, or from
+	// the backup if resolv.conf is already Tailscale's.
+	PreserveTrailingComments bool
+	// NoBackup, if true, makes SetDNS replace resolv.conf without
+	// backing it up, for throwaway machines whose platform
+	// regenerates resolv.conf anyway. Close then replaces Tailscale's
+	// resolv.conf with NoBackupDefault, or removes it if that's nil.
+	// The base config is remembered only in memory, so GetBaseConfig
+	// fails after a restart.
+	NoBackup        bool
+	NoBackupDefault []byte
+	// ConflictCheckInterval, if non-zero, is how often to check that
+	// resolv.conf is still Tailscale's once SetDNS has written it. If
+	// another manager, such as NetworkManager, has taken it back, a
+	// warning naming that manager is logged, once per takeover.
+	// Nothing is done about it; the next SetDNS takes resolv.conf
+	// back as usual.
+	ConflictCheckInterval time.Duration
+	// SearchDomainWarnThreshold is how many search domains SetDNS
+	// writes before warning that some resolvers ignore the rest. If
+	// zero, it's 6, the limit of glibc before 2.26; other libcs
+	// differ. If negative, there's no warning. All domains are
+	// written regardless.
+	SearchDomainWarnThreshold int
+	// RefuseWhenResolvedActive, if true, makes SetDNS fail instead
+	// of writing resolv.conf when systemd-resolved is running, for
+	// environments that require DNS to be managed through resolved,
+	// where falling back to writing resolv.conf directly would hide a
+	// misconfiguration. Restoring the original resolv.conf, with a
+	// zero config or Close, still works.
+	RefuseWhenResolvedActive bool
+	// UseSymlink, if true, brings back the layout of older Tailscale
+	// versions for integrations that depend on it: SetDNS writes its
+	// config to /etc/resolv.tailscale.conf and makes resolv.conf a
+	// symlink to that, and Close removes both. A resolv.conf linking
+	// there counts as Tailscale's.
+	//
+	// The layout was dropped because snaps, Flatpak and other
+	// sandboxes often can't follow a resolv.conf symlink pointing
+	// outside the few paths they bind-mount, leaving DNS broken inside
+	// them. Only use it where nothing sandboxed needs DNS. It needs a
+	// file system that can make symlinks, and is ignored on others.
+	UseSymlink bool
+}
+
+// FamilyOrder is how directManager orders nameservers by address
+// family. See DirectOptions.FamilyOrder.
+type FamilyOrder string
+
+const (
+	// FamilyOrderPreserve, the default, keeps nameservers in the
+	// order given. The empty FamilyOrder means the same.
+	FamilyOrderPreserve FamilyOrder = "preserve"
+	// FamilyOrderV6First puts IPv6 nameservers before IPv4 ones.
+	FamilyOrderV6First FamilyOrder = "v6first"
+	// FamilyOrderV4First puts IPv4 nameservers before IPv6 ones.
+	FamilyOrderV4First FamilyOrder = "v4first"
+)
+
+// apply returns ns ordered according to o.
+func (o FamilyOrder) apply(ns []netaddr.IP) []netaddr.IP {
+	var first func(netaddr.IP) bool
+	switch o {
+	case FamilyOrderV6First:
+		first = netaddr.IP.Is6
+	case FamilyOrderV4First:
+		first = netaddr.IP.Is4
+	default:
+		return ns
+	}
+	ret := make([]netaddr.IP, 0, len(ns))
+	for _, ip := range ns {
+		if first(ip) {
+			ret = append(ret, ip)
+		}
+	}
+	for _, ip := range ns {
+		if !first(ip) {
+			ret = append(ret, ip)
+		}
+	}
+	return ret
+}
+
+// DirectManagerOptions are the settings for NewDirectManager.
+type DirectManagerOptions struct {
+	DirectOptions
+
+	// Logf is where the manager logs. If nil, logs are discarded.
+	Logf logger.Logf
+	// FS is the file system to manage resolv.conf on. If nil, the
+	// real file system is used, under DirectOptions.Root if set.
+	FS WholeFileFS
+	// ResolvConf is the absolute path of the file to manage. If
+	// empty, it's /etc/resolv.conf, unless overridden for debugging
+	// by the TS_DEBUG_RESOLV_CONF environment variable.
+	ResolvConf string
+	// Now, if non-nil, replaces time.Now as the manager's clock.
+	Now func() time.Time
+}
+
+// NewDirectManager returns an OSConfigurator that manages DNS by
+// writing resolv.conf directly, configured by opts. Most callers want
+// NewOSConfigurator instead, which picks the right OSConfigurator for
+// the system; this is for embedders that need a direct manager
+// specifically, or one on a file system of their own.
+func NewDirectManager(opts DirectManagerOptions) OSConfigurator {
+	return newDirectManagerFromOptions(opts)
+}
+
+func newDirectManager(logf logger.Logf) *directManager {
+	return newDirectManagerWithOptions(logf, directFS{}, DirectOptions{})
+}
+
+func newDirectManagerOnFS(logf logger.Logf, fs WholeFileFS) *directManager {
+	return newDirectManagerWithOptions(logf, fs, DirectOptions{})
+}
+
+func newDirectManagerWithOptions(logf logger.Logf, fs WholeFileFS, opts DirectOptions) *directManager {
+	return newDirectManagerFromOptions(DirectManagerOptions{
+		DirectOptions: opts,
+		Logf:          logf,
+		FS:            fs,
+	})
+}
+
+func newDirectManagerFromOptions(dopts DirectManagerOptions) *directManager {
+	opts := dopts.DirectOptions
+	logf, fs, timeNow := dopts.Logf, dopts.FS, dopts.Now
+	if logf == nil {
+		logf = logger.Discard
+	}
+	if fs == nil {
+		fs = directFS{prefix: opts.Root}
+	}
+	if opts.Namespace != "" {
+		fs = nsFS{fs: fs, enter: enterNamespace(opts.Namespace)}
+	}
+	if timeNow == nil {
+		timeNow = time.Now
+	}
+	m := &directManager{
+		logf:            logf,
+		fs:              fs,
+		resolvConfPath:  resolvConf,
+		readTimeout:     defaultReadTimeout,
+		maxFileSize:     defaultMaxFileSize,
+		fileMode:        0644,
+		backupPath:      backupConf,
+		manifestPath:    recoveryManifest,
+		restartResolved: restartResolved,
+		resolvedRunning: isResolvedRunning,
+		tempNameFunc:    randomTempName,
+		isMusl:          func() bool { return false },
+		symlinkTarget:   legacyTailscaleConf,
+		timeNow:         timeNow,
+		afterFunc: func(d time.Duration, f func()) func() bool {
+			return time.AfterFunc(d, f).Stop
+		},
+	}
+	if dfs, ok := fs.(directFS); ok {
+		// Only a real filesystem has a libc to look for.
+		m.isMusl = func() bool { return hasMuslLoader(dfs.prefix) }
+	}
+	if opts.ReadTimeout != 0 {
+		m.readTimeout = opts.ReadTimeout
+	}
+	if dopts.ResolvConf != "" {
+		m.resolvConfPath = dopts.ResolvConf
+	} else if p := os.Getenv("TS_DEBUG_RESOLV_CONF"); p != "" {
+		if !filepath.IsAbs(p) {
+			logf("ignoring TS_DEBUG_RESOLV_CONF=%q: not an absolute path", p)
+		} else {
+			logf("WARNING: TS_DEBUG_RESOLV_CONF is set; managing %s instead of %s", p, resolvConf)
+			m.resolvConfPath = p
+			// Keep the real resolv.conf's backups out of it.
+			m.backupPath = p + ".pre-tailscale-backup"
+			m.manifestPath = p + ".tailscale-recovery.json"
+			m.symlinkTarget = p + ".tailscale"
+		}
+	}
+	m.approveConfig = opts.ApproveConfig
+	m.backupMetadata = opts.BackupMetadata
+	m.protectedNameservers = opts.ProtectedNameservers
+	m.mirrorFiles = opts.MirrorFiles
+	m.familyOrder = opts.FamilyOrder
+	m.onBackup = opts.OnBackup
+	m.onRestore = opts.OnRestore
+	m.preserveComments = opts.PreserveTrailingComments
+	m.noBackup = opts.NoBackup
+	m.refuseResolved = opts.RefuseWhenResolvedActive
+	m.searchWarnThreshold = defaultSearchWarnThreshold
+	m.lineEnding = LineEndingLF
+	if lfs, ok := fs.(lineEndingFS); ok {
+		m.lineEnding = lfs.LineEnding()
+	}
+	if opts.SearchDomainWarnThreshold != 0 {
+		m.searchWarnThreshold = opts.SearchDomainWarnThreshold
+	}
+	if opts.UseSymlink {
+		_, canLink := fs.(symlinker)
+		_, canRead := fs.(symlinkReader)
+		if canLink && canRead {
+			m.useSymlink = true
+		} else {
+			logf("ignoring UseSymlink: %T can't make symlinks", fs)
+		}
+	}
+	m.conflictInterval = opts.ConflictCheckInterval
+	m.noBackupDefault = opts.NoBackupDefault
+	m.logDiffs = opts.LogDiffs
+	m.filterCGNATBase = opts.FilterCGNATBaseResolvers
+	m.dropInDir = opts.DropInDir
+	if opts.FileMode != 0 {
+		m.fileMode = opts.FileMode.Perm()
+	}
+	if opts.BackupFile != "" && opts.BackupFile != backupConf {
+		m.backupPath = opts.BackupFile
+		// Still restore a backup made before the option was set.
+		m.otherBackups = append([]string{backupConf}, m.otherBackups...)
+	}
+	m.baseConfigFile = opts.BaseConfigFile
+	m.probeNameservers = opts.ProbeNameservers
+	m.dial = new(net.Dialer).DialContext
+	m.probeTimeout = defaultProbeTimeout
+	m.verifyName = opts.VerifyName
+	m.lookupHost = net.DefaultResolver.LookupHost
+	return m
+}
+
+// withReadTimeout calls f, giving up after m.readTimeout. op and name
+// describe the call for the timeout error.
+//
+// f can't be interrupted, so on timeout the goroutine running it
+// lingers until f eventually returns.
+func (m *directManager) withReadTimeout(op, name string, f func() (interface{}, error)) (interface{}, error) {
+	if m.readTimeout <= 0 {
+		return f()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), m.readTimeout)
+	defer cancel()
+
+	type result struct {
+		v   interface{}
+		err error
+	}
+	ch := make(chan result, 1) // buffered so f's goroutine never blocks on send
+	go func() {
+		v, err := f()
+		ch <- result{v, err}
+	}()
+	select {
+	case res := <-ch:
+		return res.v, res.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%s %s: %w", op, name, ctx.Err())
+	}
+}
+
+// readFile reads name from m.fs, giving up after m.readTimeout or
+// once the file exceeds m.maxFileSize.
+func (m *directManager) readFile(name string) ([]byte, error) {
+	v, err := m.withReadTimeout("reading", name, func() (interface{}, error) {
+		return m.fs.ReadFile(name, int64(m.maxFileSize))
+	})
+	if errors.Is(err, ErrFileTooLarge) {
+		return nil, fmt.Errorf("reading %s: %w (limit %d bytes)", name, err, m.maxFileSize)
+	}
+	b, _ := v.([]byte)
+	return b, err
+}
+
+// readDir lists dir on lister, giving up after m.readTimeout.
+func (m *directManager) readDir(lister dirLister, dir string) ([]string, error) {
+	v, err := m.withReadTimeout("listing", dir, func() (interface{}, error) {
+		return lister.ReadDir(dir)
+	})
+	names, _ := v.([]string)
+	return names, err
 }
 
-func newDirectManager() directManager {
-	return directManager{fs: directFS{}}
+// readBoundedResolvConf reads the system's resolv.conf with
+// directManager's default size and time limits, for callers probing
+// it before any OSConfigurator exists.
+func readBoundedResolvConf() ([]byte, error) {
+	return newDirectManager(logger.Discard).readFile(resolvConf)
 }
 
-func newDirectManagerOnFS(fs wholeFileFS) directManager {
-	return directManager{fs: fs}
+// stat stats name on m.fs, giving up after m.readTimeout.
+func (m *directManager) stat(name string) (isRegular bool, err error) {
+	v, err := m.withReadTimeout("stat", name, func() (interface{}, error) {
+		return m.fs.Stat(name)
+	})
+	isRegular, _ = v.(bool)
+	return isRegular, err
 }
 
 // ownedByTailscale reports whether /etc/resolv.conf seems to be a
 // tailscale-managed file.
-func (m directManager) ownedByTailscale() (bool, error) {
-	isRegular, err := m.fs.Stat(resolvConf)
+func (m *directManager) ownedByTailscale() (bool, error) {
+	if m.useSymlink && m.linksToOurs() {
+		// Our own file, whatever is in it now.
+		return true, nil
+	}
+	isRegular, err := m.stat(m.resolvConfPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return false, nil
@@ -170,7 +1187,7 @@ func (m directManager) ownedByTailscale() (bool, error) {
 	if !isRegular {
 		return false, nil
 	}
-	bs, err := m.fs.ReadFile(resolvConf)
+	bs, err := m.readFile(m.resolvConfPath)
 	if err != nil {
 		return false, err
 	}
@@ -182,16 +1199,24 @@ func (m directManager) ownedByTailscale() (bool, error) {
 
 // backupConfig creates or updates a backup of /etc/resolv.conf, if
 // resolv.conf does not currently contain a Tailscale-managed config.
-func (m directManager) backupConfig() error {
-	if _, err := m.fs.Stat(resolvConf); err != nil {
+func (m *directManager) backupConfig() error {
+	if m.useSymlink && m.linksToOurs() {
+		// Already ours, even if the link dangles.
+		return nil
+	}
+	isRegular, err := m.stat(m.resolvConfPath)
+	if err != nil {
 		if os.IsNotExist(err) {
 			// No resolv.conf, nothing to back up. Also get rid of any
 			// existing backup file, to avoid restoring something old.
-			m.fs.Remove(backupConf)
+			m.fs.Remove(m.backupPath)
 			return nil
 		}
 		return err
 	}
+	if !isRegular {
+		return fmt.Errorf("refusing to replace %s: %w", m.resolvConfPath, errNotRegularFile)
+	}
 
 	owned, err := m.ownedByTailscale()
 	if err != nil {
@@ -200,160 +1225,1809 @@ func (m directManager) backupConfig() error {
 	if owned {
 		return nil
 	}
-
-	return m.fs.Rename(resolvConf, backupConf)
-}
-
-func (m directManager) restoreBackup() error {
-	if _, err := m.fs.Stat(backupConf); err != nil {
-		if os.IsNotExist(err) {
-			// No backup, nothing we can do.
-			return nil
+	if m.noBackup {
+		// Remember the base config for GetBaseConfig, but write
+		// nothing.
+		cfg, err := m.readBaseResolvFile(m.resolvConfPath)
+		if err != nil {
+			m.logf("reading base config from %s: %v", m.resolvConfPath, err)
 		}
-		return err
+		m.noBackupBase, m.haveNoBackupBase = cfg, err == nil
+		return nil
 	}
-	owned, err := m.ownedByTailscale()
-	if err != nil {
+
+	if err := m.unlinkSameFileBackup(); err != nil {
 		return err
 	}
-	if _, err := m.fs.Stat(resolvConf); err != nil && !os.IsNotExist(err) {
-		return err
+	if mfs, ok := m.fs.(metaFS); ok && m.backupMetadata {
+		if err := m.writeEnvelopedBackup(mfs); err != nil {
+			return err
+		}
+		m.removeOtherBackups()
+		m.backedUp()
+		return nil
 	}
-	resolvConfExists := !os.IsNotExist(err)
+	if err := m.fs.Rename(m.resolvConfPath, m.backupPath); err != nil {
+		// The backup may be on another file system, or resolv.conf's
+		// directory may be read-only. Copy it instead; it'll be
+		// overwritten in place.
+		m.logf("backing up %s: rename failed (%v), copying instead", m.resolvConfPath, err)
+		m.renameBroken = true
+		if err := m.copyFile(m.resolvConfPath, m.backupPath); err != nil {
+			return err
+		}
+	}
+	// The resolv.conf we just backed up supersedes any backup left
+	// at another path.
+	m.removeOtherBackups()
+	m.backedUp()
+	return nil
+}
 
-	if resolvConfExists && !owned {
-		// There's already a non-tailscale config in place, get rid of
-		// our backup.
-		m.fs.Remove(backupConf)
+// backedUp runs the OnBackup hook, if any.
+func (m *directManager) backedUp() {
+	if m.onBackup != nil {
+		m.onBackup(m.backupPath)
+	}
+}
+
+// unlinkSameFileBackup removes m.backupPath if it's a hard link to
+// resolv.conf, as some container setups leave it. Renaming one link of
+// a file over another does nothing, so backing up would otherwise
+// lose the original config when resolv.conf is overwritten.
+func (m *directManager) unlinkSameFileBackup() error {
+	sf, ok := m.fs.(sameFiler)
+	if !ok {
 		return nil
 	}
+	same, err := sf.SameFile(m.resolvConfPath, m.backupPath)
+	if err != nil || !same {
+		// An error most likely means there's no backup yet.
+		return nil
+	}
+	m.logf("%s is a hard link to %s; unlinking it before backing up", m.backupPath, m.resolvConfPath)
+	if err := m.fs.Remove(m.backupPath); err != nil {
+		return fmt.Errorf("refusing to back up %s to a hard link of itself: %w", m.resolvConfPath, err)
+	}
+	return nil
+}
 
-	// We own resolv.conf, and a backup exists.
-	if err := m.fs.Rename(backupConf, resolvConf); err != nil {
+// writeEnvelopedBackup backs up resolv.conf to m.backupPath in the
+// format of encodeBackup. resolv.conf is left in place to be
+// overwritten.
+func (m *directManager) writeEnvelopedBackup(mfs metaFS) error {
+	meta, err := mfs.FileMeta(m.resolvConfPath)
+	if err != nil {
+		return fmt.Errorf("backing up %s: %w", m.resolvConfPath, err)
+	}
+	b, err := m.readFile(m.resolvConfPath)
+	if err != nil {
 		return err
 	}
+	return m.atomicWriteFile(m.backupPath, encodeBackup(meta, b), meta.Mode.Perm())
+}
 
-	return nil
+// removeOtherBackups removes any backups left at m.otherBackups.
+func (m *directManager) removeOtherBackups() {
+	for _, path := range m.otherBackups {
+		m.fs.Remove(path)
+	}
 }
 
-func (m directManager) SetDNS(config OSConfig) error {
-	if config.IsZero() {
-		if err := m.restoreBackup(); err != nil {
-			return err
+// findBackup returns the path of the backup to restore: m.backupPath
+// if it exists, or else the first m.otherBackups entry that does.
+// Only regular files count. It returns "" if there's no backup.
+func (m *directManager) findBackup() (string, error) {
+	for _, path := range append([]string{m.backupPath}, m.otherBackups...) {
+		isRegular, err := m.stat(path)
+		if os.IsNotExist(err) {
+			continue
 		}
-	} else {
-		if err := m.backupConfig(); err != nil {
-			return err
+		if err != nil {
+			return "", err
 		}
-
-		buf := new(bytes.Buffer)
-		writeResolvConf(buf, config.Nameservers, config.SearchDomains)
-		if err := atomicWriteFile(m.fs, resolvConf, buf.Bytes(), 0644); err != nil {
-			return err
+		if !isRegular {
+			m.logf("ignoring backup %s: not a regular file", path)
+			continue
 		}
+		return path, nil
 	}
+	return "", nil
+}
 
-	// We might have taken over a configuration managed by resolved,
-	// in which case it will notice this on restart and gracefully
-	// start using our configuration. This shouldn't happen because we
-	// try to manage DNS through resolved when it's around, but as a
-	// best-effort fallback if we messed up the detection, try to
-	// restart resolved to make the system configuration consistent.
-	if isResolvedRunning() {
-		exec.Command("systemctl", "restart", "systemd-resolved.service").Run()
-	}
+// RestoreAction is what restoring the pre-Tailscale resolv.conf
+// would do.
+type RestoreAction string
 
-	return nil
-}
+const (
+	// RestoreBackup means the backup would replace resolv.conf.
+	RestoreBackup RestoreAction = "restore"
+	// RestoreDiscard means resolv.conf is no longer ours, so the
+	// backup would be deleted and resolv.conf left alone.
+	RestoreDiscard RestoreAction = "discard"
+	// RestoreNoop means there's no backup, so nothing would change.
+	RestoreNoop RestoreAction = "noop"
+)
 
-func (m directManager) SupportsSplitDNS() bool {
-	return false
+// RestorePlan describes what Close would do to resolv.conf, as
+// returned by PreviewRestore.
+type RestorePlan struct {
+	Action RestoreAction
+	// Backup is the path of the backup that would be restored or
+	// discarded, or "" for RestoreNoop.
+	Backup string
+	// Config is the configuration resolv.conf would hold afterwards.
+	// It's zero if resolv.conf wouldn't exist.
+	Config OSConfig
 }
 
-func (m directManager) GetBaseConfig() (OSConfig, error) {
-	owned, err := m.ownedByTailscale()
+// PreviewRestore reports what Close would do to resolv.conf, without
+// changing anything.
+func (m *directManager) PreviewRestore() (RestorePlan, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	action, backup, err := m.planRestore()
 	if err != nil {
-		return OSConfig{}, err
+		return RestorePlan{}, err
 	}
-	fileToRead := resolvConf
-	if owned {
-		fileToRead = backupConf
+	plan := RestorePlan{Action: action, Backup: backup}
+	resultFile := m.resolvConfPath
+	if action == RestoreBackup {
+		resultFile = backup
 	}
+	// Don't try to read a FIFO or device; it might never return.
+	isRegular, err := m.stat(resultFile)
+	switch {
+	case os.IsNotExist(err):
+		return plan, nil
+	case err != nil:
+		return RestorePlan{}, err
+	case !isRegular:
+		return RestorePlan{}, fmt.Errorf("reading %s: %w", resultFile, errNotRegularFile)
+	}
+	plan.Config, err = m.readResolvFile(resultFile)
+	if err != nil {
+		return RestorePlan{}, err
+	}
+	return plan, nil
+}
 
-	return m.readResolvFile(fileToRead)
+// PreflightReport is the result of directManager.Preflight.
+type PreflightReport struct {
+	// ResolvConfExists is whether resolv.conf exists.
+	ResolvConfExists bool
+	// RegularFile is whether resolv.conf is a regular file, or a
+	// symlink to one. It's false if resolv.conf doesn't exist.
+	RegularFile bool
+	// Owner is the software that resolv.conf says manages it, as
+	// detected by resolvOwner, or "" if unknown.
+	Owner string
+	// OwnedByTailscale is whether resolv.conf is already ours.
+	OwnedByTailscale bool
+	// DirWritable is whether files can be created next to
+	// resolv.conf, which atomically replacing it needs.
+	DirWritable bool
+	// Immutable is whether resolv.conf has the immutable attribute.
+	// It's false if that can't be determined.
+	Immutable bool
+	// ResolvedRunning is whether systemd-resolved is running, in
+	// which case it should be configured instead.
+	ResolvedRunning bool
+	// Problems are human-readable reasons why SetDNS would fail or
+	// misbehave. If empty, the system looks manageable.
+	Problems []string
 }
 
-func (m directManager) Close() error {
-	// We used to keep a file for the tailscale config and symlinked
-	// to it, but then we stopped because /etc/resolv.conf being a
-	// symlink to surprising places breaks snaps and other sandboxing
-	// things. Clean it up if it's still there.
-	m.fs.Remove("/etc/resolv.tailscale.conf")
+// Preflight probes whether m could manage resolv.conf on this system,
+// without changing its DNS configuration. Checking writability
+// creates and removes a temporary file next to resolv.conf.
+func (m *directManager) Preflight() (PreflightReport, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var r PreflightReport
+	problem := func(format string, args ...interface{}) {
+		r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+	}
+
+	isRegular, err := m.stat(m.resolvConfPath)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return PreflightReport{}, err
+	default:
+		r.ResolvConfExists = true
+		r.RegularFile = isRegular
+	}
+	if r.ResolvConfExists && !r.RegularFile {
+		problem("%s is not a regular file", m.resolvConfPath)
+	}
+	if r.RegularFile {
+		b, err := m.readFile(m.resolvConfPath)
+		if err != nil {
+			return PreflightReport{}, err
+		}
+		r.Owner = resolvOwner(b)
+		r.OwnedByTailscale = bytes.Contains(b, []byte("generated by tailscale"))
+		if r.Owner != "" {
+			problem("%s is managed by %s, which may overwrite it", m.resolvConfPath, r.Owner)
+		}
+	}
+	if ic, ok := m.fs.(immutableChecker); ok && r.RegularFile {
+		if imm, err := ic.IsImmutable(m.resolvConfPath); err == nil && imm {
+			r.Immutable = true
+			problem("%s is immutable", m.resolvConfPath)
+		}
+	}
+
+	var randBytes [8]byte
+	if _, err := rand.Read(randBytes[:]); err != nil {
+		return PreflightReport{}, err
+	}
+	probe := fmt.Sprintf("%s.%x.preflight", m.resolvConfPath, randBytes[:])
+	if err := m.fs.WriteFile(probe, nil, 0600); err != nil {
+		problem("can't create files next to %s, so it can at best be overwritten in place: %v", m.resolvConfPath, err)
+	} else {
+		r.DirWritable = true
+		m.fs.Remove(probe)
+	}
+
+	r.ResolvedRunning = m.resolvedRunning()
+	if r.ResolvedRunning {
+		problem("systemd-resolved is running and should be configured instead")
+	}
+	return r, nil
+}
+
+// DumpRedaction is what directManager.DumpState hides.
+type DumpRedaction int
+
+const (
+	// DumpRedactNothing dumps files as they are.
+	DumpRedactNothing DumpRedaction = iota
+	// DumpMaskPublicIPs replaces public IP addresses, which may
+	// identify the user's network, with "<public IPv4>" or
+	// "<public IPv6>". Loopback, link-local, private, CGNAT and
+	// Tailscale addresses are kept.
+	DumpMaskPublicIPs
+)
+
+// DumpState returns a human-readable report of resolv.conf's state
+// for bug reports: whether it exists and whose it is, the backup if
+// there is one, and both files' contents, redacted as asked. It
+// changes nothing.
+func (m *directManager) DumpState(redact DumpRedaction) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var sb strings.Builder
+	var files []string // in the order their contents are dumped
+	fmt.Fprintf(&sb, "resolv.conf: %s\n", m.resolvConfPath)
+	if rl, ok := m.fs.(symlinkReader); ok {
+		if target, err := rl.Readlink(m.resolvConfPath); err == nil {
+			fmt.Fprintf(&sb, "  symlink to: %s\n", target)
+		}
+	}
+	isRegular, err := m.stat(m.resolvConfPath)
+	switch {
+	case os.IsNotExist(err):
+		sb.WriteString("  exists: false\n")
+	case err != nil:
+		return "", err
+	case !isRegular:
+		sb.WriteString("  exists: true (not a regular file)\n")
+	default:
+		b, err := m.readFile(m.resolvConfPath)
+		if err != nil {
+			return "", err
+		}
+		info := parseResolvOwner(b)
+		owner := info.Owner
+		if owner == "" {
+			owner = "unknown"
+		}
+		if info.Detail != "" {
+			owner += " (" + info.Detail + ")"
+		}
+		sb.WriteString("  exists: true\n")
+		fmt.Fprintf(&sb, "  owner: %s\n", owner)
+		files = append(files, m.resolvConfPath)
+	}
+	owned, err := m.ownedByTailscale()
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(&sb, "  owned by tailscale: %v\n", owned)
+
+	backup, err := m.findBackup()
+	if err != nil {
+		return "", err
+	}
+	if backup == "" {
+		fmt.Fprintf(&sb, "backup: none (expected at %s)\n", m.backupPath)
+	} else {
+		fmt.Fprintf(&sb, "backup: %s\n", backup)
+		files = append(files, backup)
+	}
+
+	for _, name := range files {
+		b, err := m.readFile(name)
+		if err != nil {
+			return "", err
+		}
+		if _, contents, ok := decodeBackup(b); ok {
+			b = contents
+		}
+		s := string(b)
+		if redact == DumpMaskPublicIPs {
+			s = maskPublicIPs(s)
+		}
+		fmt.Fprintf(&sb, "\n--- %s ---\n%s", name, s)
+		if !strings.HasSuffix(s, "\n") {
+			sb.WriteString("\n")
+		}
+	}
+	return sb.String(), nil
+}
+
+// ipLike matches words that might be IP addresses, for
+// maskPublicIPs to check.
+var ipLike = regexp.MustCompile(`[0-9A-Fa-f:.]*[:.][0-9A-Fa-f:.]*`)
+
+// nonPublicPrefixes are the ranges maskPublicIPs keeps, besides
+// loopback and link-local addresses.
+var nonPublicPrefixes = []netaddr.IPPrefix{
+	netaddr.MustParseIPPrefix("10.0.0.0/8"),
+	netaddr.MustParseIPPrefix("172.16.0.0/12"),
+	netaddr.MustParseIPPrefix("192.168.0.0/16"),
+	netaddr.MustParseIPPrefix("fc00::/7"),
+	tsaddr.CGNATRange(),
+}
+
+// maskPublicIPs returns s with its public IP addresses masked. See
+// DumpMaskPublicIPs.
+func maskPublicIPs(s string) string {
+	return ipLike.ReplaceAllStringFunc(s, func(word string) string {
+		ip, err := netaddr.ParseIP(word)
+		if err != nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+			return word
+		}
+		for _, p := range nonPublicPrefixes {
+			if p.Contains(ip.Unmap()) {
+				return word
+			}
+		}
+		if ip.Is4() {
+			return "<public IPv4>"
+		}
+		return "<public IPv6>"
+	})
+}
+
+// planRestore decides what restoreBackup should do, and with which
+// backup, without changing anything.
+func (m *directManager) planRestore() (action RestoreAction, backup string, err error) {
+	backup, err = m.findBackup()
+	if err != nil {
+		return "", "", err
+	}
+	if backup == "" {
+		// No backup, nothing we can do.
+		return RestoreNoop, "", nil
+	}
+	owned, err := m.ownedByTailscale()
+	if err != nil {
+		return "", "", err
+	}
+	_, err = m.stat(m.resolvConfPath)
+	if err != nil && !os.IsNotExist(err) {
+		return "", "", err
+	}
+	resolvConfExists := !os.IsNotExist(err)
+
+	if resolvConfExists && !owned {
+		// There's already a non-tailscale config in place, so get rid
+		// of our backup, and any older ones.
+		return RestoreDiscard, backup, nil
+	}
+	return RestoreBackup, backup, nil
+}
+
+// restoreBackup puts the backed-up pre-Tailscale resolv.conf back in
+// place, if there is a backup and resolv.conf is still ours. If
+// resolv.conf has since been replaced by something else, the backup
+// is discarded instead. It reports whether a backup was restored.
+func (m *directManager) restoreBackup() (restored bool, err error) {
+	if m.noBackup {
+		return m.dropOurConfig()
+	}
+	action, backup, err := m.planRestore()
+	if err != nil {
+		return false, err
+	}
+	if action != RestoreNoop {
+		// The next takeover may find different comments.
+		m.keptComments, m.keptCommentsLoaded = nil, false
+	}
+	switch action {
+	case RestoreNoop:
+		return false, nil
+	case RestoreDiscard:
+		metricRestoreNotOwned.Add(1)
+		m.fs.Remove(backup)
+		m.removeOtherBackups()
+		return false, nil
+	}
+
+	// We own resolv.conf, and a backup exists. It's either enveloped
+	// (see DirectOptions.BackupMetadata) or a raw copy; one we can't
+	// read here is put back as a raw copy.
+	b, _ := m.readFile(backup)
+	if meta, contents, ok := decodeBackup(b); ok {
+		if err := m.atomicWriteFile(m.resolvConfPath, contents, meta.Mode); err != nil {
+			return false, err
+		}
+		if mfs, ok := m.fs.(metaFS); ok {
+			if err := mfs.SetFileMeta(m.resolvConfPath, meta); err != nil {
+				// The contents are back, which is what matters.
+				m.logf("restoring %s metadata: %v", m.resolvConfPath, err)
+			}
+		}
+		m.fs.Remove(backup)
+	} else if err := m.fs.Rename(backup, m.resolvConfPath); err != nil {
+		m.logf("restoring %s: rename failed (%v), copying instead", m.resolvConfPath, err)
+		m.renameBroken = true
+		if err := m.copyFile(backup, m.resolvConfPath); err != nil {
+			return false, err
+		}
+		m.fs.Remove(backup)
+	}
+	m.removeOtherBackups()
+	m.syncMirrors()
+	if m.onRestore != nil {
+		m.onRestore(backup)
+	}
+	return true, nil
+}
+
+// dropOurConfig is restoreBackup for DirectOptions.NoBackup. With no
+// backup to put back, Tailscale's resolv.conf is replaced with
+// m.noBackupDefault, or removed if that's nil, along with its
+// mirrors. It does nothing if resolv.conf isn't Tailscale's.
+func (m *directManager) dropOurConfig() (dropped bool, err error) {
+	owned, err := m.ownedByTailscale()
+	if err != nil || !owned {
+		return false, err
+	}
+	if m.noBackupDefault != nil {
+		if err := m.atomicWriteFile(m.resolvConfPath, m.noBackupDefault, m.fileMode); err != nil {
+			return false, err
+		}
+		m.syncMirrors()
+	} else {
+		if err := m.fs.Remove(m.resolvConfPath); err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		for _, path := range m.mirrorFiles {
+			m.fs.Remove(path)
+		}
+	}
+	m.noBackupBase, m.haveNoBackupBase = OSConfig{}, false
+	return true, nil
+}
+
+// copyFile copies src to dst, for when they can't be renamed. dst
+// gets src's mode if the FS can report it, as a rename would have
+// kept it, and m.fileMode otherwise.
+func (m *directManager) copyFile(src, dst string) error {
+	b, err := m.readFile(src)
+	if err != nil {
+		return err
+	}
+	mode := m.fileMode
+	if mfs, ok := m.fs.(metaFS); ok {
+		if meta, err := mfs.FileMeta(src); err == nil {
+			mode = meta.Mode.Perm()
+		}
+	}
+	return m.atomicWriteFile(dst, b, mode)
+}
+
+func (m *directManager) SetDNS(config OSConfig) error {
+	config, err := m.prepareConfig(config)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	config, apply, err := m.acceptLocked(config)
+	if !apply {
+		return err
+	}
+	if m.flappingLocked(config) {
+		return nil
+	}
+	return m.setDNSLocked(config)
+}
+
+// EnsureManaged makes sure resolv.conf holds config, as SetDNS would
+// write it, and reports whether that took a write. If resolv.conf is
+// already Tailscale's and matches config, it does nothing; if another
+// manager has since replaced or edited it, config is applied again.
+// Unlike SetDNS, it isn't throttled when configs flap, as reapplying
+// the same config isn't flapping. A zero config restores the backup
+// as SetDNS does, reporting a change if resolv.conf was Tailscale's.
+func (m *directManager) EnsureManaged(config OSConfig) (changed bool, err error) {
+	config, err = m.prepareConfig(config)
+	if err != nil {
+		return false, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	config, apply, err := m.acceptLocked(config)
+	if !apply {
+		return false, err
+	}
+	if config.IsZero() {
+		changed, err = m.ownedByTailscale()
+		if err != nil {
+			return false, err
+		}
+	} else if m.alreadyWrittenLocked(config) {
+		return false, nil
+	} else {
+		changed = true
+	}
+	// This write supersedes any deferred one.
+	m.cancelPendingLocked()
+	if err := m.setDNSLocked(config); err != nil {
+		return false, err
+	}
+	return changed, nil
+}
+
+// prepareConfig returns config transformed into what SetDNS writes,
+// as far as that can be done without m.mu held: approved, cut down to
+// what resolv.conf can express, and with its nameservers cleaned up.
+func (m *directManager) prepareConfig(config OSConfig) (OSConfig, error) {
+	if m.approveConfig != nil {
+		var err error
+		config, err = m.approveConfig(config)
+		if err != nil {
+			return OSConfig{}, fmt.Errorf("DNS config not approved: %w", err)
+		}
+	}
+	for ip, port := range config.NameserverPorts {
+		if port != 53 {
+			m.logf("warning: resolv.conf can't express port %d for nameserver %v; using port 53", port, ip)
+		}
+	}
+	config.NameserverPorts = nil
+	if len(config.Routes) > 0 {
+		m.logf("warning: resolv.conf can't express conditional forwarding; ignoring routes for %d domains", len(config.Routes))
+		config.Routes = nil
+	}
+	if m.isMusl() {
+		var dropped []string
+		config, dropped = muslCompat(config)
+		if len(dropped) > 0 {
+			m.logf("musl libc detected; omitting unsupported resolv.conf options %q", dropped)
+		}
+	}
+	config.Nameservers = m.dropInvalidNameservers(config.Nameservers)
+	// Dedup before anything counts nameservers.
+	config.Nameservers = normalizeNameservers(config.Nameservers)
+	config.Nameservers = m.familyOrder.apply(config.Nameservers)
+	if len(m.protectedNameservers) > 0 {
+		config.Nameservers = m.truncateNameservers(config.Nameservers)
+	}
+	for _, d := range config.SearchDomains {
+		if isReverseZone(d) {
+			m.logf("warning: search domain %q is a reverse DNS zone; it belongs in MatchDomains, not SearchDomains", d)
+		}
+	}
+	if m.probeNameservers {
+		m.warnUnreachable(config.Nameservers)
+	}
+	return config, nil
+}
+
+// acceptLocked finishes preparing config, which prepareConfig
+// returned, and records it as the config to apply. It reports whether
+// the config should be applied now: not if m is suspended, as Resume
+// will apply it, nor if m is closed, which is an error unless config
+// is zero. m.mu must be held.
+func (m *directManager) acceptLocked(config OSConfig) (_ OSConfig, apply bool, err error) {
+	if m.closed {
+		if config.IsZero() {
+			// Already torn down, as asked.
+			return OSConfig{}, false, nil
+		}
+		return OSConfig{}, false, errClosed
+	}
+	if err := m.migrateLegacySymlinkLocked(); err != nil {
+		return OSConfig{}, false, err
+	}
+	config = m.normalizeLocked(config)
+	config.SearchDomains = m.dropRootSearch(config.SearchDomains)
+	m.lastConfig = config
+	return config, !m.suspended, nil
+}
+
+// dropInvalidNameservers returns ns without the zero IPs, which
+// resolv.conf can't express, warning about any it drops.
+func (m *directManager) dropInvalidNameservers(ns []netaddr.IP) []netaddr.IP {
+	var ret []netaddr.IP
+	for _, ip := range ns {
+		if ip.IsZero() {
+			m.logf("warning: ignoring invalid (zero) nameserver")
+			continue
+		}
+		ret = append(ret, ip)
+	}
+	return ret
+}
+
+// migrateLegacySymlinkLocked converts resolv.conf from the old
+// layout, a symlink to legacyTailscaleConf, into a regular file with
+// the same contents, and removes legacyTailscaleConf. The original
+// config was backed up to backupConf in that layout too, so it's left
+// for Close to restore. Each step is safe to redo if an earlier
+// attempt was interrupted. m.mu must be held.
+func (m *directManager) migrateLegacySymlinkLocked() error {
+	rl, ok := m.fs.(symlinkReader)
+	if !ok || m.useSymlink {
+		return nil
+	}
+	target, err := rl.Readlink(m.resolvConfPath)
+	if err != nil {
+		// Missing, or not a symlink.
+		return nil
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(m.resolvConfPath), target)
+	}
+	if filepath.Clean(target) != legacyTailscaleConf {
+		return nil
+	}
+
+	m.logf("migrating %s from a symlink to %s to a regular file", m.resolvConfPath, legacyTailscaleConf)
+	contents, err := m.readFile(legacyTailscaleConf)
+	if os.IsNotExist(err) {
+		// Dangling symlink. Write an empty config of our own, so
+		// that backupConfig doesn't take resolv.conf's absence as a
+		// reason to discard the backup.
+		contents, err = RenderResolvConf(OSConfig{}), nil
+	}
+	if err != nil {
+		return err
+	}
+	// Renaming over the symlink replaces the link itself, not its
+	// target.
+	if err := m.atomicWriteFile(m.resolvConfPath, contents, m.fileMode); err != nil {
+		return fmt.Errorf("migrating legacy %s: %w", m.resolvConfPath, err)
+	}
+	m.fs.Remove(legacyTailscaleConf)
+	return nil
+}
+
+// normalizeLocked returns config.Normalize(), reusing the previous
+// result for the search domains if they're unchanged. m.mu must be
+// held.
+func (m *directManager) normalizeLocked(config OSConfig) OSConfig {
+	if len(config.SearchDomains) == 0 || !fqdnsEqual(config.SearchDomains, m.lastSearchIn) {
+		in := append([]dnsname.FQDN(nil), config.SearchDomains...)
+		config = config.Normalize()
+		m.lastSearchIn, m.lastSearchOut = in, config.SearchDomains
+		return config
+	}
+	config.SearchDomains = m.lastSearchOut
+	config.Nameservers = normalizeNameservers(config.Nameservers)
+	config.MatchDomains = normalizeDomains(config.MatchDomains)
+	return config
+}
+
+// maxResolvNameservers is the most nameservers glibc's resolver uses
+// (MAXNS); it ignores any beyond that.
+const maxResolvNameservers = 3
+
+// defaultSearchWarnThreshold is the default for
+// DirectOptions.SearchDomainWarnThreshold: the most search domains
+// glibc used before 2.26 (MAXDNSRCH).
+const defaultSearchWarnThreshold = 6
+
+// truncateNameservers returns ns cut down to maxResolvNameservers by
+// dropping servers not in m.protectedNameservers, last first. If more
+// than that many are protected, they're all kept.
+func (m *directManager) truncateNameservers(ns []netaddr.IP) []netaddr.IP {
+	excess := len(ns) - maxResolvNameservers
+	if excess <= 0 {
+		return ns
+	}
+	protected := func(ip netaddr.IP) bool {
+		for _, p := range m.protectedNameservers {
+			if p == ip {
+				return true
+			}
+		}
+		return false
+	}
+	drop := make([]bool, len(ns))
+	for i := len(ns) - 1; i >= 0 && excess > 0; i-- {
+		if !protected(ns[i]) {
+			drop[i] = true
+			excess--
+		}
+	}
+	ret := make([]netaddr.IP, 0, len(ns))
+	for i, ip := range ns {
+		if drop[i] {
+			m.logf("dropping nameserver %v: resolv.conf can only use %d, and others are protected or preferred", ip, maxResolvNameservers)
+			continue
+		}
+		ret = append(ret, ip)
+	}
+	return ret
+}
+
+// dropRootSearch returns domains without the root, ".", which is
+// meaningless as a search domain and would render as an empty word
+// in resolv.conf. domains must be normalized.
+func (m *directManager) dropRootSearch(domains []dnsname.FQDN) []dnsname.FQDN {
+	for i, d := range domains {
+		if d != "." {
+			continue
+		}
+		m.logf("[v1] dropping root search domain %q", d)
+		ret := append([]dnsname.FQDN(nil), domains[:i]...)
+		for _, d := range domains[i+1:] {
+			if d != "." {
+				ret = append(ret, d)
+			}
+		}
+		return ret
+	}
+	return domains
+}
+
+// isReverseZone reports whether d is, or is under, one of the reverse
+// DNS zones in-addr.arpa or ip6.arpa.
+func isReverseZone(d dnsname.FQDN) bool {
+	s := strings.TrimSuffix(strings.ToLower(string(d)), ".")
+	for _, zone := range []string{"in-addr.arpa", "ip6.arpa"} {
+		if s == zone || strings.HasSuffix(s, "."+zone) {
+			return true
+		}
+	}
+	return false
+}
+
+func fqdnsEqual(a, b []dnsname.FQDN) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// defaultProbeTimeout is how long a nameserver probe waits for an
+// answer.
+const defaultProbeTimeout = 2 * time.Second
+
+// probeQuery is the DNS query sent by probeNameserver: an NS query
+// for the root, which any working resolver can answer.
+var probeQuery = func() []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 0x7473, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName("."),
+		Type:  dnsmessage.TypeNS,
+		Class: dnsmessage.ClassINET,
+	})
+	msg, err := b.Finish()
+	if err != nil {
+		panic(err)
+	}
+	return msg
+}()
+
+// warnUnreachable probes nameservers concurrently and logs a warning
+// for each that doesn't answer.
+func (m *directManager) warnUnreachable(nameservers []netaddr.IP) {
+	errs := make([]error, len(nameservers))
+	var wg sync.WaitGroup
+	for i, ip := range nameservers {
+		wg.Add(1)
+		go func(i int, ip netaddr.IP) {
+			defer wg.Done()
+			errs[i] = m.probeNameserver(ip)
+		}(i, ip)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			m.logf("warning: nameserver %v did not answer a probe query: %v", nameservers[i], err)
+		}
+	}
+}
+
+// probeNameserver sends a DNS query to ip on UDP port 53 and waits up
+// to m.probeTimeout for any reply.
+func (m *directManager) probeNameserver(ip netaddr.IP) error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.probeTimeout)
+	defer cancel()
+	conn, err := m.dial(ctx, "udp", netaddr.IPPortFrom(ip, 53).String())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	if _, err := conn.Write(probeQuery); err != nil {
+		return err
+	}
+	var buf [512]byte
+	_, err = conn.Read(buf[:])
+	return err
+}
+
+// flappingLocked reports whether writing config should be deferred
+// because SetDNS has been flipping between configs faster than
+// flapMaxWrites per flapWindow. If so, it schedules flushPending to
+// write m.lastConfig once the window clears. Otherwise, it records
+// config as written. m.mu must be held.
+func (m *directManager) flappingLocked(config OSConfig) bool {
+	now := m.timeNow()
+	i := 0
+	for i < len(m.recentWrites) && now.Sub(m.recentWrites[i].at) >= flapWindow {
+		i++
+	}
+	m.recentWrites = m.recentWrites[i:]
+
+	if n := len(m.recentWrites); !config.IsZero() && n >= flapMaxWrites && !m.recentWrites[n-1].config.Equal(config) {
+		for _, w := range m.recentWrites[:n-1] {
+			if w.config.Equal(config) {
+				if !m.throttled {
+					m.logf("warning: resolv.conf config is flapping (%d writes in %v); throttling writes", n, flapWindow)
+					m.throttled = true
+				}
+				m.pending = true
+				if m.stopFlush == nil {
+					m.stopFlush = m.afterFunc(m.recentWrites[0].at.Add(flapWindow).Sub(now), m.flushPending)
+				}
+				return true
+			}
+		}
+	}
+	if m.throttled && len(m.recentWrites) < flapMaxWrites {
+		m.logf("resolv.conf config no longer flapping; resuming writes")
+		m.throttled = false
+	}
+	m.cancelPendingLocked()
+	m.recentWrites = append(m.recentWrites, recentWrite{at: now, config: config})
+	return false
+}
+
+// cancelPendingLocked forgets any config deferred by flappingLocked.
+// m.mu must be held.
+func (m *directManager) cancelPendingLocked() {
+	m.pending = false
+	if m.stopFlush != nil {
+		m.stopFlush()
+		m.stopFlush = nil
+	}
+}
+
+// scheduleConflictCheckLocked arranges for checkConflict to run after
+// m.conflictInterval, if that's set and it isn't already scheduled.
+// m.mu must be held.
+func (m *directManager) scheduleConflictCheckLocked() {
+	if m.conflictInterval <= 0 || m.stopConflictCheck != nil {
+		return
+	}
+	m.stopConflictCheck = m.afterFunc(m.conflictInterval, m.checkConflict)
+}
+
+// checkConflict warns if resolv.conf, which we last left holding our
+// config, has since been taken over by something else, and schedules
+// the next check.
+func (m *directManager) checkConflict() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stopConflictCheck = nil
+	if m.closed || !m.wroteOurs {
+		return
+	}
+	defer m.scheduleConflictCheckLocked()
+	if m.conflictWarned {
+		return
+	}
+	owned, err := m.ownedByTailscale()
+	if err != nil || owned {
+		return
+	}
+	m.conflictWarned = true
+	b, err := m.readFile(m.resolvConfPath)
+	if os.IsNotExist(err) {
+		m.logf("warning: %s was removed while Tailscale was managing it; DNS may not work until the next update", m.resolvConfPath)
+		return
+	}
+	owner := "an unknown program"
+	if info := parseResolvOwner(b); info.Owner != "" {
+		owner = info.Owner
+		if info.Detail != "" {
+			owner += " (" + info.Detail + ")"
+		}
+	}
+	m.logf("warning: %s was taken over by %s while Tailscale was managing it; Tailscale DNS settings are lost until the next update", m.resolvConfPath, owner)
+}
+
+// flushPending writes m.lastConfig if flappingLocked deferred it and
+// nothing has written a newer config since.
+func (m *directManager) flushPending() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stopFlush = nil
+	if !m.pending || m.suspended {
+		return
+	}
+	if m.flappingLocked(m.lastConfig) {
+		// Still flapping; flappingLocked rescheduled us.
+		return
+	}
+	if err := m.setDNSLocked(m.lastConfig); err != nil {
+		m.logf("writing deferred DNS config: %v", err)
+	}
+}
+
+// setDNSLocked writes config to resolv.conf, or restores the backup if
+// config is zero. m.mu must be held.
+func (m *directManager) setDNSLocked(config OSConfig) error {
+	wrote := false
+	if config.IsZero() {
+		if _, err := m.restoreBackup(); err != nil {
+			return err
+		}
+		m.removeSymlinkLocked()
+		m.wroteOurs, m.effective = false, OSConfig{}
+		m.removeManifest()
+	} else {
+		if m.refuseResolved && m.resolvedRunning() {
+			return fmt.Errorf("refusing to write %s: %w", m.resolvConfPath, errResolvedActive)
+		}
+		if m.alreadyWrittenLocked(config) {
+			return nil
+		}
+		if n := len(config.SearchDomains); m.searchWarnThreshold > 0 && n > m.searchWarnThreshold {
+			m.logf("warning: writing %d search domains; resolvers limited to %d ignore the rest, from %q on", n, m.searchWarnThreshold, config.SearchDomains[m.searchWarnThreshold])
+		}
+		var old []byte
+		if m.logDiffs {
+			// Best effort; a missing or unreadable file diffs as empty.
+			if isRegular, err := m.stat(m.resolvConfPath); err == nil && isRegular {
+				old, _ = m.readFile(m.resolvConfPath)
+			}
+		}
+		var buf bytes.Buffer
+		writeResolvConf(&buf, config.Nameservers, config.NameserverSources, config.SearchDomains, config.resolvOptions(), m.lineEnding)
+		contents := insertComments(buf.Bytes(), m.keptCommentsLocked(), m.lineEnding)
+		// Write the mirrors first, so that nothing needs undoing in
+		// resolv.conf if one fails.
+		undo, err := m.writeMirrors(contents)
+		if err != nil {
+			return err
+		}
+		if err := m.backupConfig(); err != nil {
+			undo()
+			return err
+		}
+		if err := m.writeOursLocked(contents); err != nil {
+			undo()
+			return err
+		}
+		if m.logDiffs {
+			for _, line := range diffLines(string(old), string(contents)) {
+				m.logf("[v1] %s: %s", m.resolvConfPath, line)
+			}
+		}
+		m.writeManifestLocked(config)
+		m.effective = config
+		m.wroteOurs, m.conflictWarned = true, false
+		m.scheduleConflictCheckLocked()
+		wrote = true
+	}
+
+	if !wrote {
+		// Restoring the backup hands DNS back to whatever managed it
+		// before, which needs no prodding.
+		return nil
+	}
+
+	// We might have taken over a configuration managed by resolved,
+	// in which case it will notice this on restart and gracefully
+	// start using our configuration. This shouldn't happen because we
+	// try to manage DNS through resolved when it's around, but as a
+	// best-effort fallback if we messed up the detection, try to
+	// restart resolved to make the system configuration consistent.
+	m.restartResolved()
+
+	if m.verifyName != "" {
+		m.verifyResolution()
+	}
+	return nil
+}
+
+// ourFile returns the file holding the config SetDNS writes:
+// resolv.conf, or the file it links to with DirectOptions.UseSymlink.
+func (m *directManager) ourFile() string {
+	if m.useSymlink {
+		return m.symlinkTarget
+	}
+	return m.resolvConfPath
+}
+
+// writeOursLocked writes contents, our config, to resolv.conf, or to
+// m.symlinkTarget with resolv.conf linking to it if m.useSymlink is
+// set. m.mu must be held.
+func (m *directManager) writeOursLocked(contents []byte) error {
+	if !m.useSymlink {
+		return m.atomicWriteFile(m.resolvConfPath, contents, m.fileMode)
+	}
+	if err := m.atomicWriteFile(m.symlinkTarget, contents, m.fileMode); err != nil {
+		return err
+	}
+	if m.linksToOurs() {
+		return nil
+	}
+	// Link relative to resolv.conf's directory, so that the link
+	// also resolves under DirectOptions.Root.
+	target, err := filepath.Rel(filepath.Dir(m.resolvConfPath), m.symlinkTarget)
+	if err != nil {
+		target = m.symlinkTarget
+	}
+	tmpName, err := m.tempNameFunc(m.resolvConfPath)
+	if err != nil {
+		return fmt.Errorf("linking %s: %w", m.resolvConfPath, err)
+	}
+	if err := m.fs.(symlinker).Symlink(target, tmpName); err != nil {
+		return fmt.Errorf("linking %s: %w", m.resolvConfPath, err)
+	}
+	// Renaming the new link over resolv.conf swaps it in atomically.
+	if err := m.fs.Rename(tmpName, m.resolvConfPath); err != nil {
+		m.fs.Remove(tmpName)
+		return fmt.Errorf("linking %s: %w", m.resolvConfPath, err)
+	}
+	return nil
+}
+
+// linksToOurs reports whether resolv.conf is a symlink to
+// m.symlinkTarget.
+func (m *directManager) linksToOurs() bool {
+	rl, ok := m.fs.(symlinkReader)
+	if !ok {
+		return false
+	}
+	target, err := rl.Readlink(m.resolvConfPath)
+	if err != nil {
+		return false
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(m.resolvConfPath), target)
+	}
+	return filepath.Clean(target) == m.symlinkTarget
+}
 
-	if _, err := m.fs.Stat(backupConf); err != nil {
-		if os.IsNotExist(err) {
-			// No backup, nothing we can do.
+// removeSymlinkLocked cleans up after DirectOptions.UseSymlink once
+// the backup has been restored: it removes resolv.conf if it still
+// links to m.symlinkTarget, as when there was no resolv.conf to back
+// up, and then m.symlinkTarget itself. m.mu must be held.
+func (m *directManager) removeSymlinkLocked() {
+	if !m.useSymlink {
+		return
+	}
+	if m.linksToOurs() {
+		m.fs.Remove(m.resolvConfPath)
+	}
+	m.fs.Remove(m.symlinkTarget)
+}
+
+// verifyResolution looks up m.verifyName and logs the outcome.
+func (m *directManager) verifyResolution() {
+	ctx, cancel := context.WithTimeout(context.Background(), m.probeTimeout)
+	defer cancel()
+	addrs, err := m.lookupHost(ctx, m.verifyName)
+	if err != nil {
+		m.logf("warning: DNS verification failed after writing %s: resolving %q: %v", m.resolvConfPath, m.verifyName, err)
+		return
+	}
+	m.logf("DNS verification: %q resolved to %v", m.verifyName, addrs)
+}
+
+// writeMirrors writes contents to each of m.mirrorFiles. If that fails
+// partway, it puts the files already written back as they were and
+// returns the error. Otherwise it returns a func that does the same,
+// for when a later step fails.
+func (m *directManager) writeMirrors(contents []byte) (undo func(), err error) {
+	type prev struct {
+		path     string
+		contents []byte // nil if the file didn't exist
+	}
+	var written []prev
+	undo = func() {
+		for i := len(written) - 1; i >= 0; i-- {
+			p := written[i]
+			var err error
+			if p.contents == nil {
+				err = m.fs.Remove(p.path)
+			} else {
+				err = m.atomicWriteFile(p.path, p.contents, m.fileMode)
+			}
+			if err != nil {
+				m.logf("rolling back %s: %v", p.path, err)
+			}
+		}
+	}
+	for _, path := range m.mirrorFiles {
+		old, err := m.readFile(path)
+		switch {
+		case os.IsNotExist(err):
+			old = nil
+		case err != nil:
+			undo()
+			return nil, err
+		case old == nil:
+			old = []byte{}
+		}
+		if err := m.atomicWriteFile(path, contents, m.fileMode); err != nil {
+			undo()
+			return nil, err
+		}
+		written = append(written, prev{path, old})
+	}
+	return undo, nil
+}
+
+// syncMirrors copies resolv.conf to each of m.mirrorFiles, logging
+// failures.
+func (m *directManager) syncMirrors() {
+	if len(m.mirrorFiles) == 0 {
+		return
+	}
+	b, err := m.readFile(m.resolvConfPath)
+	if err != nil {
+		m.logf("updating mirrors of %s: %v", m.resolvConfPath, err)
+		return
+	}
+	for _, path := range m.mirrorFiles {
+		if err := m.atomicWriteFile(path, b, m.fileMode); err != nil {
+			m.logf("updating %s: %v", path, err)
+		}
+	}
+}
+
+// diffLines returns a line-level diff turning a into b: the lines
+// only in a prefixed with "-", and those only in b with "+", in
+// order. Unchanged lines are omitted.
+func diffLines(a, b string) []string {
+	al := strings.Split(strings.TrimSuffix(a, "\n"), "\n")
+	bl := strings.Split(strings.TrimSuffix(b, "\n"), "\n")
+	if a == "" {
+		al = nil
+	}
+	if b == "" {
+		bl = nil
+	}
+	// lcs[i][j] is the length of the longest common subsequence of
+	// al[i:] and bl[j:]. Files are small, so quadratic is fine.
+	lcs := make([][]int, len(al)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bl)+1)
+	}
+	for i := len(al) - 1; i >= 0; i-- {
+		for j := len(bl) - 1; j >= 0; j-- {
+			if al[i] == bl[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var ret []string
+	i, j := 0, 0
+	for i < len(al) || j < len(bl) {
+		switch {
+		case i < len(al) && j < len(bl) && al[i] == bl[j]:
+			i++
+			j++
+		case j == len(bl) || (i < len(al) && lcs[i+1][j] >= lcs[i][j+1]):
+			ret = append(ret, "-"+al[i])
+			i++
+		default:
+			ret = append(ret, "+"+bl[j])
+			j++
+		}
+	}
+	return ret
+}
+
+// keptCommentsLocked returns the trailing comments to carry over from
+// the pre-Tailscale resolv.conf, if m.preserveComments is set. They're
+// read from resolv.conf itself while it's not ours yet, and otherwise
+// from its backup, as after a restart. m.mu must be held.
+func (m *directManager) keptCommentsLocked() []string {
+	if !m.preserveComments || m.keptCommentsLoaded {
+		return m.keptComments
+	}
+	owned, err := m.ownedByTailscale()
+	if err != nil {
+		// Try again next time.
+		return nil
+	}
+	src := m.resolvConfPath
+	if owned {
+		if src, err = m.findBackup(); err != nil {
 			return nil
 		}
-		return err
+	}
+	var b []byte
+	if src != "" {
+		if isRegular, err := m.stat(src); err == nil && isRegular {
+			b, _ = m.readFile(src)
+		}
+		if _, contents, ok := decodeBackup(b); ok {
+			b = contents
+		}
+	}
+	m.keptComments = trailingComments(b)
+	m.keptCommentsLoaded = true
+	return m.keptComments
+}
+
+// alreadyWrittenLocked reports whether resolv.conf is already a
+// Tailscale-generated file expressing config. The files are compared
+// parsed rather than byte-wise, so that reformatting (by a human or
+// another tool) doesn't trigger needless rewrites. m.mu must be held.
+func (m *directManager) alreadyWrittenLocked(config OSConfig) bool {
+	if m.useSymlink && !m.linksToOurs() {
+		// Our config, but not linked the way it's wanted.
+		return false
 	}
 	owned, err := m.ownedByTailscale()
+	if err != nil || !owned {
+		return false
+	}
+	cur, err := m.readResolvConf()
 	if err != nil {
-		return err
+		return false
 	}
-	_, err = m.fs.Stat(resolvConf)
-	if err != nil && !os.IsNotExist(err) {
+	// Only compare what resolv.conf can express.
+	want := OSConfig{
+		Nameservers:   config.Nameservers,
+		SearchDomains: config.SearchDomains,
+		Options:       config.resolvOptions(),
+	}
+	return cur.Normalize().Equal(want)
+}
+
+// Suspend temporarily stops managing resolv.conf without tearing
+// down: the pre-Tailscale backup is restored, and configs passed to
+// SetDNS are remembered but not written until Resume is called.
+// Suspending an already-suspended manager is a no-op.
+func (m *directManager) Suspend() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.suspended {
+		return nil
+	}
+	if _, err := m.restoreBackup(); err != nil {
 		return err
 	}
-	resolvConfExists := !os.IsNotExist(err)
+	m.removeSymlinkLocked()
+	m.wroteOurs, m.effective = false, OSConfig{}
+	// Resume re-applies lastConfig, deferred or not.
+	m.cancelPendingLocked()
+	m.suspended = true
+	return nil
+}
 
-	if resolvConfExists && !owned {
-		// There's already a non-tailscale config in place, get rid of
-		// our backup.
-		m.fs.Remove(backupConf)
+// Resume resumes managing resolv.conf after Suspend, re-applying the
+// most recent config given to SetDNS. It's a no-op if the manager
+// isn't suspended.
+func (m *directManager) Resume() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.suspended || m.closed {
 		return nil
 	}
+	m.suspended = false
+	if m.lastConfig.IsZero() {
+		return nil
+	}
+	return m.setDNSLocked(m.lastConfig)
+}
 
-	// We own resolv.conf, and a backup exists.
-	if err := m.fs.Rename(backupConf, resolvConf); err != nil {
-		return err
+func (m *directManager) SupportsSplitDNS() bool {
+	return false
+}
+
+func (m *directManager) Features() ManagerFeatures {
+	return FeatureResolvConf
+}
+
+// CanRepresent reports whether resolv.conf can hold all of cfg: it has
+// no UnsupportedFields, and no reverse zones among its search domains,
+// where they do nothing useful.
+func (m *directManager) CanRepresent(cfg OSConfig) bool {
+	if len(m.UnsupportedFields(cfg)) > 0 {
+		return false
+	}
+	for _, d := range cfg.SearchDomains {
+		if isReverseZone(d) {
+			return false
+		}
 	}
+	return true
+}
 
-	if isResolvedRunning() {
-		exec.Command("systemctl", "restart", "systemd-resolved.service").Run() // Best-effort.
+// UnsupportedFields returns the names of the fields set in config
+// that SetDNS would drop, as resolv.conf, or on musl its resolver,
+// has no way to express them. Callers can use it to warn users.
+func (m *directManager) UnsupportedFields(config OSConfig) []string {
+	var ret []string
+	// resolv.conf's nameservers already get every query, so a
+	// catch-all match domain loses nothing.
+	if match, _ := config.splitMatchDomains(); len(match) > 0 {
+		ret = append(ret, "MatchDomains")
+	}
+	if len(config.Routes) > 0 {
+		ret = append(ret, "Routes")
+	}
+	for _, port := range config.NameserverPorts {
+		if port != 53 {
+			ret = append(ret, "NameserverPorts")
+			break
+		}
+	}
+	if !m.isMusl() {
+		return ret
+	}
+	for _, opt := range config.Options {
+		if !isMuslOption(opt) {
+			ret = append(ret, "Options")
+			break
+		}
+	}
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{
+		{config.TrustAD, "TrustAD"},
+		{config.NoAAAA, "NoAAAA"},
+		{config.SingleRequest, "SingleRequest"},
+		{config.SingleRequestReopen, "SingleRequestReopen"},
+		{config.Debug, "Debug"},
+	} {
+		if f.set {
+			ret = append(ret, f.name)
+		}
+	}
+	return ret
+}
+
+func (m *directManager) GetBaseConfig() (OSConfig, error) {
+	cfg, err := m.getBaseConfig()
+	if err != nil {
+		return OSConfig{}, err
+	}
+	if m.dropInDir != "" {
+		cfg = m.mergeDropIns(cfg)
+	}
+	// A base config pointing back at us, as left by a botched earlier
+	// run, would make quad-100 forward to itself.
+	var keep []netaddr.IP
+	for _, ip := range cfg.Nameservers {
+		if ip == tsaddr.TailscaleServiceIP() || (m.filterCGNATBase && tsaddr.CGNATRange().Contains(ip)) {
+			m.logf("warning: ignoring base nameserver %v: it's a Tailscale address", ip)
+			continue
+		}
+		keep = append(keep, ip)
+	}
+	cfg.Nameservers = keep
+	return cfg, nil
+}
+
+// mergeDropIns returns cfg with the settings from the "*.conf" files
+// in m.dropInDir appended, in lexical order of file name. Fragments
+// that can't be read or parsed are logged and skipped.
+func (m *directManager) mergeDropIns(cfg OSConfig) OSConfig {
+	lister, ok := m.fs.(dirLister)
+	if !ok {
+		m.logf("ignoring %s: %T can't list directories", m.dropInDir, m.fs)
+		return cfg
+	}
+	names, err := m.readDir(lister, m.dropInDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			m.logf("reading %s: %v", m.dropInDir, err)
+		}
+		return cfg
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".conf") {
+			continue
+		}
+		frag, err := m.readBaseResolvFile(path.Join(m.dropInDir, name))
+		if err != nil {
+			m.logf("ignoring %s: %v", path.Join(m.dropInDir, name), err)
+			continue
+		}
+		cfg.Nameservers = append(cfg.Nameservers, frag.Nameservers...)
+		cfg.SearchDomains = append(cfg.SearchDomains, frag.SearchDomains...)
+		cfg.Options = append(cfg.Options, frag.Options...)
+	}
+	return cfg
+}
+
+func (m *directManager) getBaseConfig() (OSConfig, error) {
+	if m.baseConfigFile != "" {
+		cfg, err := m.readBaseResolvFile(m.baseConfigFile)
+		switch {
+		case err == nil:
+			return cfg, nil
+		case !os.IsNotExist(err):
+			m.logf("ignoring base config file %s: %v", m.baseConfigFile, err)
+		}
+	}
+
+	owned, err := m.ownedByTailscale()
+	if err != nil {
+		return OSConfig{}, err
+	}
+	if !owned {
+		// Don't try to read a FIFO or device; it might never return.
+		isRegular, err := m.stat(m.resolvConfPath)
+		if err == nil && !isRegular {
+			return OSConfig{}, fmt.Errorf("reading %s: %w", m.resolvConfPath, errNotRegularFile)
+		}
+		return m.readBaseResolvFile(m.resolvConfPath)
+	}
+
+	if m.noBackup {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if !m.haveNoBackupBase {
+			return OSConfig{}, fmt.Errorf("base config of %s not known: taken over without a backup", m.resolvConfPath)
+		}
+		return m.noBackupBase, nil
+	}
+	backup, err := m.findBackup()
+	if err != nil {
+		return OSConfig{}, err
+	}
+	fileToRead := m.backupPath
+	if backup != "" {
+		fileToRead = backup
+	}
+	cfg, err := m.readBaseResolvFile(fileToRead)
+	if err != nil {
+		// We replaced resolv.conf, so there should be a usable backup.
+		metricBackupInvalid.Add(1)
+	}
+	return cfg, err
+}
+
+// Close restores the pre-Tailscale resolv.conf. Once it has succeeded,
+// further calls do nothing and return nil, so it's safe to call from
+// several cleanup paths. A SetDNS already writing when Close is called
+// finishes first, and its config is then torn down; one that gets the
+// lock after Close fails with errClosed, writing nothing.
+func (m *directManager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil
+	}
+
+	// We used to keep a file for the tailscale config and symlinked
+	// to it, but then we stopped because /etc/resolv.conf being a
+	// symlink to surprising places breaks snaps and other sandboxing
+	// things. Clean it up if it's still there, unless UseSymlink
+	// wants it, in which case removeSymlinkLocked does once resolv.conf
+	// no longer points there.
+	if !m.useSymlink {
+		m.fs.Remove(legacyTailscaleConf)
 	}
 
+	m.cancelPendingLocked()
+	if _, err := m.restoreBackup(); err != nil {
+		return err
+	}
+	m.removeSymlinkLocked()
+	m.removeManifest()
+	m.wroteOurs, m.effective = false, OSConfig{}
+	if m.stopConflictCheck != nil {
+		m.stopConflictCheck()
+		m.stopConflictCheck = nil
+	}
+	m.closed = true
 	return nil
 }
 
-func atomicWriteFile(fs wholeFileFS, filename string, data []byte, perm os.FileMode) error {
+// RepairResolvConf adds the missing final newline to resolv.conf, if
+// it's ours and an editor has stripped it, without otherwise touching
+// the config. Some strict resolvers ignore an unterminated last line.
+// Files SetDNS writes always end in a newline.
+func (m *directManager) RepairResolvConf() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	owned, err := m.ownedByTailscale()
+	if err != nil || !owned {
+		return err
+	}
+	b, err := m.readFile(m.resolvConfPath)
+	if err != nil {
+		return err
+	}
+	if len(b) == 0 || b[len(b)-1] == '\n' {
+		return nil
+	}
+	m.logf("repairing %s: adding missing final newline", m.resolvConfPath)
+	return m.atomicWriteFile(m.ourFile(), append(b, m.lineEnding.newline()...), m.fileMode)
+}
+
+// randomTempName returns a unique name for a temporary file next to
+// filename.
+func randomTempName(filename string) (string, error) {
 	var randBytes [12]byte
 	if _, err := rand.Read(randBytes[:]); err != nil {
-		return fmt.Errorf("atomicWriteFile: %w", err)
+		return "", err
+	}
+	return fmt.Sprintf("%s.%x.tmp", filename, randBytes[:]), nil
+}
+
+// AddSearchDomains appends domains that aren't already there to the
+// search list of the Tailscale-managed resolv.conf, leaving the rest
+// of the file as it is. It fails if resolv.conf isn't Tailscale's.
+func (m *directManager) AddSearchDomains(domains ...dnsname.FQDN) error {
+	return m.editSearchDomains(func(cur []dnsname.FQDN) []dnsname.FQDN {
+		return append(cur[:len(cur):len(cur)], domains...)
+	})
+}
+
+// RemoveSearchDomains removes domains from the search list of the
+// Tailscale-managed resolv.conf, leaving the rest of the file as it
+// is. It fails if resolv.conf isn't Tailscale's.
+func (m *directManager) RemoveSearchDomains(domains ...dnsname.FQDN) error {
+	drop := map[dnsname.FQDN]bool{}
+	for _, d := range normalizeDomains(domains) {
+		drop[d] = true
+	}
+	return m.editSearchDomains(func(cur []dnsname.FQDN) []dnsname.FQDN {
+		var ret []dnsname.FQDN
+		for _, d := range cur {
+			if !drop[d] {
+				ret = append(ret, d)
+			}
+		}
+		return ret
+	})
+}
+
+// editSearchDomains replaces the search line of resolv.conf with the
+// normalized result of edit, which is passed the current normalized
+// search domains.
+func (m *directManager) editSearchDomains(edit func([]dnsname.FQDN) []dnsname.FQDN) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	owned, err := m.ownedByTailscale()
+	if err != nil {
+		return err
+	}
+	if !owned {
+		return fmt.Errorf("editing search domains: %s is %w", m.resolvConfPath, errNotOwned)
+	}
+	b, err := m.readFile(m.resolvConfPath)
+	if err != nil {
+		return err
+	}
+	cfg, err := readResolv(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	cur := normalizeDomains(cfg.SearchDomains)
+	next := normalizeDomains(edit(cur))
+	if fqdnsEqual(cur, next) {
+		return nil
+	}
+	if err := m.atomicWriteFile(m.ourFile(), replaceSearchLine(b, next), m.fileMode); err != nil {
+		return err
+	}
+	// Keep Resume from undoing the edit.
+	m.lastConfig.SearchDomains = next
+	if m.wroteOurs {
+		m.effective.SearchDomains = next
+	}
+	m.syncMirrors()
+	return nil
+}
+
+// replaceSearchLine returns resolv.conf contents b with its search
+// lines replaced by a single one for domains, or none if domains is
+// empty. A new search line goes after the nameservers, where
+// writeResolvConf puts it.
+func replaceSearchLine(b []byte, domains []dnsname.FQDN) []byte {
+	var search string
+	if len(domains) > 0 {
+		words := make([]string, len(domains))
+		for i, d := range domains {
+			words[i] = d.WithoutTrailingDot()
+		}
+		search = "search " + strings.Join(words, " ")
+		if bytes.Contains(b, []byte("\r\n")) {
+			// Keep the file's CRLF line endings.
+			search += "\r"
+		}
+	}
+	var out []string
+	replaced := false
+	lastNameserver := -1
+	for _, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		keyword, _ := resolvKeyword(line)
+		switch keyword {
+		case "search":
+			if !replaced && search != "" {
+				out = append(out, search)
+			}
+			replaced = true
+			continue
+		case "nameserver":
+			lastNameserver = len(out)
+		}
+		out = append(out, line)
+	}
+	if !replaced && search != "" {
+		i := lastNameserver + 1
+		if lastNameserver < 0 {
+			i = len(out)
+		}
+		out = append(out[:i], append([]string{search}, out[i:]...)...)
 	}
+	return []byte(strings.Join(out, "\n") + "\n")
+}
+
+// EffectiveConfig returns the config SetDNS last wrote to resolv.conf,
+// as written: after invalid and duplicate nameservers were dropped,
+// nameservers reordered and truncated, and domains and options
+// normalized. It's the zero OSConfig if resolv.conf doesn't currently
+// hold a config of ours, as before the first SetDNS or after the
+// original has been restored.
+func (m *directManager) EffectiveConfig() OSConfig {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.effective
+}
 
-	tmpName := fmt.Sprintf("%s.%x.tmp", filename, randBytes[:])
-	defer fs.Remove(tmpName)
+// UsingCopyFallback reports whether m has had to fall back from
+// renaming files into place to copying or overwriting them, so that
+// its writes to resolv.conf are no longer atomic. Once true, it stays
+// true.
+func (m *directManager) UsingCopyFallback() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.renameBroken
+}
 
-	if err := fs.WriteFile(tmpName, data, perm); err != nil {
+// atomicWriteFile writes data to filename by writing it to a temporary
+// file in the same directory and renaming that into place.
+//
+// In some locked-down containers, /etc isn't writable but a
+// bind-mounted /etc/resolv.conf is, so the temporary file can't be
+// created. In that case (a permission or read-only filesystem error)
+// atomicWriteFile falls back to writing filename in place. That opens
+// a short window where readers can see a partial file, but beats not
+// configuring DNS at all. Other errors, like a full disk, are
+// returned: writing in place then would likely leave resolv.conf
+// truncated.
+func (m *directManager) atomicWriteFile(filename string, data []byte, perm os.FileMode) error {
+	tmpName, err := m.tempNameFunc(filename)
+	if err != nil {
 		return fmt.Errorf("atomicWriteFile: %w", err)
 	}
-	return fs.Rename(tmpName, filename)
+	defer m.fs.Remove(tmpName)
+
+	if err := m.fs.WriteFile(tmpName, data, perm); err != nil {
+		if !os.IsPermission(err) && !errors.Is(err, syscall.EROFS) {
+			return fmt.Errorf("atomicWriteFile: %w", err)
+		}
+		m.logf("atomicWriteFile: creating temp file for %s failed (%v), writing it in place instead", filename, err)
+		m.renameBroken = true
+		if err := m.fs.WriteFile(filename, data, perm); err != nil {
+			return fmt.Errorf("atomicWriteFile: %w", err)
+		}
+		return nil
+	}
+	return m.fs.Rename(tmpName, filename)
 }
 
-// wholeFileFS is a high-level file system abstraction designed just for use
+// WholeFileFS is a high-level file system abstraction designed just for use
 // by directManager, with the goal that it is easy to implement over wsl.exe.
+// It's exported so that NewDirectManager can be given other
+// implementations.
 //
 // All name parameters are absolute paths.
-type wholeFileFS interface {
+type WholeFileFS interface {
 	Stat(name string) (isRegular bool, err error)
 	Rename(oldName, newName string) error
 	Remove(name string) error
-	ReadFile(name string) ([]byte, error)
+	// ReadFile returns the contents of name. If maxSize is positive
+	// and the file is larger than that, it returns ErrFileTooLarge
+	// after reading at most maxSize+1 bytes.
+	ReadFile(name string, maxSize int64) ([]byte, error)
 	WriteFile(name string, contents []byte, perm os.FileMode) error
 }
 
-// directFS is a wholeFileFS implemented directly on the OS.
+// dirLister is implemented by WholeFileFS implementations that can
+// list directories, for DirectOptions.DropInDir.
+type dirLister interface {
+	// ReadDir returns the names of the regular files in the
+	// directory dir.
+	ReadDir(dir string) ([]string, error)
+}
+
+// symlinkReader is implemented by WholeFileFS implementations that
+// can see symlinks, for migrating from legacyTailscaleConf.
+type symlinkReader interface {
+	// Readlink returns the target of the symlink name. It returns an
+	// error if name doesn't exist or isn't a symlink.
+	Readlink(name string) (string, error)
+}
+
+// lineEndingFS is implemented by WholeFileFS implementations whose
+// resolv.conf needs line endings other than LineEndingLF.
+type lineEndingFS interface {
+	// LineEnding returns the line ending for files SetDNS writes.
+	LineEnding() LineEnding
+}
+
+// symlinker is implemented by WholeFileFS implementations that can
+// make symlinks, for DirectOptions.UseSymlink.
+type symlinker interface {
+	// Symlink creates name as a symlink to target.
+	Symlink(target, name string) error
+}
+
+// sameFiler is implemented by WholeFileFS implementations that can
+// tell whether two names are links to the same file.
+type sameFiler interface {
+	// SameFile reports whether a and b are the same file (device
+	// and inode).
+	SameFile(a, b string) (bool, error)
+}
+
+// immutableChecker is implemented by WholeFileFS implementations that
+// can tell whether a file has been made immutable, for Preflight.
+type immutableChecker interface {
+	IsImmutable(name string) (bool, error)
+}
+
+// metaFS is implemented by WholeFileFS implementations that can read
+// and set file metadata, for DirectOptions.BackupMetadata.
+type metaFS interface {
+	// FileMeta returns the metadata of name.
+	FileMeta(name string) (fileMeta, error)
+	// SetFileMeta applies meta to name. The owner is only changed if
+	// meta.UID and meta.GID are both known.
+	SetFileMeta(name string, meta fileMeta) error
+}
+
+// directFS is a WholeFileFS implemented directly on the OS.
 type directFS struct {
 	// prefix is file path prefix.
 	//
@@ -378,10 +3052,87 @@ func (fs directFS) Rename(oldName, newName string) error {
 
 func (fs directFS) Remove(name string) error { return os.Remove(fs.path(name)) }
 
-func (fs directFS) ReadFile(name string) ([]byte, error) {
-	return ioutil.ReadFile(fs.path(name))
+func (fs directFS) Readlink(name string) (string, error) { return os.Readlink(fs.path(name)) }
+
+func (fs directFS) Symlink(target, name string) error {
+	return os.Symlink(target, fs.path(name))
+}
+
+func (fs directFS) SameFile(a, b string) (bool, error) {
+	afi, err := os.Stat(fs.path(a))
+	if err != nil {
+		return false, err
+	}
+	bfi, err := os.Stat(fs.path(b))
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(afi, bfi), nil
+}
+
+func (fs directFS) FileMeta(name string) (fileMeta, error) {
+	fi, err := os.Stat(fs.path(name))
+	if err != nil {
+		return fileMeta{}, err
+	}
+	uid, gid := fileOwner(fi)
+	return fileMeta{Mode: fi.Mode().Perm(), UID: uid, GID: gid, ModTime: fi.ModTime()}, nil
+}
+
+func (fs directFS) SetFileMeta(name string, meta fileMeta) error {
+	p := fs.path(name)
+	if err := os.Chmod(p, meta.Mode.Perm()); err != nil {
+		return err
+	}
+	if meta.UID >= 0 && meta.GID >= 0 {
+		if err := os.Chown(p, meta.UID, meta.GID); err != nil {
+			return err
+		}
+	}
+	if !meta.ModTime.IsZero() {
+		return os.Chtimes(p, meta.ModTime, meta.ModTime)
+	}
+	return nil
+}
+
+func (fs directFS) ReadDir(dir string) ([]string, error) {
+	fis, err := ioutil.ReadDir(fs.path(dir))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() {
+			names = append(names, fi.Name())
+		}
+	}
+	return names, nil
+}
+
+func (fs directFS) ReadFile(name string, maxSize int64) ([]byte, error) {
+	if maxSize <= 0 {
+		return ioutil.ReadFile(fs.path(name))
+	}
+	f, err := os.Open(fs.path(name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(f, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > maxSize {
+		return nil, ErrFileTooLarge
+	}
+	return b, nil
 }
 
 func (fs directFS) WriteFile(name string, contents []byte, perm os.FileMode) error {
-	return ioutil.WriteFile(fs.path(name), contents, perm)
+	if err := ioutil.WriteFile(fs.path(name), contents, perm); err != nil {
+		return err
+	}
+	// WriteFile only applies perm, less the umask, to new files. Set
+	// it exactly, as wslFS does.
+	return os.Chmod(fs.path(name), perm)
 }
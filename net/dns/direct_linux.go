@@ -0,0 +1,26 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// IsImmutable reports whether name has the immutable attribute
+// (chattr +i), which stops even root from replacing it.
+func (fs directFS) IsImmutable(name string) (bool, error) {
+	f, err := os.Open(fs.path(name))
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	flags, err := unix.IoctlGetUint32(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		return false, err
+	}
+	return flags&unix.FS_IMMUTABLE_FL != 0, nil
+}
@@ -5,12 +5,23 @@
 package dns
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"inet.af/netaddr"
+	"tailscale.com/types/logger"
 	"tailscale.com/util/dnsname"
 )
 
@@ -44,7 +55,7 @@ func TestSetDNS(t *testing.T) {
 		}
 	}
 
-	m := directManager{fs: directFS{prefix: tmp}}
+	m := newDirectManagerOnFS(t.Logf, directFS{prefix: tmp})
 	if err := m.SetDNS(OSConfig{
 		Nameservers:   []netaddr.IP{netaddr.MustParseIP("8.8.8.8"), netaddr.MustParseIP("8.8.4.4")},
 		SearchDomains: []dnsname.FQDN{"ts.net.", "ts-dns.test."},
@@ -81,3 +92,3201 @@ search ts.net ts-dns.test
 	}
 	assertBaseState(t)
 }
+
+// blockingFS is a WholeFileFS whose Stat and ReadFile block until
+// unblock is closed, like calls on a hung NFS mount.
+type blockingFS struct {
+	directFS
+	unblock chan struct{}
+}
+
+func (fs blockingFS) Stat(name string) (isRegular bool, err error) {
+	<-fs.unblock
+	return fs.directFS.Stat(name)
+}
+
+func (fs blockingFS) ReadFile(name string, maxSize int64) ([]byte, error) {
+	<-fs.unblock
+	return fs.directFS.ReadFile(name, maxSize)
+}
+
+func TestGetBaseConfigTimeout(t *testing.T) {
+	tmp := t.TempDir()
+	resolvPath := filepath.Join(tmp, "etc", "resolv.conf")
+	if err := os.MkdirAll(filepath.Dir(resolvPath), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(resolvPath, []byte("nameserver 8.8.8.8\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := blockingFS{
+		directFS: directFS{prefix: tmp},
+		unblock:  make(chan struct{}),
+	}
+	defer close(fs.unblock)
+
+	m := newDirectManagerWithOptions(t.Logf, fs, DirectOptions{ReadTimeout: 10 * time.Millisecond})
+	if _, err := m.GetBaseConfig(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("GetBaseConfig error = %v; want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestBoundedReads(t *testing.T) {
+	tmp := t.TempDir()
+	resolvPath := filepath.Join(tmp, "etc", "resolv.conf")
+	if err := os.MkdirAll(filepath.Dir(resolvPath), 0777); err != nil {
+		t.Fatal(err)
+	}
+	big := "nameserver 8.8.8.8\n" + strings.Repeat("# padding\n", 200)
+	if err := ioutil.WriteFile(resolvPath, []byte(big), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every read of resolv.conf goes through the same limits.
+	reads := map[string]func(m *directManager) error{
+		"GetBaseConfig": func(m *directManager) error {
+			_, err := m.GetBaseConfig()
+			return err
+		},
+		"ownedByTailscale": func(m *directManager) error {
+			_, err := m.ownedByTailscale()
+			return err
+		},
+		"readResolvFile": func(m *directManager) error {
+			_, err := m.readResolvFile(resolvConf)
+			return err
+		},
+	}
+
+	m := newDirectManagerOnFS(t.Logf, directFS{prefix: tmp})
+	m.maxFileSize = 1024
+	for name, read := range reads {
+		if err := read(m); !errors.Is(err, ErrFileTooLarge) {
+			t.Errorf("%s over the size limit: error = %v; want %v", name, err, ErrFileTooLarge)
+		}
+	}
+
+	fs := blockingFS{
+		directFS: directFS{prefix: tmp},
+		unblock:  make(chan struct{}),
+	}
+	defer close(fs.unblock)
+	m = newDirectManagerWithOptions(t.Logf, fs, DirectOptions{ReadTimeout: 10 * time.Millisecond})
+	for name, read := range reads {
+		if err := read(m); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s on a hung FS: error = %v; want %v", name, err, context.DeadlineExceeded)
+		}
+	}
+}
+
+// noTempFS is a WholeFileFS that fails to create temporary files with
+// err, like a container whose /etc is read-only apart from a
+// bind-mounted resolv.conf.
+type noTempFS struct {
+	directFS
+	err error
+}
+
+func (fs noTempFS) WriteFile(name string, contents []byte, perm os.FileMode) error {
+	if strings.HasSuffix(name, ".tmp") {
+		return fs.err
+	}
+	return fs.directFS.WriteFile(name, contents, perm)
+}
+
+func TestAtomicWriteFileFallback(t *testing.T) {
+	const orig = "nameserver 9.9.9.9\n"
+	tests := []struct {
+		name         string
+		err          error
+		wantFallback bool
+	}{
+		{"permission", os.ErrPermission, true},
+		{"read-only", &os.PathError{Op: "open", Path: "/etc/x.tmp", Err: syscall.EROFS}, true},
+		{"disk-full", &os.PathError{Op: "write", Path: "/etc/x.tmp", Err: syscall.ENOSPC}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmp := t.TempDir()
+			resolvPath := filepath.Join(tmp, "etc", "resolv.conf")
+			if err := os.MkdirAll(filepath.Dir(resolvPath), 0777); err != nil {
+				t.Fatal(err)
+			}
+
+			var logBuf strings.Builder
+			logf := func(format string, a ...interface{}) {
+				fmt.Fprintf(&logBuf, format+"\n", a...)
+			}
+			m := newDirectManagerOnFS(logf, noTempFS{directFS{prefix: tmp}, tt.err})
+			if err := m.atomicWriteFile(resolvConf, []byte(orig), 0644); err != nil {
+				if tt.wantFallback {
+					t.Fatal(err)
+				}
+				if !errors.Is(err, syscall.ENOSPC) {
+					t.Errorf("atomicWriteFile error = %v; want ENOSPC", err)
+				}
+			} else if !tt.wantFallback {
+				t.Fatalf("atomicWriteFile succeeded; want error")
+			}
+
+			b, err := ioutil.ReadFile(resolvPath)
+			if tt.wantFallback {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(b) != orig {
+					t.Errorf("resolv.conf = %q; want %q", b, orig)
+				}
+				if !strings.Contains(logBuf.String(), "writing it in place") {
+					t.Errorf("fallback not logged; got logs:\n%s", logBuf.String())
+				}
+			} else if !os.IsNotExist(err) {
+				t.Errorf("resolv.conf written in place despite %v: %q, %v", tt.err, b, err)
+			}
+		})
+	}
+}
+
+func TestDirectManagerFeatures(t *testing.T) {
+	f := newDirectManager(t.Logf).Features()
+	if !f.Has(FeatureResolvConf) {
+		t.Errorf("directManager features %b lack FeatureResolvConf", f)
+	}
+	for _, unsupported := range []ManagerFeatures{FeatureSplitDNS, FeatureReverseZones, FeatureMultiInterface} {
+		if f.Has(unsupported) {
+			t.Errorf("directManager features %b include unsupported %b", f, unsupported)
+		}
+	}
+}
+
+func TestReadResolvFileSizeLimit(t *testing.T) {
+	tmp := t.TempDir()
+	resolvPath := filepath.Join(tmp, "etc", "resolv.conf")
+	if err := os.MkdirAll(filepath.Dir(resolvPath), 0777); err != nil {
+		t.Fatal(err)
+	}
+	big := "nameserver 8.8.8.8\n" + strings.Repeat("# padding\n", 200)
+	if err := ioutil.WriteFile(resolvPath, []byte(big), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := newDirectManagerOnFS(t.Logf, directFS{prefix: tmp})
+	m.maxFileSize = 1024
+	if _, err := m.GetBaseConfig(); !errors.Is(err, ErrFileTooLarge) {
+		t.Fatalf("GetBaseConfig error = %v; want %v", err, ErrFileTooLarge)
+	}
+
+	m.maxFileSize = len(big)
+	if _, err := m.GetBaseConfig(); err != nil {
+		t.Fatalf("GetBaseConfig at exactly the limit: %v", err)
+	}
+}
+
+func TestReadResolvFileEndless(t *testing.T) {
+	if _, err := os.Stat("/dev/zero"); err != nil {
+		t.Skipf("no /dev/zero: %v", err)
+	}
+	tmp := t.TempDir()
+	resolvPath := filepath.Join(tmp, "etc", "resolv.conf")
+	if err := os.MkdirAll(filepath.Dir(resolvPath), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/dev/zero", resolvPath); err != nil {
+		t.Skipf("can't symlink: %v", err)
+	}
+
+	m := newDirectManagerOnFS(t.Logf, directFS{prefix: tmp})
+	if _, err := m.GetBaseConfig(); !errors.Is(err, ErrFileTooLarge) {
+		t.Fatalf("GetBaseConfig error = %v; want %v", err, ErrFileTooLarge)
+	}
+	// ownedByTailscale reads resolv.conf too, but /dev/zero isn't a
+	// regular file, so it mustn't even try.
+	if _, err := m.ownedByTailscale(); err != nil {
+		t.Fatalf("ownedByTailscale: %v", err)
+	}
+}
+
+func TestParseResolvOwner(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want resolvOwnerInfo
+	}{
+		{
+			name: "systemd-resolved",
+			in: `# This file is managed by man:systemd-resolved(8). Do not edit.
+#
+# Third party programs must not access this file directly, but only through the
+# symlink at /etc/resolv.conf. To manage man:resolv.conf(5) in a different way,
+# replace this symlink by a static file or a different symlink.
+
+nameserver 127.0.0.53
+`,
+			want: resolvOwnerInfo{Owner: "systemd-resolved", Detail: "/etc/resolv.conf"},
+		},
+		{
+			name: "NetworkManager",
+			in:   "# Generated by NetworkManager 1.26.6\nsearch lan\nnameserver 192.168.1.1\n",
+			want: resolvOwnerInfo{Owner: "NetworkManager", Detail: "1.26.6"},
+		},
+		{
+			name: "debian-resolvconf",
+			in: `# Dynamic resolv.conf(5) file for glibc resolver(3) generated by resolvconf(8)
+#     DO NOT EDIT THIS FILE BY HAND -- YOUR CHANGES WILL BE OVERWRITTEN
+# 127.0.0.1 is a local caching resolver, see /run/resolvconf/interface
+nameserver 127.0.0.1
+`,
+			want: resolvOwnerInfo{Owner: "resolvconf", Detail: "/run/resolvconf/interface"},
+		},
+		{
+			name: "openresolv",
+			in:   "# Generated by resolvconf\nnameserver 10.0.0.1\n",
+			want: resolvOwnerInfo{Owner: "resolvconf"},
+		},
+		{
+			name: "cloud-init",
+			in: `# Your system has been configured with 'manage-resolv-conf' set to true.
+# As a result, cloud-init has written this file with configuration data
+# that it has been provided. Cloud-init, by default, will write this file
+# a single time (PER_ONCE).
+#
+nameserver 10.0.0.2
+search ec2.internal
+`,
+			want: resolvOwnerInfo{Owner: "cloud-init"},
+		},
+		{
+			name: "unowned",
+			in:   "nameserver 8.8.8.8\n# Generated by NetworkManager\n",
+			want: resolvOwnerInfo{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseResolvOwner([]byte(tt.in))
+			if got != tt.want {
+				t.Errorf("parseResolvOwner = %+v; want %+v", got, tt.want)
+			}
+			if owner := resolvOwner([]byte(tt.in)); owner != tt.want.Owner {
+				t.Errorf("resolvOwner = %q; want %q", owner, tt.want.Owner)
+			}
+		})
+	}
+}
+
+// movedBackup is a DirectOptions.BackupFile for tests of backups left
+// at backupConf before the option was set.
+const movedBackup = "/var/lib/tailscale/resolv.pre-tailscale-backup.conf"
+
+func TestRestoreBackupFromDefaultPath(t *testing.T) {
+	const orig = "nameserver 9.9.9.9\n"
+	tmp := t.TempDir()
+	resolvPath := filepath.Join(tmp, "etc", "resolv.conf")
+	oldPath := filepath.Join(tmp, backupConf)
+	if err := os.MkdirAll(filepath.Dir(resolvPath), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(oldPath, []byte(orig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(resolvPath, []byte("# resolv.conf(5) file generated by tailscale\nnameserver 100.100.100.100\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := newDirectManagerWithOptions(t.Logf, directFS{prefix: tmp}, DirectOptions{BackupFile: movedBackup})
+	m.restartResolved = func() {}
+	base, err := m.GetBaseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []netaddr.IP{netaddr.MustParseIP("9.9.9.9")}; !reflect.DeepEqual(base.Nameservers, want) {
+		t.Errorf("GetBaseConfig nameservers = %v; want %v", base.Nameservers, want)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(resolvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != orig {
+		t.Errorf("resolv.conf after Close = %q; want backup %q", b, orig)
+	}
+	if _, err := os.Stat(oldPath); !os.IsNotExist(err) {
+		t.Errorf("backup at %s still present after restore: %v", backupConf, err)
+	}
+}
+
+func TestTakeoverRemovesDefaultPathBackup(t *testing.T) {
+	const orig = "nameserver 9.9.9.9\n"
+	tmp := t.TempDir()
+	resolvPath := filepath.Join(tmp, "etc", "resolv.conf")
+	backupPath := filepath.Join(tmp, movedBackup)
+	oldPath := filepath.Join(tmp, backupConf)
+	for _, dir := range []string{filepath.Dir(resolvPath), filepath.Dir(backupPath)} {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(oldPath, []byte("nameserver 1.2.3.4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(resolvPath, []byte(orig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := newDirectManagerWithOptions(t.Logf, directFS{prefix: tmp}, DirectOptions{BackupFile: movedBackup})
+	m.restartResolved = func() {}
+	if err := m.SetDNS(OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(backupPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != orig {
+		t.Errorf("backup = %q; want %q", b, orig)
+	}
+	if _, err := os.Stat(oldPath); !os.IsNotExist(err) {
+		t.Errorf("stale backup at %s still present after takeover: %v", backupConf, err)
+	}
+}
+
+func TestSuspendResume(t *testing.T) {
+	const orig = "nameserver 9.9.9.9\n"
+	tmp := t.TempDir()
+	resolvPath := filepath.Join(tmp, "etc", "resolv.conf")
+	if err := os.MkdirAll(filepath.Dir(resolvPath), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(resolvPath, []byte(orig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	readResolv := func(t *testing.T) string {
+		t.Helper()
+		b, err := ioutil.ReadFile(resolvPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	m := newDirectManagerOnFS(t.Logf, directFS{prefix: tmp})
+	restarts := 0
+	m.restartResolved = func() { restarts++ }
+	// Resume without Suspend is a no-op.
+	if err := m.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readResolv(t); got != orig {
+		t.Fatalf("resolv.conf after spurious Resume:\n%s, want:\n%s", got, orig)
+	}
+
+	if err := m.SetDNS(OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("8.8.8.8")}}); err != nil {
+		t.Fatal(err)
+	}
+	restarts = 0
+	if err := m.Suspend(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readResolv(t); got != orig {
+		t.Fatalf("resolv.conf after Suspend:\n%s, want:\n%s", got, orig)
+	}
+	if restarts != 0 {
+		t.Errorf("Suspend restarted resolved %d times; want 0", restarts)
+	}
+
+	// Configs set while suspended aren't written until Resume.
+	if err := m.SetDNS(OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("1.1.1.1")}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readResolv(t); got != orig {
+		t.Fatalf("resolv.conf after SetDNS while suspended:\n%s, want:\n%s", got, orig)
+	}
+
+	if err := m.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readResolv(t); !strings.Contains(got, "nameserver 1.1.1.1\n") {
+		t.Fatalf("resolv.conf after Resume:\n%s, want nameserver 1.1.1.1", got)
+	}
+}
+
+func TestSetDNSNoBackup(t *testing.T) {
+	for _, def := range [][]byte{nil, []byte("nameserver 169.254.169.253\n")} {
+		fs := newMemFS()
+		fs.files[resolvConf] = []byte("nameserver 9.9.9.9\n")
+		m := newDirectManagerWithOptions(t.Logf, fs, DirectOptions{
+			NoBackup:        true,
+			NoBackupDefault: def,
+			OnBackup:        func(path string) { t.Errorf("OnBackup(%q) with NoBackup", path) },
+		})
+		m.restartResolved = func() {}
+
+		for _, ip := range []string{"100.100.100.100", "100.100.100.101"} {
+			if err := m.SetDNS(OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP(ip)}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(fs.files) != 1 {
+			t.Errorf("files with NoBackup = %q; want only %s", fs.files, resolvConf)
+		}
+		// The base config survives in memory.
+		base, err := m.GetBaseConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []netaddr.IP{netaddr.MustParseIP("9.9.9.9")}; !reflect.DeepEqual(base.Nameservers, want) {
+			t.Errorf("base nameservers = %v; want %v", base.Nameservers, want)
+		}
+
+		if err := m.Close(); err != nil {
+			t.Fatal(err)
+		}
+		got, ok := fs.files[resolvConf]
+		switch {
+		case def == nil && ok:
+			t.Errorf("resolv.conf left after Close: %q", got)
+		case def != nil && string(got) != string(def):
+			t.Errorf("resolv.conf after Close = %q; want default %q", got, def)
+		}
+	}
+}
+
+func TestConflictCheck(t *testing.T) {
+	fs := newMemFS()
+	fs.files[resolvConf] = []byte("nameserver 9.9.9.9\n")
+	var (
+		mu   sync.Mutex
+		logs []string
+	)
+	logf := func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	warnings := func() (ret []string) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, l := range logs {
+			if strings.Contains(l, "taken over by") {
+				ret = append(ret, l)
+			}
+		}
+		return ret
+	}
+	m := newDirectManagerWithOptions(logf, fs, DirectOptions{ConflictCheckInterval: time.Minute})
+	m.restartResolved = func() {}
+	var check func()
+	m.afterFunc = func(d time.Duration, f func()) func() bool {
+		if d != time.Minute {
+			t.Errorf("check scheduled after %v; want 1m", d)
+		}
+		check = f
+		return func() bool { check = nil; return true }
+	}
+	runCheck := func() {
+		t.Helper()
+		f := check
+		if f == nil {
+			t.Fatal("no conflict check scheduled")
+		}
+		check = nil
+		f()
+	}
+
+	if err := m.SetDNS(OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}}); err != nil {
+		t.Fatal(err)
+	}
+	runCheck()
+	if w := warnings(); len(w) != 0 {
+		t.Fatalf("warned while resolv.conf was still ours: %q", w)
+	}
+
+	// NetworkManager takes it back.
+	fs.WriteFile(resolvConf, []byte("# Generated by NetworkManager 1.30.0\nnameserver 192.168.1.1\n"), 0644)
+	runCheck()
+	w := warnings()
+	if len(w) != 1 || !strings.Contains(w[0], "NetworkManager") || !strings.Contains(w[0], "1.30.0") {
+		t.Fatalf("conflict warnings = %q; want one naming NetworkManager 1.30.0", w)
+	}
+	// Only once per takeover, but it keeps checking.
+	runCheck()
+	if w := warnings(); len(w) != 1 {
+		t.Errorf("got %d conflict warnings after a second check; want 1", len(w))
+	}
+
+	// Once closed, there's nothing to check.
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if check != nil {
+		t.Errorf("conflict check still scheduled after Close")
+	}
+}
+
+func TestBackupRestoreHooks(t *testing.T) {
+	fs := newMemFS()
+	fs.files[resolvConf] = []byte("nameserver 9.9.9.9\n")
+	var events []string
+	m := newDirectManagerWithOptions(t.Logf, fs, DirectOptions{
+		OnBackup:  func(path string) { events = append(events, "backup "+path) },
+		OnRestore: func(path string) { events = append(events, "restore "+path) },
+	})
+	m.restartResolved = func() {}
+
+	// Only the first write takes over resolv.conf; later ones find
+	// it already ours and make no backup.
+	for _, ip := range []string{"100.100.100.100", "100.100.100.101"} {
+		if err := m.SetDNS(OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP(ip)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []string{"backup " + backupConf}; !reflect.DeepEqual(events, want) {
+		t.Fatalf("events after SetDNS = %q; want %q", events, want)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"backup " + backupConf, "restore " + backupConf}; !reflect.DeepEqual(events, want) {
+		t.Fatalf("events after Close = %q; want %q", events, want)
+	}
+
+	// With nothing to restore, OnRestore stays quiet.
+	m = newDirectManagerWithOptions(t.Logf, fs, DirectOptions{
+		OnRestore: func(path string) { t.Errorf("OnRestore(%q) with no backup", path) },
+	})
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPreserveTrailingComments(t *testing.T) {
+	const orig = "# Generated by NetworkManager\nnameserver 9.9.9.9\n# managed by corp policy\n; see ticket 1234\n\n"
+	fs := newMemFS()
+	fs.files[resolvConf] = []byte(orig)
+	newManager := func() *directManager {
+		m := newDirectManagerWithOptions(t.Logf, fs, DirectOptions{PreserveTrailingComments: true})
+		m.restartResolved = func() {}
+		return m
+	}
+	wantFile := func(ns string) string {
+		return resolvConfHeader + "# managed by corp policy\n; see ticket 1234\n\nnameserver " + ns + "\n"
+	}
+
+	m := newManager()
+	cfg := OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}}
+	if err := m.SetDNS(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(fs.files[resolvConf]), wantFile("100.100.100.100"); got != want {
+		t.Errorf("resolv.conf =\n%s\nwant:\n%s", got, want)
+	}
+	// The comments don't read back as config, or as a different
+	// config from the one written.
+	got, err := m.readResolvConf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(cfg) {
+		t.Errorf("read back %+v; want %+v", got, cfg)
+	}
+	if owned, err := m.ownedByTailscale(); err != nil || !owned {
+		t.Errorf("ownedByTailscale = %v, %v; want true", owned, err)
+	}
+
+	// A restarted manager finds the comments in the backup.
+	m = newManager()
+	if err := m.SetDNS(OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.101")}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(fs.files[resolvConf]), wantFile("100.100.100.101"); got != want {
+		t.Errorf("resolv.conf after restart =\n%s\nwant:\n%s", got, want)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(fs.files[resolvConf]); got != orig {
+		t.Errorf("restored resolv.conf = %q; want %q", got, orig)
+	}
+}
+
+func TestEnsureManaged(t *testing.T) {
+	const orig = "nameserver 9.9.9.9\n"
+	fs := newMemFS()
+	fs.files[resolvConf] = []byte(orig)
+	m := newDirectManagerOnFS(t.Logf, fs)
+	m.restartResolved = func() {}
+
+	config := OSConfig{
+		Nameservers:   []netaddr.IP{netaddr.MustParseIP("100.100.100.100")},
+		SearchDomains: []dnsname.FQDN{"Ts.Net"},
+	}
+	ensure := func(step string, config OSConfig, wantChanged bool) {
+		t.Helper()
+		changed, err := m.EnsureManaged(config)
+		if err != nil {
+			t.Fatalf("%s: %v", step, err)
+		}
+		if changed != wantChanged {
+			t.Errorf("%s: changed = %v; want %v", step, changed, wantChanged)
+		}
+	}
+
+	ensure("first", config, true)
+	ours := string(fs.files[resolvConf])
+	if !strings.Contains(ours, "nameserver 100.100.100.100") {
+		t.Fatalf("resolv.conf = %q; want our config", ours)
+	}
+	ensure("already applied", config, false)
+	if got := string(fs.files[resolvConf]); got != ours {
+		t.Errorf("no-op EnsureManaged rewrote resolv.conf to %q", got)
+	}
+
+	// Another manager takes resolv.conf back.
+	fs.files[resolvConf] = []byte("# Generated by NetworkManager\nnameserver 1.1.1.1\n")
+	ensure("after clobber", config, true)
+	if got := string(fs.files[resolvConf]); got != ours {
+		t.Errorf("after clobber, resolv.conf = %q; want %q", got, ours)
+	}
+
+	// Our file, edited by hand.
+	fs.files[resolvConf] = []byte(ours + "nameserver 8.8.8.8\n")
+	ensure("after edit", config, true)
+	if got := string(fs.files[resolvConf]); got != ours {
+		t.Errorf("after edit, resolv.conf = %q; want %q", got, ours)
+	}
+
+	ensure("zero", OSConfig{}, true)
+	if _, ok := fs.files[resolvConf]; !ok || strings.Contains(string(fs.files[resolvConf]), "tailscale") {
+		t.Errorf("after zero config, resolv.conf = %q; want the base config", fs.files[resolvConf])
+	}
+	ensure("zero again", OSConfig{}, false)
+}
+
+func TestCloseDuringSetDNS(t *testing.T) {
+	const orig = "nameserver 9.9.9.9\n"
+	cfg := OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}}
+	for i := 0; i < 100; i++ {
+		fs := newMemFS()
+		fs.files[resolvConf] = []byte(orig)
+		m := newDirectManagerOnFS(t.Logf, fs)
+		m.restartResolved = func() {}
+
+		var wg sync.WaitGroup
+		var setErr, closeErr error
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			setErr = m.SetDNS(cfg)
+		}()
+		go func() {
+			defer wg.Done()
+			closeErr = m.Close()
+		}()
+		wg.Wait()
+		if closeErr != nil {
+			t.Fatalf("Close: %v", closeErr)
+		}
+		if setErr != nil && !errors.Is(setErr, errClosed) {
+			t.Fatalf("SetDNS: %v", setErr)
+		}
+
+		// Whichever won, Close's restore is the last word.
+		if got := string(fs.files[resolvConf]); got != orig {
+			t.Fatalf("iteration %d: resolv.conf = %q; want %q (SetDNS err: %v)", i, got, orig, setErr)
+		}
+		if _, ok := fs.files[backupConf]; ok {
+			t.Fatalf("iteration %d: backup left behind", i)
+		}
+
+		// And nothing after Close brings the config back.
+		if err := m.SetDNS(cfg); !errors.Is(err, errClosed) {
+			t.Fatalf("SetDNS after Close = %v; want errClosed", err)
+		}
+		if err := m.SetDNS(OSConfig{}); err != nil {
+			t.Fatalf("clearing SetDNS after Close: %v", err)
+		}
+		if got := string(fs.files[resolvConf]); got != orig {
+			t.Fatalf("resolv.conf after late SetDNS = %q; want %q", got, orig)
+		}
+	}
+}
+
+// countingFS is a WholeFileFS that counts calls to WriteFile.
+type countingFS struct {
+	directFS
+	writes *int
+}
+
+func (fs countingFS) WriteFile(name string, contents []byte, perm os.FileMode) error {
+	*fs.writes++
+	return fs.directFS.WriteFile(name, contents, perm)
+}
+
+func TestSetDNSFlapThrottle(t *testing.T) {
+	const orig = "nameserver 9.9.9.9\n"
+	tmp := t.TempDir()
+	resolvPath := filepath.Join(tmp, "etc", "resolv.conf")
+	if err := os.MkdirAll(filepath.Dir(resolvPath), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(resolvPath, []byte(orig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	readResolv := func(t *testing.T) string {
+		t.Helper()
+		b, err := ioutil.ReadFile(resolvPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	var writes int
+	var logs []string
+	logf := func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+		t.Logf(format, args...)
+	}
+	m := newDirectManagerOnFS(logf, countingFS{directFS: directFS{prefix: tmp}, writes: &writes})
+	m.manifestPath = "" // count only resolv.conf writes
+	now := time.Unix(1600000000, 0)
+	m.timeNow = func() time.Time { return now }
+	var flush func()
+	var flushDelay time.Duration
+	m.afterFunc = func(d time.Duration, f func()) func() bool {
+		if flush != nil {
+			t.Errorf("flush scheduled twice")
+		}
+		flush, flushDelay = f, d
+		return func() bool { flush = nil; return true }
+	}
+
+	a := OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("8.8.8.8")}}
+	b := OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("1.1.1.1")}}
+	flap := func(calls int) {
+		for i := 0; i < calls; i++ {
+			cfg := a
+			if i%2 == 1 {
+				cfg = b
+			}
+			if err := m.SetDNS(cfg); err != nil {
+				t.Fatal(err)
+			}
+			now = now.Add(100 * time.Millisecond)
+		}
+	}
+
+	const calls = 20 // ending with b
+	flap(calls)
+	if writes != flapMaxWrites {
+		t.Errorf("got %d writes for %d flapping SetDNS calls; want %d", writes, calls, flapMaxWrites)
+	}
+	if !strings.Contains(strings.Join(logs, "\n"), "throttling") {
+		t.Errorf("no throttling warning logged; logs:\n%s", strings.Join(logs, "\n"))
+	}
+	if flush == nil {
+		t.Fatal("no flush scheduled for the deferred config")
+	}
+	if flushDelay <= 0 || flushDelay > flapWindow {
+		t.Errorf("flush delay = %v; want in (0, %v]", flushDelay, flapWindow)
+	}
+
+	// Once the window clears, the last requested config is written.
+	now = now.Add(flapWindow)
+	f := flush
+	flush = nil
+	f()
+	if got := readResolv(t); !strings.Contains(got, "nameserver 1.1.1.1\n") {
+		t.Errorf("resolv.conf after flush:\n%s\nwant the last config set (1.1.1.1)", got)
+	}
+
+	// Removing our config is never deferred, even mid-flap.
+	flap(calls)
+	if err := m.SetDNS(OSConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readResolv(t); got != orig {
+		t.Errorf("resolv.conf after SetDNS(zero) during flap:\n%s\nwant original:\n%s", got, orig)
+	}
+	if flush != nil {
+		t.Errorf("deferred config still scheduled after SetDNS(zero)")
+	}
+}
+
+func TestResolvOptionsRoundTrip(t *testing.T) {
+	const orig = "nameserver 9.9.9.9\noptions trust-ad ndots:1\n"
+	tmp := t.TempDir()
+	resolvPath := filepath.Join(tmp, "etc", "resolv.conf")
+	if err := os.MkdirAll(filepath.Dir(resolvPath), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(resolvPath, []byte(orig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := newDirectManagerOnFS(t.Logf, directFS{prefix: tmp})
+	base, err := m.GetBaseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"trust-ad", "ndots:1"}; !reflect.DeepEqual(base.Options, want) {
+		t.Fatalf("base options = %q; want %q", base.Options, want)
+	}
+
+	if err := m.SetDNS(OSConfig{
+		Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")},
+		Options:     base.Options,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(resolvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "\noptions trust-ad ndots:1\n") {
+		t.Errorf("written resolv.conf lacks base options:\n%s", b)
+	}
+
+	// Base config is still read from the backup after takeover.
+	base, err = m.GetBaseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"trust-ad", "ndots:1"}; !reflect.DeepEqual(base.Options, want) {
+		t.Errorf("base options after takeover = %q; want %q", base.Options, want)
+	}
+
+	// The TrustAD flag adds the option, without duplicating it.
+	for _, opts := range [][]string{nil, {"trust-ad"}} {
+		if err := m.SetDNS(OSConfig{
+			Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")},
+			Options:     opts,
+			TrustAD:     true,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile(resolvPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(string(b), "\noptions trust-ad\n") {
+			t.Errorf("with Options=%q and TrustAD set, resolv.conf:\n%s\nwant a single trust-ad option", opts, b)
+		}
+	}
+}
+
+func TestSetDNSApproveConfig(t *testing.T) {
+	tmp := t.TempDir()
+	resolvPath := filepath.Join(tmp, "etc", "resolv.conf")
+	if err := os.MkdirAll(filepath.Dir(resolvPath), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	disallowed := netaddr.MustParseIP("8.8.8.8")
+	errNoResolvers := errors.New("no resolvers left")
+	approve := func(cfg OSConfig) (OSConfig, error) {
+		var keep []netaddr.IP
+		for _, ip := range cfg.Nameservers {
+			if ip != disallowed {
+				keep = append(keep, ip)
+			}
+		}
+		if len(keep) == 0 && !cfg.IsZero() {
+			return OSConfig{}, errNoResolvers
+		}
+		cfg.Nameservers = keep
+		return cfg, nil
+	}
+	m := newDirectManagerWithOptions(t.Logf, directFS{prefix: tmp}, DirectOptions{ApproveConfig: approve})
+
+	if err := m.SetDNS(OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100"), disallowed}}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(resolvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), disallowed.String()) {
+		t.Errorf("resolv.conf contains disallowed resolver %v:\n%s", disallowed, b)
+	}
+	if !strings.Contains(string(b), "nameserver 100.100.100.100\n") {
+		t.Errorf("resolv.conf lacks approved resolver:\n%s", b)
+	}
+
+	// A rejected config leaves resolv.conf untouched.
+	if err := m.SetDNS(OSConfig{Nameservers: []netaddr.IP{disallowed}}); !errors.Is(err, errNoResolvers) {
+		t.Fatalf("SetDNS with rejected config = %v; want %v", err, errNoResolvers)
+	}
+	b2, err := ioutil.ReadFile(resolvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b2) != string(b) {
+		t.Errorf("resolv.conf changed after rejected SetDNS:\n%s\nwant:\n%s", b2, b)
+	}
+}
+
+func TestSetDNSDropsNameserverPorts(t *testing.T) {
+	tmp := t.TempDir()
+	resolvPath := filepath.Join(tmp, "etc", "resolv.conf")
+	if err := os.MkdirAll(filepath.Dir(resolvPath), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	var logs []string
+	logf := func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	m := newDirectManagerOnFS(logf, directFS{prefix: tmp})
+	ip := netaddr.MustParseIP("1.2.3.4")
+	if err := m.SetDNS(OSConfig{
+		Nameservers:     []netaddr.IP{ip},
+		NameserverPorts: map[netaddr.IP]uint16{ip: 5353},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(resolvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "\nnameserver 1.2.3.4\n") || strings.Contains(string(b), "5353") {
+		t.Errorf("resolv.conf:\n%s\nwant bare nameserver 1.2.3.4", b)
+	}
+	if !strings.Contains(strings.Join(logs, "\n"), "port 5353 for nameserver 1.2.3.4") {
+		t.Errorf("no warning about dropped port; logs:\n%s", strings.Join(logs, "\n"))
+	}
+}
+
+func TestSetDNSSkipsEquivalentFile(t *testing.T) {
+	// Same config as SetDNS would write, but with different spacing.
+	const onDisk = `# resolv.conf(5) file generated by tailscale
+# DO NOT EDIT THIS FILE BY HAND -- CHANGES WILL BE OVERWRITTEN
+
+nameserver   8.8.8.8
+	nameserver 8.8.4.4  
+
+search  ts.net   ts-dns.test
+`
+	tmp := t.TempDir()
+	resolvPath := filepath.Join(tmp, "etc", "resolv.conf")
+	if err := os.MkdirAll(filepath.Dir(resolvPath), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(resolvPath, []byte(onDisk), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var writes int
+	m := newDirectManagerOnFS(t.Logf, countingFS{directFS: directFS{prefix: tmp}, writes: &writes})
+	m.manifestPath = "" // count only resolv.conf writes
+	restarts := 0
+	m.restartResolved = func() { restarts++ }
+	cfg := OSConfig{
+		Nameservers:   []netaddr.IP{netaddr.MustParseIP("8.8.8.8"), netaddr.MustParseIP("8.8.4.4")},
+		SearchDomains: []dnsname.FQDN{"ts.net.", "ts-dns.test."},
+	}
+	if err := m.SetDNS(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if writes != 0 || restarts != 0 {
+		t.Errorf("SetDNS of an equivalent config did %d writes and %d resolved restarts; want none", writes, restarts)
+	}
+	b, err := ioutil.ReadFile(resolvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != onDisk {
+		t.Errorf("resolv.conf was rewritten:\n%s", b)
+	}
+
+	// A real change is still written.
+	cfg.Nameservers = cfg.Nameservers[:1]
+	if err := m.SetDNS(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if writes != 1 {
+		t.Errorf("SetDNS of a changed config did %d writes; want 1", writes)
+	}
+}
+
+func TestDirectOptionsRoot(t *testing.T) {
+	const orig = "nameserver 9.9.9.9\n"
+	tmp := t.TempDir()
+	root := filepath.Join(tmp, "sysimage")
+	resolvPath := filepath.Join(root, "etc", "resolv.conf")
+	backupPath := filepath.Join(root, backupConf)
+	if err := os.MkdirAll(filepath.Dir(resolvPath), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(resolvPath, []byte(orig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	oscfg, err := NewOSConfiguratorWithOptions(t.Logf, "", DirectOptions{Root: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, ok := oscfg.(*directManager)
+	if !ok {
+		t.Fatalf("NewOSConfiguratorWithOptions with Root = %T; want *directManager", oscfg)
+	}
+	m.restartResolved = func() {}
+
+	if err := m.SetDNS(OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(resolvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "nameserver 100.100.100.100\n") {
+		t.Errorf("resolv.conf under root:\n%s\nwant our config", b)
+	}
+	if b, err := ioutil.ReadFile(backupPath); err != nil || string(b) != orig {
+		t.Errorf("backup under root = %q, %v; want %q", b, err, orig)
+	}
+	// Nothing may land outside the root.
+	entries, err := ioutil.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "sysimage" {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Errorf("files outside root: %q", names)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(resolvPath); err != nil || string(b) != orig {
+		t.Errorf("resolv.conf under root after Close = %q, %v; want %q", b, err, orig)
+	}
+}
+
+func TestSetDNSProbeNameservers(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tmp, "etc"), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var logs []string
+	logf := func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	m := newDirectManagerWithOptions(logf, directFS{prefix: tmp}, DirectOptions{ProbeNameservers: true})
+	m.restartResolved = func() {}
+	m.probeTimeout = 50 * time.Millisecond
+	good := netaddr.MustParseIP("1.1.1.1")
+	bad := netaddr.MustParseIP("192.0.2.1")
+	// The fake dialer answers queries to good and ignores those to
+	// bad, so the probe of bad times out.
+	m.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			buf := make([]byte, 512)
+			n, err := server.Read(buf)
+			if err != nil {
+				return
+			}
+			if addr == netaddr.IPPortFrom(good, 53).String() {
+				server.Write(buf[:n])
+				return
+			}
+			<-ctx.Done()
+		}()
+		return client, nil
+	}
+
+	if err := m.SetDNS(OSConfig{Nameservers: []netaddr.IP{good, bad}}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(tmp, resolvConf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "nameserver 192.0.2.1\n") {
+		t.Errorf("unreachable nameserver not written despite probe failure:\n%s", b)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	all := strings.Join(logs, "\n")
+	if !strings.Contains(all, "nameserver 192.0.2.1 did not answer") {
+		t.Errorf("no warning naming the unreachable nameserver; logs:\n%s", all)
+	}
+	if strings.Contains(all, "nameserver 1.1.1.1 did not answer") {
+		t.Errorf("warning about reachable nameserver; logs:\n%s", all)
+	}
+}
+
+func TestGetBaseConfigFile(t *testing.T) {
+	const overridePath = "/etc/tailscale/upstream.conf"
+	tmp := t.TempDir()
+	resolvPath := filepath.Join(tmp, "etc", "resolv.conf")
+	if err := os.MkdirAll(filepath.Join(tmp, "etc", "tailscale"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(resolvPath, []byte("nameserver 9.9.9.9\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := newDirectManagerWithOptions(t.Logf, directFS{prefix: tmp}, DirectOptions{BaseConfigFile: overridePath})
+	m.restartResolved = func() {}
+	if err := m.SetDNS(OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}}); err != nil {
+		t.Fatal(err)
+	}
+	wantNameservers := func(want string) {
+		t.Helper()
+		base, err := m.GetBaseConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []netaddr.IP{netaddr.MustParseIP(want)}; !reflect.DeepEqual(base.Nameservers, want) {
+			t.Errorf("GetBaseConfig nameservers = %v; want %v", base.Nameservers, want)
+		}
+	}
+
+	// Absent: the backup is used.
+	wantNameservers("9.9.9.9")
+
+	// Present: it takes precedence.
+	if err := ioutil.WriteFile(filepath.Join(tmp, overridePath), []byte("nameserver 10.0.0.53\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wantNameservers("10.0.0.53")
+
+	// Invalid: ignored in favor of the backup.
+	if err := ioutil.WriteFile(filepath.Join(tmp, overridePath), []byte("nameserver not-an-ip\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wantNameservers("9.9.9.9")
+}
+
+func TestCloseIdempotent(t *testing.T) {
+	const orig = "nameserver 9.9.9.9\n"
+	tmp := t.TempDir()
+	resolvPath := filepath.Join(tmp, "etc", "resolv.conf")
+	backupPath := filepath.Join(tmp, backupConf)
+	if err := os.MkdirAll(filepath.Dir(resolvPath), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(resolvPath, []byte(orig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := newDirectManagerOnFS(t.Logf, directFS{prefix: tmp})
+	restarts := 0
+	m.restartResolved = func() { restarts++ }
+	if err := m.SetDNS(OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(resolvPath); err != nil || string(b) != orig {
+		t.Fatalf("resolv.conf after Close = %q, %v; want %q", b, err, orig)
+	}
+
+	// A second Close mustn't touch anything, not even a stray file
+	// at the backup path that a real restore would discard.
+	if err := ioutil.WriteFile(backupPath, []byte("nameserver 1.2.3.4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	restarts = 0
+	if err := m.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+	if _, err := os.Stat(backupPath); err != nil {
+		t.Errorf("second Close touched the backup path: %v", err)
+	}
+	if restarts != 0 {
+		t.Errorf("second Close restarted resolved %d times", restarts)
+	}
+}
+
+// memFS is an in-memory WholeFileFS. Only regular files exist.
+type memFS struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func newMemFS() *memFS { return &memFS{files: map[string][]byte{}} }
+
+func (fs *memFS) Stat(name string) (isRegular bool, err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, ok := fs.files[name]; !ok {
+		return false, os.ErrNotExist
+	}
+	return true, nil
+}
+
+func (fs *memFS) Rename(oldName, newName string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	b, ok := fs.files[oldName]
+	if !ok {
+		return os.ErrNotExist
+	}
+	delete(fs.files, oldName)
+	fs.files[newName] = b
+	return nil
+}
+
+func (fs *memFS) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, ok := fs.files[name]; !ok {
+		return os.ErrNotExist
+	}
+	delete(fs.files, name)
+	return nil
+}
+
+func (fs *memFS) ReadFile(name string, maxSize int64) ([]byte, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	b, ok := fs.files[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	if maxSize > 0 && int64(len(b)) > maxSize {
+		return nil, ErrFileTooLarge
+	}
+	return append([]byte(nil), b...), nil
+}
+
+func (fs *memFS) ReadDir(dir string) ([]string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	var names []string
+	for name := range fs.files {
+		if rest := strings.TrimPrefix(name, dir+"/"); rest != name && !strings.Contains(rest, "/") {
+			names = append(names, rest)
+		}
+	}
+	if names == nil {
+		return nil, os.ErrNotExist
+	}
+	return names, nil
+}
+
+func (fs *memFS) WriteFile(name string, contents []byte, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.files[name] = append([]byte(nil), contents...)
+	return nil
+}
+
+func TestRenderResolvConf(t *testing.T) {
+	configs := []OSConfig{
+		{
+			Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")},
+		},
+		{
+			Nameservers:   []netaddr.IP{netaddr.MustParseIP("8.8.8.8"), netaddr.MustParseIP("fd7a:115c:a1e0::53")},
+			SearchDomains: fqdns("coffee.shop", "ts.net"),
+		},
+		{
+			Nameservers:   []netaddr.IP{netaddr.MustParseIP("100.100.100.100")},
+			SearchDomains: fqdns("ts.net"),
+			Options:       []string{"ndots:2"},
+			TrustAD:       true,
+		},
+		{
+			Nameservers:     []netaddr.IP{netaddr.MustParseIP("1.1.1.1")},
+			NameserverPorts: map[netaddr.IP]uint16{netaddr.MustParseIP("1.1.1.1"): 5353},
+		},
+	}
+	for i, cfg := range configs {
+		fs := newMemFS()
+		fs.files[resolvConf] = []byte("nameserver 9.9.9.9\n")
+		m := newDirectManagerOnFS(t.Logf, fs)
+		m.restartResolved = func() {}
+		if err := m.SetDNS(cfg); err != nil {
+			t.Fatalf("%d: SetDNS: %v", i, err)
+		}
+		if got, want := string(fs.files[resolvConf]), string(RenderResolvConf(cfg)); got != want {
+			t.Errorf("%d: SetDNS wrote:\n%s\nRenderResolvConf returned:\n%s", i, got, want)
+		}
+	}
+}
+
+func TestSingleRequest(t *testing.T) {
+	const orig = "nameserver 9.9.9.9\noptions single-request single-request-reopen\n"
+	fs := newMemFS()
+	fs.files[resolvConf] = []byte(orig)
+	m := newDirectManagerOnFS(t.Logf, fs)
+	m.restartResolved = func() {}
+
+	base, err := m.GetBaseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	both := []string{"single-request", "single-request-reopen"}
+	if !reflect.DeepEqual(base.Options, both) {
+		t.Fatalf("base options = %q; want %q", base.Options, both)
+	}
+
+	// Options carried over from the base config survive, and the
+	// flags inject the same options without duplicating them.
+	for _, cfg := range []OSConfig{
+		{Options: base.Options},
+		{SingleRequest: true, SingleRequestReopen: true},
+		{Options: base.Options, SingleRequest: true, SingleRequestReopen: true},
+	} {
+		cfg.Nameservers = []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}
+		if err := m.SetDNS(cfg); err != nil {
+			t.Fatal(err)
+		}
+		got, err := m.readResolvConf()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got.Options, both) {
+			t.Errorf("SetDNS(%+v) wrote options %q; want %q", cfg, got.Options, both)
+		}
+	}
+
+	if err := m.SetDNS(OSConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(fs.files[resolvConf]); got != orig {
+		t.Errorf("restored resolv.conf = %q; want %q", got, orig)
+	}
+}
+
+func TestRefuseWhenResolvedActive(t *testing.T) {
+	const orig = "nameserver 127.0.0.53\n"
+	config := OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}}
+	for _, refuse := range []bool{true, false} {
+		fs := newMemFS()
+		fs.files[resolvConf] = []byte(orig)
+		m := newDirectManagerWithOptions(t.Logf, fs, DirectOptions{RefuseWhenResolvedActive: refuse})
+		m.restartResolved = func() {}
+		m.resolvedRunning = func() bool { return true }
+
+		err := m.SetDNS(config)
+		if refuse {
+			if !errors.Is(err, errResolvedActive) {
+				t.Errorf("with RefuseWhenResolvedActive, SetDNS = %v; want errResolvedActive", err)
+			}
+			if got := string(fs.files[resolvConf]); got != orig {
+				t.Errorf("refused SetDNS changed resolv.conf to %q", got)
+			}
+		} else if err != nil {
+			t.Errorf("without RefuseWhenResolvedActive, SetDNS = %v; want success", err)
+		}
+		if err := m.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(fs.files[resolvConf]); got != orig {
+			t.Errorf("refuse=%v: after Close, resolv.conf = %q; want %q", refuse, got, orig)
+		}
+	}
+}
+
+func TestSearchDomainWarnThreshold(t *testing.T) {
+	var logs []string
+	logf := func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+		t.Logf(format, args...)
+	}
+	m := newDirectManagerWithOptions(logf, newMemFS(), DirectOptions{SearchDomainWarnThreshold: 3})
+	m.restartResolved = func() {}
+
+	warned := func() bool {
+		for _, l := range logs {
+			if strings.Contains(l, "search domains") {
+				return true
+			}
+		}
+		return false
+	}
+	domains := []dnsname.FQDN{"a.example.", "b.example.", "c.example.", "d.example."}
+	ns := []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}
+	if err := m.SetDNS(OSConfig{Nameservers: ns, SearchDomains: domains[:3]}); err != nil {
+		t.Fatal(err)
+	}
+	if warned() {
+		t.Errorf("warned about 3 search domains with a threshold of 3: %q", logs)
+	}
+	if err := m.SetDNS(OSConfig{Nameservers: ns, SearchDomains: domains}); err != nil {
+		t.Fatal(err)
+	}
+	if !warned() {
+		t.Errorf("no warning about 4 search domains with a threshold of 3: %q", logs)
+	}
+	if got, _ := m.readResolvConf(); len(got.SearchDomains) != 4 {
+		t.Errorf("wrote search domains %q; want all 4", got.SearchDomains)
+	}
+}
+
+func TestDebugOption(t *testing.T) {
+	const orig = "nameserver 9.9.9.9\noptions debug ndots:2\n"
+	fs := newMemFS()
+	fs.files[resolvConf] = []byte(orig)
+	m := newDirectManagerOnFS(t.Logf, fs)
+	m.restartResolved = func() {}
+
+	base, err := m.GetBaseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"debug", "ndots:2"}; !reflect.DeepEqual(base.Options, want) {
+		t.Fatalf("base options = %q; want %q", base.Options, want)
+	}
+	if got := RenderResolvConf(base); !strings.Contains(string(got), "\noptions debug ndots:2\n") {
+		t.Errorf("round-tripped base config:\n%s\nwant options debug ndots:2", got)
+	}
+
+	for _, tt := range []struct {
+		cfg  OSConfig
+		want []string
+	}{
+		{OSConfig{Debug: true}, []string{"debug"}},
+		{OSConfig{Options: []string{"ndots:2"}, Debug: true}, []string{"ndots:2", "debug"}},
+		{OSConfig{Options: base.Options, Debug: true}, []string{"debug", "ndots:2"}},
+	} {
+		cfg := tt.cfg
+		cfg.Nameservers = []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}
+		if err := m.SetDNS(cfg); err != nil {
+			t.Fatal(err)
+		}
+		got, err := m.readResolvConf()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got.Options, tt.want) {
+			t.Errorf("SetDNS(%+v) wrote options %q; want %q", cfg, got.Options, tt.want)
+		}
+	}
+
+	if err := m.SetDNS(OSConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(fs.files[resolvConf]); got != orig {
+		t.Errorf("restored resolv.conf = %q; want %q", got, orig)
+	}
+}
+
+func TestSetDNSMusl(t *testing.T) {
+	fs := newMemFS()
+	fs.files[resolvConf] = []byte("nameserver 9.9.9.9\n")
+	m := newDirectManagerOnFS(t.Logf, fs)
+	m.restartResolved = func() {}
+	m.isMusl = func() bool { return true }
+
+	if err := m.SetDNS(OSConfig{
+		Nameservers:   []netaddr.IP{netaddr.MustParseIP("100.100.100.100")},
+		Options:       []string{"ndots:2", "edns0", "rotate", "timeout:1", "attempts:3"},
+		TrustAD:       true,
+		NoAAAA:        true,
+		SingleRequest: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := m.readResolvConf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"ndots:2", "timeout:1", "attempts:3"}; !reflect.DeepEqual(got.Options, want) {
+		t.Errorf("options with musl = %q; want %q", got.Options, want)
+	}
+
+	// With only unsupported options, there's no options line at all.
+	if err := m.SetDNS(OSConfig{
+		Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")},
+		Options:     []string{"edns0"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(fs.files[resolvConf]); strings.Contains(got, "options") {
+		t.Errorf("resolv.conf with musl has options:\n%s", got)
+	}
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	fs := newMemFS()
+	fs.files[resolvConf] = []byte("nameserver 9.9.9.9\n")
+	m := newDirectManagerWithOptions(t.Logf, fs, DirectOptions{
+		ProtectedNameservers: []netaddr.IP{netaddr.MustParseIP("10.0.0.53")},
+	})
+	m.restartResolved = func() {}
+	if got := m.EffectiveConfig(); !got.IsZero() {
+		t.Errorf("EffectiveConfig before SetDNS = %+v; want zero", got)
+	}
+
+	if err := m.SetDNS(OSConfig{
+		Nameservers: []netaddr.IP{
+			{}, // invalid
+			netaddr.MustParseIP("2001:db8::1"),
+			netaddr.MustParseIP("2001:0db8:0:0:0:0:0:1"), // duplicate
+			netaddr.MustParseIP("100.100.100.100"),
+			netaddr.MustParseIP("8.8.8.8"),
+			netaddr.MustParseIP("10.0.0.53"),
+		},
+		SearchDomains: []dnsname.FQDN{"TS.net.", "ts.net."},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	got := m.EffectiveConfig()
+	want := OSConfig{
+		Nameservers: []netaddr.IP{
+			netaddr.MustParseIP("2001:db8::1"),
+			netaddr.MustParseIP("100.100.100.100"),
+			netaddr.MustParseIP("10.0.0.53"),
+		},
+		SearchDomains: []dnsname.FQDN{"ts.net."},
+	}
+	if !got.Equal(want) {
+		t.Errorf("EffectiveConfig = %+v; want %+v", got, want)
+	}
+	// It's exactly what's on disk.
+	onDisk, err := m.readResolvConf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !onDisk.Equal(got) {
+		t.Errorf("resolv.conf holds %+v; EffectiveConfig says %+v", onDisk, got)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.EffectiveConfig(); !got.IsZero() {
+		t.Errorf("EffectiveConfig after Close = %+v; want zero", got)
+	}
+}
+
+func TestSetDNSCanonicalIPv6(t *testing.T) {
+	fs := newMemFS()
+	m := newDirectManagerOnFS(t.Logf, fs)
+	m.restartResolved = func() {}
+	if err := m.SetDNS(OSConfig{
+		Nameservers: []netaddr.IP{
+			netaddr.MustParseIP("2001:0db8:0:0:0:0:0:1"),
+			netaddr.MustParseIP("2001:db8::1"),
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	got := string(fs.files[resolvConf])
+	if !strings.Contains(got, "\nnameserver 2001:db8::1\n") || strings.Count(got, "nameserver") != 1 {
+		t.Errorf("resolv.conf:\n%s\nwant a single canonical 2001:db8::1 nameserver line", got)
+	}
+}
+
+func TestUnsupportedFields(t *testing.T) {
+	m := newDirectManagerOnFS(t.Logf, newMemFS())
+	cfg := OSConfig{
+		Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100"), netaddr.MustParseIP("10.0.0.53")},
+		NameserverPorts: map[netaddr.IP]uint16{
+			netaddr.MustParseIP("100.100.100.100"): 53,
+			netaddr.MustParseIP("10.0.0.53"):       5353,
+		},
+		Routes:  map[dnsname.FQDN][]netaddr.IP{"corp.example.": {netaddr.MustParseIP("10.0.0.53")}},
+		Options: []string{"ndots:2", "edns0"},
+		TrustAD: true,
+	}
+	if got, want := m.UnsupportedFields(cfg), []string{"Routes", "NameserverPorts"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("UnsupportedFields = %q; want %q", got, want)
+	}
+
+	m.isMusl = func() bool { return true }
+	if got, want := m.UnsupportedFields(cfg), []string{"Routes", "NameserverPorts", "Options", "TrustAD"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("UnsupportedFields on musl = %q; want %q", got, want)
+	}
+
+	// Port 53 is what resolv.conf implies anyway.
+	cfg = OSConfig{
+		Nameservers:     []netaddr.IP{netaddr.MustParseIP("100.100.100.100")},
+		NameserverPorts: map[netaddr.IP]uint16{netaddr.MustParseIP("100.100.100.100"): 53},
+	}
+	if got := m.UnsupportedFields(cfg); len(got) != 0 {
+		t.Errorf("UnsupportedFields with only port 53 = %q; want none", got)
+	}
+}
+
+func TestDirectCanRepresent(t *testing.T) {
+	m := newDirectManagerOnFS(t.Logf, newMemFS())
+	plain := OSConfig{
+		Nameservers:   []netaddr.IP{netaddr.MustParseIP("100.100.100.100")},
+		SearchDomains: []dnsname.FQDN{"ts.net."},
+		Options:       []string{"ndots:2"},
+		TrustAD:       true,
+	}
+	if !m.CanRepresent(plain) {
+		t.Errorf("CanRepresent(%+v) = false; want true", plain)
+	}
+
+	lossy := map[string]func(*OSConfig){
+		"routes": func(c *OSConfig) {
+			c.Routes = map[dnsname.FQDN][]netaddr.IP{"corp.example.": {netaddr.MustParseIP("10.0.0.53")}}
+		},
+		"port": func(c *OSConfig) {
+			c.NameserverPorts = map[netaddr.IP]uint16{netaddr.MustParseIP("100.100.100.100"): 5353}
+		},
+		"match": func(c *OSConfig) { c.MatchDomains = []dnsname.FQDN{"corp.example."} },
+		"reverse-search": func(c *OSConfig) {
+			c.SearchDomains = []dnsname.FQDN{"ts.net.", "64.100.in-addr.arpa."}
+		},
+	}
+	for name, change := range lossy {
+		c := plain
+		change(&c)
+		if m.CanRepresent(c) {
+			t.Errorf("%s: CanRepresent(%+v) = true; want false", name, c)
+		}
+	}
+}
+
+func TestNoAAAA(t *testing.T) {
+	const orig = "nameserver 9.9.9.9\noptions no-aaaa\n"
+	fs := newMemFS()
+	fs.files[resolvConf] = []byte(orig)
+	m := newDirectManagerOnFS(t.Logf, fs)
+	m.restartResolved = func() {}
+
+	base, err := m.GetBaseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"no-aaaa"}; !reflect.DeepEqual(base.Options, want) {
+		t.Fatalf("base options = %q; want %q", base.Options, want)
+	}
+
+	// The flag adds the option, without duplicating one carried over
+	// from the base config.
+	for _, opts := range [][]string{nil, base.Options} {
+		if err := m.SetDNS(OSConfig{
+			Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")},
+			Options:     opts,
+			NoAAAA:      true,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(fs.files[resolvConf]); !strings.HasSuffix(got, "\noptions no-aaaa\n") {
+			t.Errorf("with Options=%q and NoAAAA set, resolv.conf:\n%s\nwant a single no-aaaa option", opts, got)
+		}
+	}
+
+	// And without the flag, it's absent.
+	if err := m.SetDNS(OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(fs.files[resolvConf]); strings.Contains(got, "no-aaaa") {
+		t.Errorf("resolv.conf without NoAAAA:\n%s", got)
+	}
+
+	// The original, option included, comes back on restore.
+	if err := m.SetDNS(OSConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(fs.files[resolvConf]); got != orig {
+		t.Errorf("restored resolv.conf = %q; want %q", got, orig)
+	}
+}
+
+// TestReadResolvCorpus runs the FuzzReadResolv seed inputs through the
+// same round trip as the fuzzer does.
+func TestReadResolvCorpus(t *testing.T) {
+	dir := filepath.Join("testdata", "resolv-corpus")
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range fis {
+		b, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := readResolv(bytes.NewReader(b))
+		if err != nil {
+			t.Logf("%s: %v", fi.Name(), err)
+			continue
+		}
+		var buf bytes.Buffer
+		writeResolvConf(&buf, cfg.Nameservers, nil, cfg.SearchDomains, cfg.Options, LineEndingLF)
+		cfg2, err := readResolv(&buf)
+		if err != nil {
+			t.Errorf("%s: re-reading %q: %v", fi.Name(), buf.Bytes(), err)
+			continue
+		}
+		if !cfg.Equal(cfg2) {
+			t.Errorf("%s: round trip got %+v; want %+v", fi.Name(), cfg2, cfg)
+		}
+	}
+}
+
+// crlfFS is a memFS that asks for CRLF line endings.
+type crlfFS struct {
+	*memFS
+}
+
+func (crlfFS) LineEnding() LineEnding { return LineEndingCRLF }
+
+func TestWriteResolvConfCRLF(t *testing.T) {
+	cfg := OSConfig{
+		Nameservers:   []netaddr.IP{netaddr.MustParseIP("100.100.100.100"), netaddr.MustParseIP("fd7a:115c:a1e0::53")},
+		SearchDomains: []dnsname.FQDN{"ts.net.", "corp.example."},
+		Options:       []string{"ndots:2"},
+	}
+	isCRLF := func(b []byte) bool {
+		return bytes.Count(b, []byte("\n")) > 0 && bytes.Count(b, []byte("\n")) == bytes.Count(b, []byte("\r\n"))
+	}
+
+	var buf bytes.Buffer
+	writeResolvConf(&buf, cfg.Nameservers, nil, cfg.SearchDomains, cfg.Options, LineEndingCRLF)
+	if !isCRLF(buf.Bytes()) {
+		t.Errorf("with LineEndingCRLF, wrote %q; want only CRLF line endings", buf.Bytes())
+	}
+	if got, want := buf.String(), LineEndingCRLF.apply(string(RenderResolvConf(cfg))); got != want {
+		t.Errorf("with LineEndingCRLF, wrote %q; want %q", got, want)
+	}
+	got, err := readResolv(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(cfg) {
+		t.Errorf("round trip got %+v; want %+v", got, cfg)
+	}
+
+	fs := crlfFS{newMemFS()}
+	m := newDirectManagerOnFS(t.Logf, fs)
+	m.restartResolved = func() {}
+	if err := m.SetDNS(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if b := fs.files[resolvConf]; !isCRLF(b) {
+		t.Errorf("SetDNS on a CRLF file system wrote %q", b)
+	}
+	if err := m.AddSearchDomains("office.example."); err != nil {
+		t.Fatal(err)
+	}
+	if b := fs.files[resolvConf]; !isCRLF(b) {
+		t.Errorf("AddSearchDomains on a CRLF file system wrote %q", b)
+	}
+	got, err = m.readResolvConf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []dnsname.FQDN{"ts.net.", "corp.example.", "office.example."}; !reflect.DeepEqual(got.SearchDomains, want) {
+		t.Errorf("search domains = %q; want %q", got.SearchDomains, want)
+	}
+}
+
+func TestResolvConfNameserverSources(t *testing.T) {
+	cfg := OSConfig{
+		Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100"), netaddr.MustParseIP("9.9.9.9")},
+		NameserverSources: map[netaddr.IP]string{
+			netaddr.MustParseIP("100.100.100.100"): "MagicDNS",
+			netaddr.MustParseIP("9.9.9.9"):         "corp\nnameserver 6.6.6.6",
+		},
+	}
+	b := RenderResolvConf(cfg)
+	for _, want := range []string{
+		"nameserver 100.100.100.100 # MagicDNS\n",
+		"nameserver 9.9.9.9 # corp nameserver 6.6.6.6\n",
+	} {
+		if !bytes.Contains(b, []byte(want)) {
+			t.Errorf("resolv.conf lacks %q:\n%s", want, b)
+		}
+	}
+
+	got, err := readResolv(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Nameservers, cfg.Nameservers) {
+		t.Errorf("read back nameservers %v; want %v", got.Nameservers, cfg.Nameservers)
+	}
+}
+
+func TestRepairResolvConf(t *testing.T) {
+	const (
+		ours  = "# resolv.conf(5) file generated by tailscale\nnameserver 100.100.100.100"
+		other = "nameserver 9.9.9.9"
+	)
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{ours, ours + "\n"},
+		{ours + "\n", ours + "\n"},
+		{other, other}, // not ours to repair
+	} {
+		fs := newMemFS()
+		fs.files[resolvConf] = []byte(tt.in)
+		m := newDirectManagerOnFS(t.Logf, fs)
+		if err := m.RepairResolvConf(); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(fs.files[resolvConf]); got != tt.want {
+			t.Errorf("RepairResolvConf of %q = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestReadResolvBOM(t *testing.T) {
+	in := "\ufeffnameserver 1.1.1.1\nnameserver 9.9.9.9\n"
+	cfg, err := readResolv(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []netaddr.IP{netaddr.MustParseIP("1.1.1.1"), netaddr.MustParseIP("9.9.9.9")}
+	if !reflect.DeepEqual(cfg.Nameservers, want) {
+		t.Errorf("nameservers = %v; want %v", cfg.Nameservers, want)
+	}
+}
+
+func TestGetBaseConfigSkipsInvalidSearch(t *testing.T) {
+	longLabel := strings.Repeat("a", 64)
+	in := "nameserver 9.9.9.9\nsearch corp.example " + longLabel + ".example ts.net\n"
+	fs := newMemFS()
+	fs.files[resolvConf] = []byte(in)
+	var logs []string
+	m := newDirectManagerOnFS(func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}, fs)
+
+	base, err := m.GetBaseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := OSConfig{
+		Nameservers:   []netaddr.IP{netaddr.MustParseIP("9.9.9.9")},
+		SearchDomains: []dnsname.FQDN{"corp.example.", "ts.net."},
+	}
+	if !reflect.DeepEqual(base, want) {
+		t.Errorf("GetBaseConfig = %+v; want %+v", base, want)
+	}
+	if len(logs) != 1 || !strings.Contains(logs[0], longLabel) {
+		t.Errorf("logs = %q; want one warning about the invalid domain", logs)
+	}
+
+	// Our own files are still held to the strict parser.
+	if _, err := readResolv(strings.NewReader(in)); err == nil {
+		t.Errorf("readResolv accepted an invalid search domain")
+	}
+}
+
+func TestParseResolvConf(t *testing.T) {
+	const in = `# Generated by NetworkManager
+domain corp.example
+search corp.example example.com
+nameserver 10.0.0.53 # office
+nameserver fd7a:115c:a1e0::53
+sortlist 10.0.0.0/255.0.0.0
+options ndots:2 timeout:1
+`
+	got, err := ParseResolvConf(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := OSConfig{
+		Nameservers:   []netaddr.IP{netaddr.MustParseIP("10.0.0.53"), netaddr.MustParseIP("fd7a:115c:a1e0::53")},
+		SearchDomains: []dnsname.FQDN{"corp.example.", "example.com."},
+		Options:       []string{"ndots:2", "timeout:1"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseResolvConf = %+v; want %+v", got, want)
+	}
+
+	got, err = ParseResolvConf(strings.NewReader("nameserver 1.1.1.1\nnameserver bogus\n"))
+	if err == nil {
+		t.Fatalf("ParseResolvConf with a malformed nameserver = %+v; want error", got)
+	}
+	if !strings.Contains(err.Error(), `"bogus"`) {
+		t.Errorf("error %q doesn't name the bad address", err)
+	}
+
+	got, err = ParseResolvConf(strings.NewReader("nameserver dns.google\n"))
+	if err == nil {
+		t.Fatalf("ParseResolvConf with a hostname nameserver = %+v; want error", got)
+	}
+	if want := `nameserver "dns.google" is a hostname; nameservers must be IP addresses`; err.Error() != want {
+		t.Errorf("error = %q; want %q", err, want)
+	}
+}
+
+func TestParseResolvConfTabs(t *testing.T) {
+	// Keywords may be indented and separated from their arguments by
+	// tabs. A keyword must be a whole word, though.
+	const in = "\tnameserver\t1.1.1.1\n  nameserver \t 8.8.8.8\nsearch\tts.net\toffice.example\noptions\tndots:2\nnameservers 9.9.9.9\nsearchable example.com\n"
+	got, err := ParseResolvConf(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := OSConfig{
+		Nameservers:   []netaddr.IP{netaddr.MustParseIP("1.1.1.1"), netaddr.MustParseIP("8.8.8.8")},
+		SearchDomains: []dnsname.FQDN{"ts.net.", "office.example."},
+		Options:       []string{"ndots:2"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseResolvConf = %+v; want %+v", got, want)
+	}
+
+	got2 := replaceSearchLine([]byte(in), []dnsname.FQDN{"example.com."})
+	if want := "\tnameserver\t1.1.1.1\n  nameserver \t 8.8.8.8\nsearch example.com\noptions\tndots:2\nnameservers 9.9.9.9\nsearchable example.com\n"; string(got2) != want {
+		t.Errorf("replaceSearchLine = %q; want %q", got2, want)
+	}
+}
+
+func TestReadResolvLongLine(t *testing.T) {
+	in := "nameserver 1.1.1.1\nsearch " + strings.Repeat("a", 128<<10) + "\n"
+	if cfg, err := readResolv(strings.NewReader(in)); err == nil {
+		t.Errorf("readResolv of an overlong line = %+v; want error", cfg)
+	}
+}
+
+// fifoFS is a memFS on which resolv.conf is a FIFO: it isn't a
+// regular file, and reading it would block.
+type fifoFS struct {
+	*memFS
+	t *testing.T
+}
+
+func (fs fifoFS) Stat(name string) (isRegular bool, err error) {
+	if name == resolvConf {
+		return false, nil
+	}
+	return fs.memFS.Stat(name)
+}
+
+func (fs fifoFS) ReadFile(name string, maxSize int64) ([]byte, error) {
+	if name == resolvConf {
+		fs.t.Errorf("read from FIFO %s", name)
+		return nil, errors.New("would block")
+	}
+	return fs.memFS.ReadFile(name, maxSize)
+}
+
+func (fs fifoFS) Rename(oldName, newName string) error {
+	if oldName == resolvConf || newName == resolvConf {
+		fs.t.Errorf("renamed FIFO %s", resolvConf)
+	}
+	return fs.memFS.Rename(oldName, newName)
+}
+
+func TestSetDNSMigratesLegacySymlink(t *testing.T) {
+	const orig = "nameserver 9.9.9.9\n"
+	tmp := t.TempDir()
+	etc := filepath.Join(tmp, "etc")
+	if err := os.MkdirAll(etc, 0777); err != nil {
+		t.Fatal(err)
+	}
+	// The old layout: resolv.conf is a symlink to our own file, and
+	// the original config is in the backup.
+	legacy := "# resolv.conf(5) file generated by tailscale\nnameserver 100.100.100.100\n"
+	if err := ioutil.WriteFile(filepath.Join(etc, "resolv.tailscale.conf"), []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(etc, "resolv.pre-tailscale-backup.conf"), []byte(orig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	resolvPath := filepath.Join(etc, "resolv.conf")
+	if err := os.Symlink("resolv.tailscale.conf", resolvPath); err != nil {
+		t.Fatal(err)
+	}
+
+	m := newDirectManagerOnFS(t.Logf, directFS{prefix: tmp})
+	m.restartResolved = func() {}
+	if err := m.SetDNS(OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100"), netaddr.MustParseIP("8.8.8.8")}}); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Lstat(resolvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.Mode().IsRegular() {
+		t.Errorf("resolv.conf mode = %v; want a regular file", fi.Mode())
+	}
+	b, err := ioutil.ReadFile(resolvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "generated by tailscale") || !strings.Contains(string(b), "nameserver 8.8.8.8") {
+		t.Errorf("resolv.conf = %q; want our new config", b)
+	}
+	if _, err := os.Lstat(filepath.Join(etc, "resolv.tailscale.conf")); !os.IsNotExist(err) {
+		t.Errorf("legacy resolv.tailscale.conf still exists: %v", err)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(resolvPath); string(b) != orig {
+		t.Errorf("after Close, resolv.conf = %q; want %q", b, orig)
+	}
+}
+
+func TestSetDNSUseSymlink(t *testing.T) {
+	const orig = "nameserver 9.9.9.9\n"
+	for _, haveOrig := range []bool{true, false} {
+		tmp := t.TempDir()
+		etc := filepath.Join(tmp, "etc")
+		if err := os.MkdirAll(etc, 0777); err != nil {
+			t.Fatal(err)
+		}
+		resolvPath := filepath.Join(etc, "resolv.conf")
+		sidecar := filepath.Join(etc, "resolv.tailscale.conf")
+		if haveOrig {
+			if err := ioutil.WriteFile(resolvPath, []byte(orig), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		m := newDirectManagerWithOptions(t.Logf, directFS{prefix: tmp}, DirectOptions{UseSymlink: true})
+		m.restartResolved = func() {}
+		m.manifestPath = ""
+		config := OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}}
+		if err := m.SetDNS(config); err != nil {
+			t.Fatal(err)
+		}
+		target, err := os.Readlink(resolvPath)
+		if err != nil {
+			t.Fatalf("haveOrig=%v: resolv.conf isn't a symlink: %v", haveOrig, err)
+		}
+		if target != "resolv.tailscale.conf" {
+			t.Errorf("haveOrig=%v: resolv.conf links to %q; want resolv.tailscale.conf", haveOrig, target)
+		}
+		if b, _ := ioutil.ReadFile(sidecar); !strings.Contains(string(b), "nameserver 100.100.100.100") {
+			t.Errorf("haveOrig=%v: resolv.tailscale.conf = %q; want our config", haveOrig, b)
+		}
+		owned, err := m.ownedByTailscale()
+		if err != nil || !owned {
+			t.Errorf("haveOrig=%v: ownedByTailscale = %v, %v; want true", haveOrig, owned, err)
+		}
+		// Reapplying leaves the layout alone.
+		if err := m.SetDNS(config); err != nil {
+			t.Fatal(err)
+		}
+		if target, _ := os.Readlink(resolvPath); target != "resolv.tailscale.conf" {
+			t.Errorf("haveOrig=%v: after reapplying, resolv.conf links to %q", haveOrig, target)
+		}
+
+		if err := m.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Lstat(sidecar); !os.IsNotExist(err) {
+			t.Errorf("haveOrig=%v: after Close, resolv.tailscale.conf still exists: %v", haveOrig, err)
+		}
+		if !haveOrig {
+			if _, err := os.Lstat(resolvPath); !os.IsNotExist(err) {
+				t.Errorf("after Close, resolv.conf still exists: %v", err)
+			}
+			continue
+		}
+		fi, err := os.Lstat(resolvPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.Mode().IsRegular() {
+			t.Errorf("after Close, resolv.conf mode = %v; want a regular file", fi.Mode())
+		}
+		if b, _ := ioutil.ReadFile(resolvPath); string(b) != orig {
+			t.Errorf("after Close, resolv.conf = %q; want %q", b, orig)
+		}
+	}
+}
+
+// hardlinkFS is a memFS on which the backup starts out as a hard
+// link to resolv.conf.
+type hardlinkFS struct {
+	*memFS
+	t      *testing.T
+	linked bool
+}
+
+func (fs *hardlinkFS) SameFile(a, b string) (bool, error) {
+	return fs.linked && (a == resolvConf && b == backupConf || a == backupConf && b == resolvConf), nil
+}
+
+func (fs *hardlinkFS) Rename(oldName, newName string) error {
+	if fs.linked && (oldName == resolvConf || oldName == backupConf) {
+		fs.t.Errorf("Rename(%q, %q) between hard links", oldName, newName)
+	}
+	return fs.memFS.Rename(oldName, newName)
+}
+
+func (fs *hardlinkFS) Remove(name string) error {
+	if name == backupConf || name == resolvConf {
+		fs.linked = false
+	}
+	return fs.memFS.Remove(name)
+}
+
+func TestSetDNSHardlinkedBackup(t *testing.T) {
+	const orig = "nameserver 9.9.9.9\n"
+	fs := &hardlinkFS{memFS: newMemFS(), t: t, linked: true}
+	fs.files[resolvConf] = []byte(orig)
+	fs.files[backupConf] = []byte(orig)
+	m := newDirectManagerOnFS(t.Logf, fs)
+	m.restartResolved = func() {}
+
+	if err := m.SetDNS(OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}}); err != nil {
+		t.Fatal(err)
+	}
+	if fs.linked {
+		t.Error("backup is still a hard link to resolv.conf")
+	}
+	if got := string(fs.files[backupConf]); got != orig {
+		t.Errorf("backup = %q; want %q", got, orig)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(fs.files[resolvConf]); got != orig {
+		t.Errorf("after Close, resolv.conf = %q; want %q", got, orig)
+	}
+}
+
+func TestPreviewRestore(t *testing.T) {
+	const (
+		ours  = "# resolv.conf(5) file generated by tailscale\nnameserver 100.100.100.100\n"
+		orig  = "nameserver 9.9.9.9\n"
+		other = "# Generated by NetworkManager\nnameserver 1.1.1.1\n"
+	)
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  RestorePlan
+	}{
+		{
+			name:  "restore",
+			files: map[string]string{resolvConf: ours, backupConf: orig},
+			want: RestorePlan{
+				Action: RestoreBackup,
+				Backup: backupConf,
+				Config: OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("9.9.9.9")}},
+			},
+		},
+		{
+			name:  "discard",
+			files: map[string]string{resolvConf: other, backupConf: orig},
+			want: RestorePlan{
+				Action: RestoreDiscard,
+				Backup: backupConf,
+				Config: OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("1.1.1.1")}},
+			},
+		},
+		{
+			name:  "noop",
+			files: map[string]string{resolvConf: ours},
+			want: RestorePlan{
+				Action: RestoreNoop,
+				Config: OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := newMemFS()
+			for name, contents := range tt.files {
+				fs.files[name] = []byte(contents)
+			}
+			m := newDirectManagerOnFS(t.Logf, fs)
+			m.restartResolved = func() {}
+
+			got, err := m.PreviewRestore()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("PreviewRestore = %+v; want %+v", got, tt.want)
+			}
+			after := map[string]string{}
+			for name, b := range fs.files {
+				after[name] = string(b)
+			}
+			if !reflect.DeepEqual(after, tt.files) {
+				t.Errorf("PreviewRestore changed files to %q; want %q", after, tt.files)
+			}
+
+			// Close must then do what was previewed.
+			if err := m.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := m.readResolvConf(); err != nil || !got.Equal(tt.want.Config) {
+				t.Errorf("after Close, resolv.conf = %+v, %v; want %+v", got, err, tt.want.Config)
+			}
+		})
+	}
+}
+
+func TestSetDNSRefusesFIFO(t *testing.T) {
+	m := newDirectManagerOnFS(t.Logf, fifoFS{newMemFS(), t})
+	m.restartResolved = func() {}
+
+	err := m.SetDNS(OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}})
+	if !errors.Is(err, errNotRegularFile) {
+		t.Errorf("SetDNS error = %v; want %v", err, errNotRegularFile)
+	}
+	if _, err := m.GetBaseConfig(); !errors.Is(err, errNotRegularFile) {
+		t.Errorf("GetBaseConfig error = %v; want %v", err, errNotRegularFile)
+	}
+}
+
+// roEtcFS is a memFS whose /etc is read-only, except that resolv.conf
+// itself can be overwritten in place, as when it's bind-mounted.
+type roEtcFS struct {
+	*memFS
+}
+
+func (fs roEtcFS) check(op string, names ...string) error {
+	for _, name := range names {
+		if strings.HasPrefix(name, "/etc/") {
+			return &os.PathError{Op: op, Path: name, Err: syscall.EROFS}
+		}
+	}
+	return nil
+}
+
+func (fs roEtcFS) Rename(oldName, newName string) error {
+	if err := fs.check("rename", oldName, newName); err != nil {
+		return err
+	}
+	return fs.memFS.Rename(oldName, newName)
+}
+
+func (fs roEtcFS) Remove(name string) error {
+	if err := fs.check("remove", name); err != nil {
+		return err
+	}
+	return fs.memFS.Remove(name)
+}
+
+func (fs roEtcFS) WriteFile(name string, contents []byte, perm os.FileMode) error {
+	if name != resolvConf {
+		if err := fs.check("open", name); err != nil {
+			return err
+		}
+	}
+	return fs.memFS.WriteFile(name, contents, perm)
+}
+
+func TestDumpState(t *testing.T) {
+	const cur = "# Generated by NetworkManager\nnameserver 8.8.8.8\nnameserver 192.168.1.1\n"
+	const backup = "nameserver 2001:4860:4860::8888\nnameserver 100.100.100.100\n"
+	fs := newMemFS()
+	fs.files[resolvConf] = []byte(cur)
+	fs.files[backupConf] = []byte(backup)
+	m := newDirectManagerOnFS(t.Logf, fs)
+
+	got, err := m.DumpState(DumpRedactNothing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"owner: NetworkManager\n",
+		"owned by tailscale: false\n",
+		"backup: " + backupConf + "\n",
+		"--- " + resolvConf + " ---\n" + cur,
+		"--- " + backupConf + " ---\n" + backup,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("DumpState missing %q; got:\n%s", want, got)
+		}
+	}
+
+	got, err = m.DumpState(DumpMaskPublicIPs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"nameserver <public IPv4>\nnameserver 192.168.1.1\n",
+		"nameserver <public IPv6>\nnameserver 100.100.100.100\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("masked DumpState missing %q; got:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "8.8.8.8") || strings.Contains(got, "2001:4860") {
+		t.Errorf("masked DumpState leaks a public IP:\n%s", got)
+	}
+
+	if b := string(fs.files[resolvConf]); b != cur {
+		t.Errorf("DumpState changed resolv.conf to %q", b)
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	const orig = "# Generated by NetworkManager\nnameserver 9.9.9.9\n"
+	for _, readOnly := range []bool{false, true} {
+		mem := newMemFS()
+		mem.files[resolvConf] = []byte(orig)
+		var fs WholeFileFS = mem
+		if readOnly {
+			fs = roEtcFS{mem}
+		}
+		m := newDirectManagerOnFS(t.Logf, fs)
+		m.resolvedRunning = func() bool { return false }
+
+		r, err := m.Preflight()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !r.ResolvConfExists || !r.RegularFile || r.OwnedByTailscale || r.Owner != "NetworkManager" {
+			t.Errorf("readOnly=%v: report = %+v; want an existing regular file owned by NetworkManager", readOnly, r)
+		}
+		if r.DirWritable == readOnly {
+			t.Errorf("readOnly=%v: DirWritable = %v", readOnly, r.DirWritable)
+		}
+		wantProblems := 1 // the owner
+		if readOnly {
+			wantProblems++
+		}
+		if len(r.Problems) != wantProblems {
+			t.Errorf("readOnly=%v: problems = %q; want %d", readOnly, r.Problems, wantProblems)
+		}
+		if len(mem.files) != 1 || string(mem.files[resolvConf]) != orig {
+			t.Errorf("readOnly=%v: Preflight changed files: %q", readOnly, mem.files)
+		}
+	}
+}
+
+func TestBackupFileElsewhere(t *testing.T) {
+	const (
+		orig   = "nameserver 9.9.9.9\n"
+		backup = "/var/lib/tailscale/resolv.pre-tailscale-backup.conf"
+	)
+	mem := newMemFS()
+	mem.files[resolvConf] = []byte(orig)
+	m := newDirectManagerWithOptions(t.Logf, roEtcFS{mem}, DirectOptions{BackupFile: backup})
+	m.restartResolved = func() {}
+
+	if m.UsingCopyFallback() {
+		t.Error("UsingCopyFallback before any write")
+	}
+	if err := m.SetDNS(OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}}); err != nil {
+		t.Fatal(err)
+	}
+	if !m.UsingCopyFallback() {
+		t.Error("UsingCopyFallback = false after renames failed")
+	}
+	if got := string(mem.files[backup]); got != orig {
+		t.Errorf("backup = %q; want %q", got, orig)
+	}
+	if got := string(mem.files[resolvConf]); !strings.Contains(got, "nameserver 100.100.100.100\n") {
+		t.Errorf("resolv.conf not taken over:\n%s", got)
+	}
+
+	base, err := m.GetBaseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []netaddr.IP{netaddr.MustParseIP("9.9.9.9")}; !reflect.DeepEqual(base.Nameservers, want) {
+		t.Errorf("base nameservers = %v; want %v", base.Nameservers, want)
+	}
+
+	if err := m.SetDNS(OSConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(mem.files[resolvConf]); got != orig {
+		t.Errorf("restored resolv.conf = %q; want %q", got, orig)
+	}
+	if _, ok := mem.files[backup]; ok {
+		t.Errorf("backup still present after restore")
+	}
+}
+
+// permFS is a roEtcFS that also tracks file modes, as a metaFS.
+type permFS struct {
+	roEtcFS
+	perms map[string]os.FileMode
+}
+
+func (fs permFS) WriteFile(name string, contents []byte, perm os.FileMode) error {
+	if err := fs.roEtcFS.WriteFile(name, contents, perm); err != nil {
+		return err
+	}
+	fs.perms[name] = perm
+	return nil
+}
+
+func (fs permFS) Rename(oldName, newName string) error {
+	if err := fs.roEtcFS.Rename(oldName, newName); err != nil {
+		return err
+	}
+	fs.perms[newName] = fs.perms[oldName]
+	delete(fs.perms, oldName)
+	return nil
+}
+
+func (fs permFS) FileMeta(name string) (fileMeta, error) {
+	if ok, err := fs.Stat(name); !ok {
+		return fileMeta{}, err
+	}
+	return fileMeta{Mode: fs.perms[name], UID: -1, GID: -1}, nil
+}
+
+func (fs permFS) SetFileMeta(name string, meta fileMeta) error {
+	fs.perms[name] = meta.Mode
+	return nil
+}
+
+func TestCopyFallbackKeepsMode(t *testing.T) {
+	const backup = "/var/lib/tailscale/resolv.pre-tailscale-backup.conf"
+	mem := newMemFS()
+	mem.files[resolvConf] = []byte("nameserver 9.9.9.9\n")
+	fs := permFS{roEtcFS{mem}, map[string]os.FileMode{resolvConf: 0600}}
+	m := newDirectManagerWithOptions(t.Logf, fs, DirectOptions{BackupFile: backup})
+	m.restartResolved = func() {}
+
+	if err := m.SetDNS(OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := fs.perms[backup]; got != 0600 {
+		t.Errorf("backup mode = %v; want %v", got, os.FileMode(0600))
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := fs.perms[resolvConf]; got != 0600 {
+		t.Errorf("restored resolv.conf mode = %v; want %v", got, os.FileMode(0600))
+	}
+}
+
+func TestBackupMetrics(t *testing.T) {
+	const ours = "# resolv.conf(5) file generated by tailscale\nnameserver 100.100.100.100\n"
+	fs := newMemFS()
+	fs.files[resolvConf] = []byte(ours)
+	fs.files[backupConf] = []byte("nameserver not-an-ip\n")
+	m := newDirectManagerOnFS(t.Logf, fs)
+	m.restartResolved = func() {}
+
+	before := metricBackupInvalid.Value()
+	if _, err := m.GetBaseConfig(); err == nil {
+		t.Fatalf("GetBaseConfig with a malformed backup succeeded")
+	}
+	if got := metricBackupInvalid.Value() - before; got != 1 {
+		t.Errorf("malformed backup counted %d times; want 1", got)
+	}
+
+	delete(fs.files, backupConf)
+	if _, err := m.GetBaseConfig(); err == nil {
+		t.Fatalf("GetBaseConfig with a missing backup succeeded")
+	}
+	if got := metricBackupInvalid.Value() - before; got != 2 {
+		t.Errorf("missing backup: counter went up by %d in total; want 2", got)
+	}
+
+	// Someone else replaced resolv.conf while we had a backup.
+	fs.files[backupConf] = []byte("nameserver 9.9.9.9\n")
+	fs.files[resolvConf] = []byte("nameserver 1.1.1.1\n")
+	before = metricRestoreNotOwned.Value()
+	if err := m.SetDNS(OSConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := metricRestoreNotOwned.Value() - before; got != 1 {
+		t.Errorf("foreign resolv.conf on restore counted %d times; want 1", got)
+	}
+}
+
+func TestDirectFileMode(t *testing.T) {
+	for _, mode := range []os.FileMode{0, 0600, 0444} {
+		tmp := t.TempDir()
+		if err := os.MkdirAll(filepath.Join(tmp, "etc"), 0777); err != nil {
+			t.Fatal(err)
+		}
+		m := newDirectManagerWithOptions(t.Logf, directFS{prefix: tmp}, DirectOptions{FileMode: mode})
+		m.restartResolved = func() {}
+		if err := m.SetDNS(OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}}); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(filepath.Join(tmp, resolvConf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := mode
+		if want == 0 {
+			want = 0644
+		}
+		if got := fi.Mode().Perm(); got != want {
+			t.Errorf("FileMode %v: resolv.conf written with mode %v; want %v", mode, got, want)
+		}
+	}
+}
+
+func TestBackupMetadata(t *testing.T) {
+	const orig = "nameserver 9.9.9.9\n"
+	tmp := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tmp, "etc"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	resolvPath := filepath.Join(tmp, resolvConf)
+	if err := ioutil.WriteFile(resolvPath, []byte(orig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(resolvPath, 0600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(resolvPath, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	m := newDirectManagerWithOptions(t.Logf, directFS{prefix: tmp}, DirectOptions{BackupMetadata: true})
+	m.restartResolved = func() {}
+	if err := m.SetDNS(OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(tmp, backupConf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, contents, ok := decodeBackup(b)
+	if !ok {
+		t.Fatalf("backup isn't enveloped: %q", b)
+	}
+	if string(contents) != orig || meta.Mode != 0600 || !meta.ModTime.Equal(mtime) {
+		t.Errorf("backup = %+v, %q; want mode 0600, mtime %v, %q", meta, contents, mtime, orig)
+	}
+	// The backup parses as the original config too.
+	if base, err := m.GetBaseConfig(); err != nil || len(base.Nameservers) != 1 || base.Nameservers[0] != netaddr.MustParseIP("9.9.9.9") {
+		t.Errorf("GetBaseConfig = %+v, %v; want 9.9.9.9", base, err)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(resolvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fi.Mode().Perm(); got != 0600 {
+		t.Errorf("restored mode = %v; want 0600", got)
+	}
+	if !fi.ModTime().Equal(mtime) {
+		t.Errorf("restored mtime = %v; want %v", fi.ModTime(), mtime)
+	}
+	if b, _ := ioutil.ReadFile(resolvPath); string(b) != orig {
+		t.Errorf("restored resolv.conf = %q; want %q", b, orig)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, backupConf)); !os.IsNotExist(err) {
+		t.Errorf("backup still exists after restore: %v", err)
+	}
+}
+
+func TestDecodeBackupRaw(t *testing.T) {
+	for _, raw := range []string{
+		"",
+		"nameserver 9.9.9.9\n",
+		"# some other comment\nnameserver 9.9.9.9\n",
+		backupEnvelopeMagic + " mode=banana\nnameserver 9.9.9.9\n",
+	} {
+		if _, _, ok := decodeBackup([]byte(raw)); ok {
+			t.Errorf("decodeBackup(%q) ok; want a raw backup", raw)
+		}
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want []string
+	}{
+		{"", "", nil},
+		{"", "a\nb\n", []string{"+a", "+b"}},
+		{"a\nb\n", "", []string{"-a", "-b"}},
+		{"a\nb\nc\n", "a\nx\nc\n", []string{"-b", "+x"}},
+		{"a\nb\n", "a\nb\n", nil},
+		{"a\nb\n", "b\na\n", []string{"-a", "+a"}},
+	}
+	for _, tt := range tests {
+		if got := diffLines(tt.a, tt.b); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("diffLines(%q, %q) = %q; want %q", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestSetDNSLogDiffs(t *testing.T) {
+	for _, logDiffs := range []bool{false, true} {
+		var (
+			mu   sync.Mutex
+			logs []string
+		)
+		logf := func(format string, args ...interface{}) {
+			mu.Lock()
+			defer mu.Unlock()
+			logs = append(logs, fmt.Sprintf(format, args...))
+		}
+		fs := newMemFS()
+		fs.files[resolvConf] = []byte("nameserver 9.9.9.9\n")
+		m := newDirectManagerWithOptions(logf, fs, DirectOptions{LogDiffs: logDiffs})
+		m.restartResolved = func() {}
+		if err := m.SetDNS(OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}}); err != nil {
+			t.Fatal(err)
+		}
+
+		all := strings.Join(logs, "\n")
+		for _, want := range []string{"-nameserver 9.9.9.9", "+nameserver 100.100.100.100"} {
+			if got := strings.Contains(all, want); got != logDiffs {
+				t.Errorf("LogDiffs=%v: logs contain %q = %v; logs:\n%s", logDiffs, want, got, all)
+			}
+		}
+	}
+}
+
+func TestSetDNSWarnsReverseSearchDomain(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		logs []string
+	)
+	logf := func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	fs := newMemFS()
+	m := newDirectManagerOnFS(logf, fs)
+	m.restartResolved = func() {}
+	if err := m.SetDNS(OSConfig{
+		Nameservers:   []netaddr.IP{netaddr.MustParseIP("100.100.100.100")},
+		SearchDomains: []dnsname.FQDN{"ts.net.", "10.in-addr.arpa."},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var warned []string
+	for _, l := range logs {
+		if strings.Contains(l, "reverse DNS zone") {
+			warned = append(warned, l)
+		}
+	}
+	if len(warned) != 1 || !strings.Contains(warned[0], "10.in-addr.arpa.") {
+		t.Errorf("reverse zone warnings = %q; want one for 10.in-addr.arpa.", warned)
+	}
+}
+
+func TestSetDNSVerifyName(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		logs []string
+	)
+	logf := func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	fs := newMemFS()
+	m := newDirectManagerWithOptions(logf, fs, DirectOptions{VerifyName: "controlplane.tailscale.com"})
+	m.restartResolved = func() {}
+	var lookups []string
+	m.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		// By the time of the lookup, the config must be in place.
+		if b, _ := fs.ReadFile(resolvConf, 0); !bytes.Contains(b, []byte("nameserver 100.100.100.100")) {
+			t.Errorf("lookup before resolv.conf was written; have %q", b)
+		}
+		lookups = append(lookups, host)
+		return nil, errors.New("no such host")
+	}
+
+	config := OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}}
+	if err := m.SetDNS(config); err != nil {
+		t.Fatalf("SetDNS failed on verification failure: %v", err)
+	}
+	if want := []string{"controlplane.tailscale.com"}; !reflect.DeepEqual(lookups, want) {
+		t.Errorf("lookups = %q; want %q", lookups, want)
+	}
+	if all := strings.Join(logs, "\n"); !strings.Contains(all, "DNS verification failed") {
+		t.Errorf("no verification warning in logs:\n%s", all)
+	}
+
+	// Re-applying the same config doesn't rewrite, so doesn't verify.
+	if err := m.SetDNS(config); err != nil {
+		t.Fatal(err)
+	}
+	if len(lookups) != 1 {
+		t.Errorf("got %d lookups after unchanged SetDNS; want 1", len(lookups))
+	}
+}
+
+func TestGetBaseConfigFiltersSelf(t *testing.T) {
+	const ours = "# resolv.conf(5) file generated by tailscale\nnameserver 100.100.100.100\n"
+	for _, filterCGNAT := range []bool{false, true} {
+		fs := newMemFS()
+		fs.files[resolvConf] = []byte(ours)
+		fs.files[backupConf] = []byte("nameserver 100.100.100.100\nnameserver 100.101.102.103\nnameserver 9.9.9.9\n")
+		m := newDirectManagerWithOptions(t.Logf, fs, DirectOptions{FilterCGNATBaseResolvers: filterCGNAT})
+
+		base, err := m.GetBaseConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []netaddr.IP{netaddr.MustParseIP("100.101.102.103"), netaddr.MustParseIP("9.9.9.9")}
+		if filterCGNAT {
+			want = want[1:]
+		}
+		if !reflect.DeepEqual(base.Nameservers, want) {
+			t.Errorf("FilterCGNATBaseResolvers=%v: base nameservers = %v; want %v", filterCGNAT, base.Nameservers, want)
+		}
+	}
+}
+
+func TestNewDirectManager(t *testing.T) {
+	const (
+		resolvPath = "/run/dns/resolv.conf"
+		backupPath = "/run/dns/resolv.backup"
+		orig       = "nameserver 9.9.9.9\n"
+	)
+	fs := newMemFS()
+	fs.files[resolvPath] = []byte(orig)
+	now := time.Unix(1600000000, 0)
+	m := NewDirectManager(DirectManagerOptions{
+		DirectOptions: DirectOptions{BackupFile: backupPath},
+		Logf:          t.Logf,
+		FS:            fs,
+		ResolvConf:    resolvPath,
+		Now:           func() time.Time { return now },
+	})
+	dm := m.(*directManager)
+	dm.restartResolved = func() {}
+	if got := dm.timeNow(); !got.Equal(now) {
+		t.Errorf("manager clock = %v; want %v", got, now)
+	}
+
+	if err := m.SetDNS(OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(fs.files[backupPath]); got != orig {
+		t.Errorf("backup = %q; want %q", got, orig)
+	}
+	if got := string(fs.files[resolvPath]); !strings.Contains(got, "nameserver 100.100.100.100\n") {
+		t.Errorf("%s not taken over:\n%s", resolvPath, got)
+	}
+	if _, ok := fs.files[resolvConf]; ok {
+		t.Errorf("wrote the default %s", resolvConf)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(fs.files[resolvPath]); got != orig {
+		t.Errorf("restored %s = %q; want %q", resolvPath, got, orig)
+	}
+}
+
+func TestSetDNSKeepsOrder(t *testing.T) {
+	cfg := OSConfig{
+		Nameservers: []netaddr.IP{
+			netaddr.MustParseIP("9.9.9.9"),
+			netaddr.MustParseIP("fd7a:115c:a1e0::53"),
+			netaddr.MustParseIP("1.1.1.1"),
+			netaddr.MustParseIP("100.100.100.100"),
+		},
+		SearchDomains: fqdns("zz.example", "aa.example", "mm.example"),
+	}
+	want := `nameserver 9.9.9.9
+nameserver fd7a:115c:a1e0::53
+nameserver 1.1.1.1
+nameserver 100.100.100.100
+search zz.example aa.example mm.example
+`
+	fs := newMemFS()
+	m := newDirectManagerOnFS(t.Logf, fs)
+	m.restartResolved = func() {}
+	if err := m.SetDNS(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(fs.files[resolvConf]); !strings.HasSuffix(got, "\n\n"+want) {
+		t.Errorf("resolv.conf:\n%s\nwant it to end with:\n%s", got, want)
+	}
+}
+
+func TestRestartResolvedOnTakeoverOnly(t *testing.T) {
+	fs := newMemFS()
+	fs.files[resolvConf] = []byte("nameserver 127.0.0.53\n")
+	m := newDirectManagerOnFS(t.Logf, fs)
+	restarts := 0
+	m.restartResolved = func() { restarts++ }
+
+	if err := m.SetDNS(OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}}); err != nil {
+		t.Fatal(err)
+	}
+	if restarts != 1 {
+		t.Errorf("takeover restarted resolved %d times; want 1", restarts)
+	}
+
+	restarts = 0
+	if err := m.SetDNS(OSConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(fs.files[resolvConf]); got != "nameserver 127.0.0.53\n" {
+		t.Fatalf("backup not restored; resolv.conf = %q", got)
+	}
+	if restarts != 0 {
+		t.Errorf("restore restarted resolved %d times; want 0", restarts)
+	}
+}
+
+func TestAtomicWriteFileTempName(t *testing.T) {
+	const tmp = "/etc/resolv.conf.test.tmp"
+	fs := newMemFS()
+	m := newDirectManagerOnFS(t.Logf, fs)
+	m.restartResolved = func() {}
+	var temps []string
+	m.tempNameFunc = func(filename string) (string, error) {
+		if filename != resolvConf {
+			t.Errorf("temp name requested for %q; want %q", filename, resolvConf)
+		}
+		temps = append(temps, tmp)
+		return tmp, nil
+	}
+	if err := m.SetDNS(OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(temps) != 1 {
+		t.Errorf("got %d temp files; want 1", len(temps))
+	}
+	if _, ok := fs.files[tmp]; ok {
+		t.Errorf("temp file %s left behind", tmp)
+	}
+	if _, ok := fs.files[resolvConf]; !ok {
+		t.Errorf("resolv.conf not written")
+	}
+}
+
+func TestEditSearchDomains(t *testing.T) {
+	fs := newMemFS()
+	fs.files[resolvConf] = []byte("nameserver 9.9.9.9\n")
+	m := newDirectManagerOnFS(t.Logf, fs)
+	m.restartResolved = func() {}
+	if err := m.AddSearchDomains("corp.example."); !errors.Is(err, errNotOwned) {
+		t.Errorf("AddSearchDomains on a file we don't own: err = %v; want errNotOwned", err)
+	}
+
+	cfg := OSConfig{
+		Nameservers:   []netaddr.IP{netaddr.MustParseIP("100.100.100.100"), netaddr.MustParseIP("9.9.9.9")},
+		SearchDomains: []dnsname.FQDN{"ts.net."},
+		Options:       []string{"ndots:2"},
+	}
+	if err := m.SetDNS(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	step := func(name string, f func() error, wantDiff []string) {
+		t.Helper()
+		before := string(fs.files[resolvConf])
+		if err := f(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		after := string(fs.files[resolvConf])
+		if got := diffLines(before, after); !reflect.DeepEqual(got, wantDiff) {
+			t.Errorf("%s: changed lines %q; want %q", name, got, wantDiff)
+		}
+	}
+	step("add", func() error { return m.AddSearchDomains("corp.example", "TS.NET.") },
+		[]string{"-search ts.net", "+search ts.net corp.example"})
+	step("remove", func() error { return m.RemoveSearchDomains("ts.net") },
+		[]string{"-search ts.net corp.example", "+search corp.example"})
+	step("remove-all", func() error { return m.RemoveSearchDomains("corp.example.") },
+		[]string{"-search corp.example"})
+	step("add-new", func() error { return m.AddSearchDomains("ts.net.") },
+		[]string{"+search ts.net"})
+
+	got, err := m.readResolvConf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Nameservers, cfg.Nameservers) || !reflect.DeepEqual(got.Options, cfg.Options) {
+		t.Errorf("config = %+v; want nameservers and options of %+v", got, cfg)
+	}
+}
+
+func TestSetDNSDropsRootSearch(t *testing.T) {
+	fs := newMemFS()
+	m := newDirectManagerOnFS(t.Logf, fs)
+	m.restartResolved = func() {}
+	if err := m.SetDNS(OSConfig{
+		Nameservers:   []netaddr.IP{netaddr.MustParseIP("100.100.100.100")},
+		SearchDomains: []dnsname.FQDN{"ts.net.", ".", "example.com."},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	got := string(fs.files[resolvConf])
+	if !strings.Contains(got, "\nsearch ts.net example.com\n") {
+		t.Errorf("resolv.conf doesn't search exactly ts.net and example.com:\n%s", got)
+	}
+}
+
+func TestSetDNSFamilyOrder(t *testing.T) {
+	v4a, v4b := netaddr.MustParseIP("100.100.100.100"), netaddr.MustParseIP("9.9.9.9")
+	v6a, v6b := netaddr.MustParseIP("fd7a:115c:a1e0::53"), netaddr.MustParseIP("2620:fe::fe")
+	in := []netaddr.IP{v4a, v6a, v4b, v6b}
+	tests := []struct {
+		order FamilyOrder
+		want  []netaddr.IP
+	}{
+		{"", in},
+		{FamilyOrderPreserve, in},
+		{FamilyOrderV6First, []netaddr.IP{v6a, v6b, v4a, v4b}},
+		{FamilyOrderV4First, []netaddr.IP{v4a, v4b, v6a, v6b}},
+	}
+	for _, tt := range tests {
+		fs := newMemFS()
+		m := newDirectManagerWithOptions(t.Logf, fs, DirectOptions{FamilyOrder: tt.order})
+		m.restartResolved = func() {}
+		if err := m.SetDNS(OSConfig{Nameservers: in}); err != nil {
+			t.Fatal(err)
+		}
+		got, err := m.readResolvConf()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got.Nameservers, tt.want) {
+			t.Errorf("FamilyOrder %q: nameservers = %v; want %v", tt.order, got.Nameservers, tt.want)
+		}
+	}
+
+	// Truncation applies after ordering.
+	fs := newMemFS()
+	m := newDirectManagerWithOptions(t.Logf, fs, DirectOptions{
+		FamilyOrder:          FamilyOrderV6First,
+		ProtectedNameservers: []netaddr.IP{v4a},
+	})
+	m.restartResolved = func() {}
+	if err := m.SetDNS(OSConfig{Nameservers: in}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := m.readResolvConf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []netaddr.IP{v6a, v6b, v4a}; !reflect.DeepEqual(got.Nameservers, want) {
+		t.Errorf("v6first with truncation: nameservers = %v; want %v", got.Nameservers, want)
+	}
+}
+
+func TestSetDNSProtectedNameservers(t *testing.T) {
+	cfg := OSConfig{
+		Nameservers: []netaddr.IP{
+			netaddr.MustParseIP("100.100.100.100"),
+			netaddr.MustParseIP("1.1.1.1"),
+			netaddr.MustParseIP("10.0.0.53"),
+			netaddr.MustParseIP("8.8.8.8"),
+		},
+	}
+	fs := newMemFS()
+	m := newDirectManagerWithOptions(t.Logf, fs, DirectOptions{
+		ProtectedNameservers: []netaddr.IP{netaddr.MustParseIP("8.8.8.8")},
+	})
+	m.restartResolved = func() {}
+	if err := m.SetDNS(cfg); err != nil {
+		t.Fatal(err)
+	}
+	got, err := m.readResolvConf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []netaddr.IP{
+		netaddr.MustParseIP("100.100.100.100"),
+		netaddr.MustParseIP("1.1.1.1"),
+		netaddr.MustParseIP("8.8.8.8"),
+	}
+	if !reflect.DeepEqual(got.Nameservers, want) {
+		t.Errorf("nameservers = %v; want %v", got.Nameservers, want)
+	}
+}
+
+// failWriteFS is a memFS on which writes to fail, or to temporary
+// files for it, fail while fail is set.
+type failWriteFS struct {
+	*memFS
+	fail string
+}
+
+func (fs *failWriteFS) WriteFile(name string, contents []byte, perm os.FileMode) error {
+	if fs.fail != "" && strings.HasPrefix(name, fs.fail) {
+		return fmt.Errorf("write %s: %w", name, syscall.EIO)
+	}
+	return fs.memFS.WriteFile(name, contents, perm)
+}
+
+func TestSetDNSMirrorFiles(t *testing.T) {
+	const mirror = "/run/resolvconf/resolv.conf"
+	fs := &failWriteFS{memFS: newMemFS()}
+	fs.files[resolvConf] = []byte("nameserver 9.9.9.9\n")
+	m := newDirectManagerWithOptions(t.Logf, fs, DirectOptions{MirrorFiles: []string{mirror}})
+	m.restartResolved = func() {}
+
+	first := OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}}
+	if err := m.SetDNS(first); err != nil {
+		t.Fatal(err)
+	}
+	want := string(RenderResolvConf(first))
+	for _, path := range []string{resolvConf, mirror} {
+		if got := string(fs.files[path]); got != want {
+			t.Errorf("%s = %q; want %q", path, got, want)
+		}
+	}
+
+	// Fail the write of resolv.conf, after the mirror is written.
+	fs.fail = resolvConf
+	if err := m.SetDNS(OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("8.8.8.8")}}); err == nil {
+		t.Fatal("SetDNS succeeded despite failed write")
+	}
+	fs.fail = ""
+	for _, path := range []string{resolvConf, mirror} {
+		if got := string(fs.files[path]); got != want {
+			t.Errorf("after failed SetDNS, %s = %q; want it rolled back to %q", path, got, want)
+		}
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{resolvConf, mirror} {
+		if got := string(fs.files[path]); got != "nameserver 9.9.9.9\n" {
+			t.Errorf("after Close, %s = %q; want the original config", path, got)
+		}
+	}
+}
+
+func TestGetBaseConfigDropIns(t *testing.T) {
+	const dropIns = "/etc/resolv.conf.d"
+	fs := newMemFS()
+	fs.files[resolvConf] = []byte("nameserver 9.9.9.9\nsearch base.example\n")
+	// Listed out of order, to check they're merged lexically.
+	fs.files[dropIns+"/20-vpn.conf"] = []byte("nameserver 10.0.0.2\nsearch vpn.example\n")
+	fs.files[dropIns+"/10-lan.conf"] = []byte("nameserver 192.168.1.1\nsearch lan.example\noptions ndots:2\n")
+	fs.files[dropIns+"/README"] = []byte("nameserver 6.6.6.6\n")
+
+	for _, dir := range []string{"", dropIns} {
+		m := newDirectManagerWithOptions(t.Logf, fs, DirectOptions{DropInDir: dir})
+		base, err := m.GetBaseConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := OSConfig{
+			Nameservers:   []netaddr.IP{netaddr.MustParseIP("9.9.9.9")},
+			SearchDomains: fqdns("base.example"),
+		}
+		if dir != "" {
+			want = OSConfig{
+				Nameservers: []netaddr.IP{
+					netaddr.MustParseIP("9.9.9.9"),
+					netaddr.MustParseIP("192.168.1.1"),
+					netaddr.MustParseIP("10.0.0.2"),
+				},
+				SearchDomains: fqdns("base.example", "lan.example", "vpn.example"),
+				Options:       []string{"ndots:2"},
+			}
+		}
+		if !base.Equal(want) {
+			t.Errorf("DropInDir=%q: base config = %+v; want %+v", dir, base, want)
+		}
+	}
+}
+
+func TestSetDNSNormalizeCache(t *testing.T) {
+	fs := newMemFS()
+	m := newDirectManagerOnFS(t.Logf, fs)
+	m.restartResolved = func() {}
+	for _, cfg := range []OSConfig{
+		{Nameservers: []netaddr.IP{netaddr.MustParseIP("1.1.1.1")}, SearchDomains: []dnsname.FQDN{"Corp.Example", "corp.example."}},
+		{Nameservers: []netaddr.IP{netaddr.MustParseIP("8.8.8.8")}, SearchDomains: []dnsname.FQDN{"Corp.Example", "corp.example."}},
+		{Nameservers: []netaddr.IP{netaddr.MustParseIP("8.8.8.8")}, SearchDomains: []dnsname.FQDN{"Other.Example"}},
+	} {
+		if err := m.SetDNS(cfg); err != nil {
+			t.Fatal(err)
+		}
+		want := RenderResolvConf(cfg.Normalize())
+		if got := fs.files[resolvConf]; !bytes.Equal(got, want) {
+			t.Errorf("for %+v, resolv.conf:\n%s\nwant:\n%s", cfg, got, want)
+		}
+	}
+}
+
+func BenchmarkSetDNSReapply(b *testing.B) {
+	search := []dnsname.FQDN{"Corp.Example.com", "tail-scale.ts.net", "LAN", "home.arpa", "office.example.com", "corp.example.com"}
+	search2 := append([]dnsname.FQDN{"other.example"}, search[1:]...)
+	ns1 := []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}
+	ns2 := []netaddr.IP{netaddr.MustParseIP("8.8.8.8")}
+
+	for _, bb := range []struct {
+		name string
+		cfgs [2]OSConfig
+	}{
+		{"full", [2]OSConfig{{Nameservers: ns1, SearchDomains: search}, {Nameservers: ns1, SearchDomains: search2}}},
+		{"nameservers-only", [2]OSConfig{{Nameservers: ns1, SearchDomains: search}, {Nameservers: ns2, SearchDomains: search}}},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			m := newDirectManagerOnFS(logger.Discard, newMemFS())
+			m.restartResolved = func() {}
+			// Step the clock past the flap window on every write, so
+			// that alternating configs aren't throttled.
+			now := time.Unix(0, 0)
+			m.timeNow = func() time.Time {
+				now = now.Add(flapWindow)
+				return now
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := m.SetDNS(bb.cfgs[i%2]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestResolvConfEnvOverride(t *testing.T) {
+	const path = "/tmp/debug/resolv.conf"
+	os.Setenv("TS_DEBUG_RESOLV_CONF", path)
+	defer os.Unsetenv("TS_DEBUG_RESOLV_CONF")
+
+	const orig = "nameserver 9.9.9.9\n"
+	fs := newMemFS()
+	fs.files[path] = []byte(orig)
+	var logs []string
+	m := newDirectManagerOnFS(func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}, fs)
+	m.restartResolved = func() {}
+	if len(logs) == 0 || !strings.Contains(logs[0], "TS_DEBUG_RESOLV_CONF") {
+		t.Errorf("override not logged; logs: %q", logs)
+	}
+
+	base, err := m.GetBaseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []netaddr.IP{netaddr.MustParseIP("9.9.9.9")}; !reflect.DeepEqual(base.Nameservers, want) {
+		t.Errorf("base nameservers = %v; want %v", base.Nameservers, want)
+	}
+
+	if err := m.SetDNS(OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(fs.files[path]); !strings.Contains(got, "nameserver 100.100.100.100\n") {
+		t.Errorf("%s not taken over:\n%s", path, got)
+	}
+	for _, name := range []string{resolvConf, backupConf} {
+		if _, ok := fs.files[name]; ok {
+			t.Errorf("wrote %s despite the override", name)
+		}
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(fs.files[path]); got != orig {
+		t.Errorf("restored %s = %q; want %q", path, got, orig)
+	}
+}
@@ -6,7 +6,10 @@ package dns
 
 import (
 	"bufio"
+	"fmt"
 	"runtime"
+	"strings"
+	"sync"
 	"time"
 
 	"inet.af/netaddr"
@@ -33,9 +36,14 @@ type Manager struct {
 	logf logger.Logf
 
 	resolver *resolver.Resolver
-	os       OSConfigurator
 
-	config Config
+	mu     sync.Mutex // guards os and config, and serializes applying them
+	os     OSConfigurator
+	config Config // last config passed to Set
+
+	// searchOrigins records where each search domain last applied
+	// to the OS came from, for SearchDomainOrigins.
+	searchOrigins map[dnsname.FQDN]SearchDomainOrigin
 }
 
 // NewManagers created a new manager from the given config.
@@ -55,7 +63,50 @@ func (m *Manager) Set(cfg Config) error {
 		cfg.WriteToBufioWriter(w)
 	}))
 
-	rcfg, ocfg, err := m.compileConfig(cfg)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.config = cfg
+	return m.applyLocked()
+}
+
+// SwitchManager replaces m's OSConfigurator with oscfg, for instance
+// when systemd-resolved starts or stops at runtime. The current config
+// is applied to oscfg before the old OSConfigurator is closed, so that
+// DNS keeps working throughout.
+//
+// If applying it fails, the error is returned, oscfg is closed, and m
+// goes back to the old OSConfigurator, reapplying the config compiled
+// for it. Either way, m owns oscfg once SwitchManager is called.
+func (m *Manager) SwitchManager(oscfg OSConfigurator) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old := m.os
+	m.os = oscfg
+	m.logf("switching from %T to %T", old, oscfg)
+	if err := m.applyLocked(); err != nil {
+		m.logf("switching to %T: %v; staying with %T", oscfg, err, old)
+		m.os = old
+		// The resolver may already have the config compiled for
+		// oscfg's capabilities. Put back the one for old.
+		if err := m.applyLocked(); err != nil {
+			m.logf("reapplying config to %T: %v", old, err)
+		}
+		if err := oscfg.Close(); err != nil {
+			m.logf("closing %T: %v", oscfg, err)
+		}
+		return err
+	}
+	if err := old.Close(); err != nil {
+		m.logf("closing %T: %v", old, err)
+	}
+	return nil
+}
+
+// applyLocked applies m.config to the resolver and m.os.
+// m.mu must be held.
+func (m *Manager) applyLocked() error {
+	rcfg, ocfg, origins, err := m.compileConfig(m.config)
 	if err != nil {
 		return err
 	}
@@ -71,13 +122,37 @@ func (m *Manager) Set(cfg Config) error {
 	if err := m.os.SetDNS(ocfg); err != nil {
 		return err
 	}
+	m.searchOrigins = origins
 
 	return nil
 }
 
+// SearchDomainOrigins reports, for each search domain in the most
+// recently applied OS config, which source it came from. It's meant
+// for diagnosing an unexpected search list.
+func (m *Manager) SearchDomainOrigins() map[dnsname.FQDN]SearchDomainOrigin {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ret := make(map[dnsname.FQDN]SearchDomainOrigin, len(m.searchOrigins))
+	for domain, origin := range m.searchOrigins {
+		ret[domain] = origin
+	}
+	return ret
+}
+
 // compileConfig converts cfg into a quad-100 resolver configuration
-// and an OS-level configuration.
-func (m *Manager) compileConfig(cfg Config) (rcfg resolver.Config, ocfg OSConfig, err error) {
+// and an OS-level configuration for m's OSConfigurator.
+func (m *Manager) compileConfig(cfg Config) (rcfg resolver.Config, ocfg OSConfig, origins map[dnsname.FQDN]SearchDomainOrigin, err error) {
+	return configToOSConfig(cfg, m.os.Features(), m.os.GetBaseConfig)
+}
+
+// configToOSConfig converts cfg into a quad-100 resolver configuration
+// and an OS-level configuration for an OSConfigurator with the given
+// features. getBase is its GetBaseConfig, called when the OS config
+// must blend in the base config.
+func configToOSConfig(cfg Config, features ManagerFeatures, getBase func() (OSConfig, error)) (rcfg resolver.Config, ocfg OSConfig, origins map[dnsname.FQDN]SearchDomainOrigin, err error) {
+	supportsSplit := features.Has(FeatureSplitDNS)
+
 	// The internal resolver always gets MagicDNS hosts and
 	// authoritative suffixes, even if we don't propagate MagicDNS to
 	// the OS.
@@ -92,6 +167,10 @@ func (m *Manager) compileConfig(cfg Config) (rcfg resolver.Config, ocfg OSConfig
 	}
 	// Similarly, the OS always gets search paths.
 	ocfg.SearchDomains = cfg.SearchDomains
+	origins = make(map[dnsname.FQDN]SearchDomainOrigin, len(cfg.SearchDomains))
+	for _, domain := range cfg.SearchDomains {
+		origins[domain] = SearchDomainFromMagicDNS
+	}
 
 	// Deal with trivial configs first.
 	switch {
@@ -99,19 +178,28 @@ func (m *Manager) compileConfig(cfg Config) (rcfg resolver.Config, ocfg OSConfig
 		// Set search domains, but nothing else. This also covers the
 		// case where cfg is entirely zero, in which case these
 		// configs clear all Tailscale DNS settings.
-		return rcfg, ocfg, nil
+		return rcfg, ocfg, origins, nil
 	case cfg.hasDefaultResolversOnly():
 		// Trivial CorpDNS configuration, just override the OS
 		// resolver.
 		ocfg.Nameservers = toIPsOnly(cfg.DefaultResolvers)
-		return rcfg, ocfg, nil
+		ocfg.NameserverPorts = nonDefaultPorts(cfg.DefaultResolvers)
+		return rcfg, ocfg, origins, nil
 	case cfg.hasDefaultResolvers():
 		// Default resolvers plus other stuff always ends up proxying
 		// through quad-100.
 		rcfg.Routes = routes
 		rcfg.Routes["."] = cfg.DefaultResolvers
 		ocfg.Nameservers = []netaddr.IP{tsaddr.TailscaleServiceIP()}
-		return rcfg, ocfg, nil
+		if supportsSplit && features.Has(FeatureCatchAllMatch) && runtime.GOOS != "windows" {
+			// Keep the routes visible to the OS, as match domains
+			// alongside a catch-all for the default resolvers, so
+			// that they take precedence over other interfaces'
+			// domains. Otherwise, quad-100 as the primary resolver
+			// already covers them.
+			ocfg.MatchDomains = append([]dnsname.FQDN{"."}, cfg.matchDomains()...)
+		}
+		return rcfg, ocfg, origins, nil
 	}
 
 	// From this point on, we're figuring out split DNS
@@ -135,12 +223,13 @@ func (m *Manager) compileConfig(cfg Config) (rcfg resolver.Config, ocfg OSConfig
 	// This bool is used in a couple of places below to implement this
 	// workaround.
 	isWindows := runtime.GOOS == "windows"
-	if cfg.singleResolverSet() != nil && m.os.SupportsSplitDNS() && !isWindows {
+	if cfg.singleResolverSet() != nil && supportsSplit && !isWindows {
 		// Split DNS configuration requested, where all split domains
 		// go to the same resolvers. We can let the OS do it.
 		ocfg.Nameservers = toIPsOnly(cfg.singleResolverSet())
+		ocfg.NameserverPorts = nonDefaultPorts(cfg.singleResolverSet())
 		ocfg.MatchDomains = cfg.matchDomains()
-		return rcfg, ocfg, nil
+		return rcfg, ocfg, origins, nil
 	}
 
 	// Split DNS configuration with either multiple upstream routes,
@@ -151,26 +240,33 @@ func (m *Manager) compileConfig(cfg Config) (rcfg resolver.Config, ocfg OSConfig
 
 	// If the OS can't do native split-dns, read out the underlying
 	// resolver config and blend it into our config.
-	if m.os.SupportsSplitDNS() {
+	if supportsSplit {
 		ocfg.MatchDomains = cfg.matchDomains()
 	}
-	if !m.os.SupportsSplitDNS() || isWindows {
-		bcfg, err := m.os.GetBaseConfig()
+	if !supportsSplit || isWindows {
+		bcfg, err := getBase()
 		if err != nil {
-			return resolver.Config{}, OSConfig{}, err
+			return resolver.Config{}, OSConfig{}, nil, err
 		}
 		rcfg.Routes["."] = toIPPorts(bcfg.Nameservers)
-		ocfg.SearchDomains = append(ocfg.SearchDomains, bcfg.SearchDomains...)
+		// Merge, but don't cap: what's too many depends on the
+		// resolver, and directManager warns about long lists when
+		// it writes them.
+		origins = map[dnsname.FQDN]SearchDomainOrigin{}
+		ocfg.SearchDomains = buildSearchList(nil, ocfg.SearchDomains, bcfg.SearchDomains, origins, 0)
+		// Carry over the base config's resolver options (e.g.
+		// trust-ad), which would otherwise be lost when we take over
+		// resolv.conf.
+		ocfg.Options = bcfg.Options
 	}
 
-	return rcfg, ocfg, nil
+	return rcfg, ocfg, origins, nil
 }
 
-// toIPsOnly returns only the IP portion of ipps.
-// TODO: this discards port information on the assumption that we're
-// always pointing at port 53.
-// https://github.com/tailscale/tailscale/issues/1666 tracks making
-// that not true, if we ever want to.
+// toIPsOnly returns only the IP portion of ipps. Callers that need
+// to keep non-53 ports pair it with nonDefaultPorts, whose result
+// goes in OSConfig.NameserverPorts
+// (https://github.com/tailscale/tailscale/issues/1666).
 func toIPsOnly(ipps []netaddr.IPPort) (ret []netaddr.IP) {
 	ret = make([]netaddr.IP, 0, len(ipps))
 	for _, ipp := range ipps {
@@ -179,6 +275,21 @@ func toIPsOnly(ipps []netaddr.IPPort) (ret []netaddr.IP) {
 	return ret
 }
 
+// nonDefaultPorts returns the ports of those ipps not on port 53,
+// keyed by IP, or nil if they're all on port 53.
+func nonDefaultPorts(ipps []netaddr.IPPort) (ret map[netaddr.IP]uint16) {
+	for _, ipp := range ipps {
+		if ipp.Port() == 53 {
+			continue
+		}
+		if ret == nil {
+			ret = map[netaddr.IP]uint16{}
+		}
+		ret[ipp.IP()] = ipp.Port()
+	}
+	return ret
+}
+
 func toIPPorts(ips []netaddr.IP) (ret []netaddr.IPPort) {
 	ret = make([]netaddr.IPPort, 0, len(ips))
 	for _, ip := range ips {
@@ -187,6 +298,73 @@ func toIPPorts(ips []netaddr.IP) (ret []netaddr.IPPort) {
 	return ret
 }
 
+// maxSearchDomains is the maximum number of search domains that glibc
+// before 2.26 honors, silently ignoring the rest. Newer glibc has no
+// such limit, but older systems are still around, so BuildSearchList
+// stays within it.
+const maxSearchDomains = 6
+
+// SearchDomainOrigin is the source of a search domain.
+type SearchDomainOrigin string
+
+const (
+	SearchDomainFromUser     SearchDomainOrigin = "user"     // configured by the user
+	SearchDomainFromMagicDNS SearchDomainOrigin = "magicdns" // from the tailnet's DNS config
+	SearchDomainFromBase     SearchDomainOrigin = "base"     // from the OS base config
+)
+
+// BuildSearchList merges search domains from several sources into a
+// single search list. Sources are in priority order: user-provided
+// domains come first, then MagicDNS domains, then the OS base
+// config's domains.
+//
+// Domains are deduplicated case-insensitively, keeping the spelling
+// of the first occurrence, and the result is capped at
+// maxSearchDomains entries.
+func BuildSearchList(user, magicDNS, base []dnsname.FQDN) []dnsname.FQDN {
+	return buildSearchList(user, magicDNS, base, nil, maxSearchDomains)
+}
+
+// BuildSearchListWithOrigins is like BuildSearchList, but also
+// reports which source each domain in the result came from.
+func BuildSearchListWithOrigins(user, magicDNS, base []dnsname.FQDN) ([]dnsname.FQDN, map[dnsname.FQDN]SearchDomainOrigin) {
+	origins := map[dnsname.FQDN]SearchDomainOrigin{}
+	return buildSearchList(user, magicDNS, base, origins, maxSearchDomains), origins
+}
+
+// buildSearchList implements BuildSearchList. If origins is non-nil,
+// the origin of each returned domain is recorded in it. If max is
+// positive, the result has at most max entries.
+func buildSearchList(user, magicDNS, base []dnsname.FQDN, origins map[dnsname.FQDN]SearchDomainOrigin, max int) []dnsname.FQDN {
+	var ret []dnsname.FQDN
+	seen := map[string]bool{}
+	sources := []struct {
+		domains []dnsname.FQDN
+		origin  SearchDomainOrigin
+	}{
+		{user, SearchDomainFromUser},
+		{magicDNS, SearchDomainFromMagicDNS},
+		{base, SearchDomainFromBase},
+	}
+	for _, src := range sources {
+		for _, domain := range src.domains {
+			if max > 0 && len(ret) == max {
+				return ret
+			}
+			k := strings.ToLower(domain.WithTrailingDot())
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			ret = append(ret, domain)
+			if origins != nil {
+				origins[domain] = src.origin
+			}
+		}
+	}
+	return ret
+}
+
 func (m *Manager) EnqueueRequest(bs []byte, from netaddr.IPPort) error {
 	return m.resolver.EnqueueRequest(bs, from)
 }
@@ -196,6 +374,8 @@ func (m *Manager) NextResponse() ([]byte, netaddr.IPPort, error) {
 }
 
 func (m *Manager) Down() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if err := m.os.Close(); err != nil {
 		return err
 	}
@@ -203,10 +383,93 @@ func (m *Manager) Down() error {
 	return nil
 }
 
+// NoOSConfiguratorError is returned by DiagnoseOSConfigurator when
+// none of the ways this platform knows to manage DNS looks usable.
+type NoOSConfiguratorError struct {
+	// Owner is the manager named in /etc/resolv.conf's header, or
+	// "" if none was recognized.
+	Owner string
+	// Rejected lists each OSConfigurator that was considered, in the
+	// order they were tried, with why it was passed over.
+	Rejected []RejectedOSConfigurator
+}
+
+// RejectedOSConfigurator is one entry of NoOSConfiguratorError.Rejected.
+type RejectedOSConfigurator struct {
+	Name   string // "systemd-resolved", "direct", etc.
+	Reason string
+}
+
+func (e *NoOSConfiguratorError) Error() string {
+	var sb strings.Builder
+	sb.WriteString("no usable DNS configurator")
+	if e.Owner == "" {
+		sb.WriteString(" (resolv.conf owner unknown)")
+	} else {
+		fmt.Fprintf(&sb, " (resolv.conf owner %q)", e.Owner)
+	}
+	for i, r := range e.Rejected {
+		if i == 0 {
+			sb.WriteString(": ")
+		} else {
+			sb.WriteString("; ")
+		}
+		fmt.Fprintf(&sb, "%s: %s", r.Name, r.Reason)
+	}
+	return sb.String()
+}
+
+// DiagnoseOSConfigurator reports why DNS configuration is likely to
+// fail on this system, as a *NoOSConfiguratorError listing each way
+// to manage DNS that was considered and why it was passed over. It
+// returns nil if NewOSConfigurator has something it expects to work.
+//
+// NewOSConfigurator itself never fails this way: writing resolv.conf
+// directly is always its last resort, so that a DNS problem stays a
+// DNS problem rather than keeping tailscaled from starting.
+func DiagnoseOSConfigurator(logf logger.Logf) error {
+	return diagnoseOSConfigurator(logf)
+}
+
+// NewOSConfigurator returns the OSConfigurator best suited to the
+// current system, with default options.
+func NewOSConfigurator(logf logger.Logf, interfaceName string) (OSConfigurator, error) {
+	return newOSConfigurator(logf, interfaceName, DirectOptions{})
+}
+
+// NewOSConfiguratorWithOptions is like NewOSConfigurator, but applies
+// opts if the chosen OSConfigurator writes /etc/resolv.conf directly.
+// If opts.Backend is set, it returns that registered OSConfigurator
+// instead; see RegisterManager.
+//
+// If opts.Root is set, the returned OSConfigurator always writes
+// resolv.conf directly under that root: the other configurators
+// manage the running system, not a system image.
+func NewOSConfiguratorWithOptions(logf logger.Logf, interfaceName string, opts DirectOptions) (OSConfigurator, error) {
+	if opts.Backend != "" {
+		factory := registeredManager(opts.Backend)
+		if factory == nil {
+			return nil, fmt.Errorf("unknown DNS backend %q", opts.Backend)
+		}
+		return factory(logf), nil
+	}
+	if opts.Root != "" {
+		return newDirectManagerWithOptions(logf, directFS{prefix: opts.Root}, opts), nil
+	}
+	return newOSConfigurator(logf, interfaceName, opts)
+}
+
 // Cleanup restores the system DNS configuration to its original state
 // in case the Tailscale daemon terminated without closing the router.
 // No other state needs to be instantiated before this runs.
+//
+// If a previous process wrote resolv.conf directly and left a
+// recovery manifest behind, Cleanup first restores resolv.conf from
+// it; see RecoverFromManifest.
 func Cleanup(logf logger.Logf, interfaceName string) {
+	if err := RecoverFromManifest(logf); err != nil {
+		logf("dns recovery: %v", err)
+	}
 	oscfg, err := NewOSConfigurator(logf, interfaceName)
 	if err != nil {
 		logf("creating dns cleanup: %v", err)
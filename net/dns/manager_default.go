@@ -9,9 +9,11 @@ package dns
 
 import "tailscale.com/types/logger"
 
-func NewOSConfigurator(logger.Logf, string) (OSConfigurator, error) {
+func newOSConfigurator(logger.Logf, string, DirectOptions) (OSConfigurator, error) {
 	// TODO(dmytro): on darwin, we should use a macOS-specific method such as scutil.
 	// This is currently not implemented. Editing /etc/resolv.conf does not work,
 	// as most applications use the system resolver, which disregards it.
 	return NewNoopManager()
 }
+
+func diagnoseOSConfigurator(logger.Logf) error { return nil }
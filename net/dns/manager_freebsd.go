@@ -6,16 +6,15 @@ package dns
 
 import (
 	"fmt"
-	"io/ioutil"
 	"os"
 
 	"tailscale.com/types/logger"
 )
 
-func NewOSConfigurator(logf logger.Logf, _ string) (OSConfigurator, error) {
-	bs, err := ioutil.ReadFile("/etc/resolv.conf")
+func newOSConfigurator(logf logger.Logf, _ string, opts DirectOptions) (OSConfigurator, error) {
+	bs, err := readBoundedResolvConf()
 	if os.IsNotExist(err) {
-		return newDirectManager(), nil
+		return newDirectManagerWithOptions(logf, directFS{}, opts), nil
 	}
 	if err != nil {
 		return nil, fmt.Errorf("reading /etc/resolv.conf: %w", err)
@@ -24,7 +23,12 @@ func NewOSConfigurator(logf logger.Logf, _ string) (OSConfigurator, error) {
 	switch resolvOwner(bs) {
 	case "resolvconf":
 		return newResolvconfManager(logf)
+	case "cloud-init":
+		logf("dns: warning: /etc/resolv.conf is managed by cloud-init, which may revert Tailscale's DNS settings")
+		return newDirectManagerWithOptions(logf, directFS{}, opts), nil
 	default:
-		return newDirectManager(), nil
+		return newDirectManagerWithOptions(logf, directFS{}, opts), nil
 	}
 }
+
+func diagnoseOSConfigurator(logger.Logf) error { return nil }
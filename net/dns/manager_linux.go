@@ -8,12 +8,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"os/exec"
 	"time"
 
 	"github.com/godbus/dbus/v5"
+	"golang.org/x/sys/unix"
 	"inet.af/netaddr"
 	"tailscale.com/types/logger"
 	"tailscale.com/util/cmpver"
@@ -27,28 +27,114 @@ func (kv kv) String() string {
 	return fmt.Sprintf("%s=%s", kv.k, kv.v)
 }
 
-func NewOSConfigurator(logf logger.Logf, interfaceName string) (ret OSConfigurator, err error) {
+func newOSConfigurator(logf logger.Logf, interfaceName string, opts DirectOptions) (OSConfigurator, error) {
+	mode, err := dnsMode(logf, defaultOSConfigEnv)
+	if err != nil {
+		return nil, err
+	}
+	switch mode {
+	case "systemd-resolved":
+		return newResolvedManager(logf, interfaceName)
+	case "network-manager":
+		return newNMManager(interfaceName)
+	case "debian-resolvconf":
+		return newResolvconfManager(logf)
+	default:
+		return newDirectManagerWithOptions(logf, directFS{}, opts), nil
+	}
+}
+
+// osConfigEnv is the system probes that dnsMode uses to pick an
+// OSConfigurator. Tests can substitute their own.
+type osConfigEnv struct {
+	// resolvOwner returns resolvOwner of /etc/resolv.conf, or an
+	// error satisfying os.IsNotExist if there isn't one.
+	resolvOwner                func() (string, error)
+	resolvedIsActuallyResolver func() error
+	dbusPing                   func(name, objectPath string) error
+	nmIsUsingResolved          func() error
+	nmVersionBetween           func(first, last string) (bool, error)
+	lookPath                   func(file string) (string, error)
+	// resolvWritable returns an error if directManager couldn't
+	// replace /etc/resolv.conf.
+	resolvWritable func() error
+}
+
+var defaultOSConfigEnv = osConfigEnv{
+	resolvOwner: func() (string, error) {
+		bs, err := readBoundedResolvConf()
+		if err != nil {
+			return "", err
+		}
+		return resolvOwner(bs), nil
+	},
+	resolvedIsActuallyResolver: resolvedIsActuallyResolver,
+	dbusPing:                   dbusPing,
+	nmIsUsingResolved:          nmIsUsingResolved,
+	nmVersionBetween:           nmVersionBetween,
+	lookPath:                   exec.LookPath,
+	resolvWritable:             resolvWritable,
+}
+
+// dnsMode reports which way newOSConfigurator should manage DNS, as
+// probed through env: "direct", "systemd-resolved",
+// "network-manager" or "debian-resolvconf".
+//
+// Direct is the last resort even if it looks like it can't work:
+// failing here would stop tailscaled from starting, and Cleanup from
+// restoring anything, over what is only a DNS problem. That case is
+// logged, and DiagnoseOSConfigurator reports it in detail.
+func dnsMode(logf logger.Logf, env osConfigEnv) (string, error) {
+	mode, unusable, err := selectDNSMode(logf, env)
+	if unusable != nil {
+		logf("dns: warning: %v; falling back to direct anyway", unusable)
+	}
+	return mode, err
+}
+
+// selectDNSMode implements dnsMode. If the mode it picks is "direct"
+// but resolv.conf doesn't look writable, unusable explains why each
+// configurator considered was passed over.
+func selectDNSMode(logf logger.Logf, env osConfigEnv) (ret string, unusable *NoOSConfiguratorError, err error) {
 	var debug []kv
 	dbg := func(k, v string) {
 		debug = append(debug, kv{k, v})
 	}
+	noCfg := &NoOSConfiguratorError{}
+	reject := func(name, reason string) {
+		noCfg.Rejected = append(noCfg.Rejected, RejectedOSConfigurator{name, reason})
+	}
+	// direct is the fallback of last resort, so it's used even if
+	// it's unlikely to work.
+	direct := func() (string, *NoOSConfiguratorError, error) {
+		if err := env.resolvWritable(); err != nil {
+			dbg("direct", "unwritable")
+			reject("direct", err.Error())
+			return "direct", noCfg, nil
+		}
+		return "direct", nil, nil
+	}
 	defer func() {
-		if ret != nil {
-			dbg("ret", fmt.Sprintf("%T", ret))
+		if ret != "" {
+			dbg("ret", ret)
 		}
 		logf("dns: %v", debug)
 	}()
 
-	bs, err := ioutil.ReadFile("/etc/resolv.conf")
+	owner, err := env.resolvOwner()
 	if os.IsNotExist(err) {
 		dbg("rc", "missing")
-		return newDirectManager(), nil
+		return direct()
 	}
 	if err != nil {
-		return nil, fmt.Errorf("reading /etc/resolv.conf: %w", err)
+		return "", nil, fmt.Errorf("reading /etc/resolv.conf: %w", err)
 	}
 
-	switch resolvOwner(bs) {
+	switch owner {
+	case "systemd-resolved", "resolvconf", "NetworkManager", "cloud-init":
+		noCfg.Owner = owner
+	}
+	switch owner {
 	case "systemd-resolved":
 		dbg("rc", "resolved")
 		// Some systems, for reasons known only to them, have a
@@ -56,22 +142,28 @@ func NewOSConfigurator(logf logger.Logf, interfaceName string) (ret OSConfigurat
 		// header, but doesn't actually point to resolved. We mustn't
 		// try to program resolved in that case.
 		// https://github.com/tailscale/tailscale/issues/2136
-		if err := resolvedIsActuallyResolver(); err != nil {
+		if err := env.resolvedIsActuallyResolver(); err != nil {
 			dbg("resolved", "not-in-use")
-			return newDirectManager(), nil
+			reject("systemd-resolved", err.Error())
+			return direct()
 		}
-		if err := dbusPing("org.freedesktop.resolve1", "/org/freedesktop/resolve1"); err != nil {
+		if err := env.dbusPing("org.freedesktop.resolve1", "/org/freedesktop/resolve1"); err != nil {
 			dbg("resolved", "no")
-			return newDirectManager(), nil
+			reason := "resolved not running"
+			if _, err := env.lookPath("systemctl"); err != nil {
+				reason += ", and no systemctl to start it"
+			}
+			reject("systemd-resolved", reason)
+			return direct()
 		}
-		if err := dbusPing("org.freedesktop.NetworkManager", "/org/freedesktop/NetworkManager/DnsManager"); err != nil {
+		if err := env.dbusPing("org.freedesktop.NetworkManager", "/org/freedesktop/NetworkManager/DnsManager"); err != nil {
 			dbg("nm", "no")
-			return newResolvedManager(logf, interfaceName)
+			return "systemd-resolved", nil, nil
 		}
 		dbg("nm", "yes")
-		if err := nmIsUsingResolved(); err != nil {
+		if err := env.nmIsUsingResolved(); err != nil {
 			dbg("nm-resolved", "no")
-			return newResolvedManager(logf, interfaceName)
+			return "systemd-resolved", nil, nil
 		}
 		dbg("nm-resolved", "yes")
 
@@ -109,26 +201,27 @@ func NewOSConfigurator(logf logger.Logf, interfaceName string) (ret OSConfigurat
 		// that comes with it (see
 		// https://github.com/tailscale/tailscale/issues/1699,
 		// https://github.com/tailscale/tailscale/pull/1945)
-		safe, err := nmVersionBetween("1.26.0", "1.26.5")
+		safe, err := env.nmVersionBetween("1.26.0", "1.26.5")
 		if err != nil {
 			// Failed to figure out NM's version, can't make a correct
 			// decision.
-			return nil, fmt.Errorf("checking NetworkManager version: %v", err)
+			return "", nil, fmt.Errorf("checking NetworkManager version: %v", err)
 		}
 		if safe {
 			dbg("nm-safe", "yes")
-			return newNMManager(interfaceName)
+			return "network-manager", nil, nil
 		}
 		dbg("nm-safe", "no")
-		return newResolvedManager(logf, interfaceName)
+		return "systemd-resolved", nil, nil
 	case "resolvconf":
 		dbg("rc", "resolvconf")
-		if _, err := exec.LookPath("resolvconf"); err != nil {
+		if _, err := env.lookPath("resolvconf"); err != nil {
 			dbg("resolvconf", "no")
-			return newDirectManager(), nil
+			reject("debian-resolvconf", "no resolvconf binary")
+			return direct()
 		}
 		dbg("resolvconf", "yes")
-		return newResolvconfManager(logf)
+		return "debian-resolvconf", nil, nil
 	case "NetworkManager":
 		// You'd think we would use newNMManager somewhere in
 		// here. However, as explained in
@@ -143,10 +236,18 @@ func NewOSConfigurator(logf logger.Logf, interfaceName string) (ret OSConfigurat
 		// anyway, so you still need a fallback path that uses
 		// directManager.
 		dbg("rc", "nm")
-		return newDirectManager(), nil
+		reject("network-manager", "not used when NetworkManager owns resolv.conf")
+		return direct()
+	case "cloud-init":
+		// cloud-init only writes resolv.conf on first boot (or every
+		// boot, if so configured), with nothing for us to talk to.
+		// Take it over, but warn, as it may put its own back.
+		dbg("rc", "cloud-init")
+		logf("dns: warning: /etc/resolv.conf is managed by cloud-init, which may revert Tailscale's DNS settings")
+		return direct()
 	default:
 		dbg("rc", "unknown")
-		return newDirectManager(), nil
+		return direct()
 	}
 }
 
@@ -195,7 +296,7 @@ func nmIsUsingResolved() error {
 }
 
 func resolvedIsActuallyResolver() error {
-	cfg, err := newDirectManager().readResolvConf()
+	cfg, err := newDirectManager(logger.Discard).readResolvConf()
 	if err != nil {
 		return err
 	}
@@ -205,6 +306,38 @@ func resolvedIsActuallyResolver() error {
 	return nil
 }
 
+func diagnoseOSConfigurator(logf logger.Logf) error {
+	_, unusable, err := selectDNSMode(logf, defaultOSConfigEnv)
+	if err != nil {
+		return err
+	}
+	if unusable != nil {
+		return unusable
+	}
+	return nil
+}
+
+// resolvWritable reports whether directManager could replace
+// /etc/resolv.conf, either by writing the file in place or, if
+// there's none yet, by creating it in /etc.
+func resolvWritable() error {
+	const path = "/etc/resolv.conf"
+	err := unix.Access(path, unix.W_OK)
+	if os.IsNotExist(err) {
+		if err := unix.Access("/etc", unix.W_OK); err != nil {
+			return fmt.Errorf("/etc not writable: %w", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s not writable: %w", path, err)
+	}
+	if immutable, _ := (directFS{}).IsImmutable(path); immutable {
+		return fmt.Errorf("%s is immutable", path)
+	}
+	return nil
+}
+
 func dbusPing(name, objectPath string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
@@ -0,0 +1,118 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestDNSMode(t *testing.T) {
+	errNo := errors.New("no")
+	ok := func() error { return nil }
+	fail := func() error { return errNo }
+
+	tests := []struct {
+		name     string
+		owner    string
+		ownerErr error
+		resolved func() error // resolvedIsActuallyResolver
+		haveTool bool         // whether resolvconf is in $PATH
+		want     string
+	}{
+		{name: "no-resolv-conf", ownerErr: os.ErrNotExist, want: "direct"},
+		{name: "resolvconf", owner: "resolvconf", haveTool: true, want: "debian-resolvconf"},
+		{name: "resolvconf-not-installed", owner: "resolvconf", want: "direct"},
+		{name: "network-manager", owner: "NetworkManager", want: "direct"},
+		{name: "cloud-init", owner: "cloud-init", want: "direct"},
+		{name: "resolved", owner: "systemd-resolved", resolved: ok, want: "systemd-resolved"},
+		{name: "resolved-not-in-use", owner: "systemd-resolved", resolved: fail, want: "direct"},
+		{name: "unknown", want: "direct"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := osConfigEnv{
+				resolvOwner:                func() (string, error) { return tt.owner, tt.ownerErr },
+				resolvedIsActuallyResolver: tt.resolved,
+				dbusPing: func(name, _ string) error {
+					if name == "org.freedesktop.resolve1" {
+						return nil
+					}
+					return errNo // no NetworkManager
+				},
+				nmIsUsingResolved: fail,
+				nmVersionBetween:  func(string, string) (bool, error) { return false, errNo },
+				lookPath: func(file string) (string, error) {
+					if tt.haveTool {
+						return "/sbin/" + file, nil
+					}
+					return "", errNo
+				},
+				resolvWritable: ok,
+			}
+			got, err := dnsMode(t.Logf, env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("dnsMode = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDNSModeNoneUsable(t *testing.T) {
+	errNo := errors.New("no")
+	fail := func() error { return errNo }
+	env := func(owner string) osConfigEnv {
+		return osConfigEnv{
+			resolvOwner:                func() (string, error) { return owner, nil },
+			resolvedIsActuallyResolver: func() error { return nil },
+			dbusPing:                   func(string, string) error { return errNo },
+			nmIsUsingResolved:          fail,
+			nmVersionBetween:           func(string, string) (bool, error) { return false, errNo },
+			lookPath:                   func(string) (string, error) { return "", errNo },
+			resolvWritable:             func() error { return errors.New("/etc/resolv.conf not writable: read-only file system") },
+		}
+	}
+
+	tests := []struct {
+		owner string
+		want  string
+	}{
+		{
+			owner: "systemd-resolved",
+			want:  `no usable DNS configurator (resolv.conf owner "systemd-resolved"): systemd-resolved: resolved not running, and no systemctl to start it; direct: /etc/resolv.conf not writable: read-only file system`,
+		},
+		{
+			owner: "resolvconf",
+			want:  `no usable DNS configurator (resolv.conf owner "resolvconf"): debian-resolvconf: no resolvconf binary; direct: /etc/resolv.conf not writable: read-only file system`,
+		},
+		{
+			owner: "",
+			want:  `no usable DNS configurator (resolv.conf owner unknown): direct: /etc/resolv.conf not writable: read-only file system`,
+		},
+	}
+	for _, tt := range tests {
+		// Direct is still the last resort, so tailscaled can start.
+		got, err := dnsMode(t.Logf, env(tt.owner))
+		if err != nil || got != "direct" {
+			t.Errorf("owner %q: dnsMode = %q, %v; want direct, nil", tt.owner, got, err)
+		}
+
+		got, unusable, err := selectDNSMode(t.Logf, env(tt.owner))
+		if err != nil || got != "direct" {
+			t.Errorf("owner %q: selectDNSMode = %q, %v; want direct, nil", tt.owner, got, err)
+		}
+		if unusable == nil {
+			t.Errorf("owner %q: no diagnostic for unwritable resolv.conf", tt.owner)
+			continue
+		}
+		if unusable.Error() != tt.want {
+			t.Errorf("owner %q: diagnostic =\n%s\nwant\n%s", tt.owner, unusable, tt.want)
+		}
+	}
+}
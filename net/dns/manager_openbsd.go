@@ -6,6 +6,8 @@ package dns
 
 import "tailscale.com/types/logger"
 
-func NewOSConfigurator(logger.Logf, string) (OSConfigurator, error) {
-	return newDirectManager(), nil
+func newOSConfigurator(logf logger.Logf, _ string, opts DirectOptions) (OSConfigurator, error) {
+	return newDirectManagerWithOptions(logf, directFS{}, opts), nil
 }
+
+func diagnoseOSConfigurator(logger.Logf) error { return nil }
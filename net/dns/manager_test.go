@@ -5,7 +5,12 @@
 package dns
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
 	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -21,10 +26,18 @@ type fakeOSConfigurator struct {
 
 	OSConfig       OSConfig
 	ResolverConfig resolver.Config
+
+	// OnClose, if non-nil, is called by Close.
+	OnClose func()
+	// SetErr, if non-nil, is returned by SetDNS.
+	SetErr error
 }
 
 func (c *fakeOSConfigurator) SetDNS(cfg OSConfig) error {
-	if !c.SplitDNS && len(cfg.MatchDomains) > 0 {
+	if c.SetErr != nil {
+		return c.SetErr
+	}
+	if !c.SplitDNS && (len(cfg.MatchDomains) > 0 || len(cfg.Routes) > 0) {
 		panic("split DNS config passed to non-split OSConfigurator")
 	}
 	c.OSConfig = cfg
@@ -39,11 +52,27 @@ func (c *fakeOSConfigurator) SupportsSplitDNS() bool {
 	return c.SplitDNS
 }
 
+func (c *fakeOSConfigurator) Features() ManagerFeatures {
+	if c.SplitDNS {
+		return FeatureSplitDNS
+	}
+	return 0
+}
+
+func (c *fakeOSConfigurator) CanRepresent(cfg OSConfig) bool {
+	return c.Features().CanRepresent(cfg)
+}
+
 func (c *fakeOSConfigurator) GetBaseConfig() (OSConfig, error) {
 	return c.BaseConfig, nil
 }
 
-func (c *fakeOSConfigurator) Close() error { return nil }
+func (c *fakeOSConfigurator) Close() error {
+	if c.OnClose != nil {
+		c.OnClose()
+	}
+	return nil
+}
 
 func TestManager(t *testing.T) {
 	if runtime.GOOS == "windows" {
@@ -226,6 +255,20 @@ func TestManager(t *testing.T) {
 				MatchDomains:  fqdns("corp.com"),
 			},
 		},
+		{
+			name: "routes-split-port",
+			in: Config{
+				Routes:        upstreams("corp.com", "2.2.2.2:5353"),
+				SearchDomains: fqdns("tailscale.com", "universe.tf"),
+			},
+			split: true,
+			os: OSConfig{
+				Nameservers:     mustIPs("2.2.2.2"),
+				NameserverPorts: map[netaddr.IP]uint16{netaddr.MustParseIP("2.2.2.2"): 5353},
+				SearchDomains:   fqdns("tailscale.com", "universe.tf"),
+				MatchDomains:    fqdns("corp.com"),
+			},
+		},
 		{
 			name: "routes-multi",
 			in: Config{
@@ -394,6 +437,188 @@ func TestManager(t *testing.T) {
 	}
 }
 
+func TestConfigToOSConfig(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skipf("split DNS always goes through quad-100 on windows")
+	}
+
+	// MagicDNS's global resolvers, plus split routes.
+	cfg := Config{
+		DefaultResolvers: mustIPPs("1.1.1.1:53"),
+		Routes: upstreams(
+			"corp.com", "2.2.2.2:53",
+			"ts.com", ""),
+		SearchDomains: fqdns("ts.com"),
+	}
+	noBase := func() (OSConfig, error) {
+		t.Fatal("unexpected GetBaseConfig call")
+		return OSConfig{}, nil
+	}
+	trIP := cmp.Transformer("ipStr", func(ip netaddr.IP) string { return ip.String() })
+	for _, tt := range []struct {
+		features ManagerFeatures
+		want     OSConfig
+	}{
+		{
+			features: FeatureSplitDNS | FeatureCatchAllMatch,
+			want: OSConfig{
+				Nameservers:   mustIPs("100.100.100.100"),
+				SearchDomains: fqdns("ts.com"),
+				MatchDomains:  fqdns(".", "corp.com", "ts.com"),
+			},
+		},
+		{
+			// Split DNS, but no way to say "and everything
+			// else": quad-100 stays the primary resolver, and
+			// handles the routes itself.
+			features: FeatureSplitDNS,
+			want: OSConfig{
+				Nameservers:   mustIPs("100.100.100.100"),
+				SearchDomains: fqdns("ts.com"),
+			},
+		},
+		{
+			features: 0,
+			want: OSConfig{
+				Nameservers:   mustIPs("100.100.100.100"),
+				SearchDomains: fqdns("ts.com"),
+			},
+		},
+	} {
+		_, got, _, err := configToOSConfig(cfg, tt.features, noBase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(got, tt.want, trIP, cmpopts.EquateEmpty()); diff != "" {
+			t.Errorf("features=%#x: wrong OSConfig (-got+want)\n%s", tt.features, diff)
+		}
+	}
+}
+
+func TestManagerSwitchManager(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skipf("split DNS always goes through quad-100 on windows")
+	}
+
+	direct := &fakeOSConfigurator{}
+	m := NewManager(t.Logf, direct, nil, nil)
+	cfg := Config{
+		Routes:        upstreams("corp.com", "2.2.2.2:53"),
+		SearchDomains: fqdns("tailscale.com"),
+	}
+	if err := m.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// The config is recompiled for the new OSConfigurator, which
+	// can do split DNS itself.
+	resolved := &fakeOSConfigurator{SplitDNS: true}
+	want := OSConfig{
+		Nameservers:   mustIPs("2.2.2.2"),
+		SearchDomains: fqdns("tailscale.com"),
+		MatchDomains:  fqdns("corp.com"),
+	}
+	trIP := cmp.Transformer("ipStr", func(ip netaddr.IP) string { return ip.String() })
+	closed := false
+	direct.OnClose = func() {
+		closed = true
+		if diff := cmp.Diff(resolved.OSConfig, want, trIP, cmpopts.EquateEmpty()); diff != "" {
+			t.Errorf("new OSConfigurator not configured before old one was closed (-got+want)\n%s", diff)
+		}
+	}
+	if err := m.SwitchManager(resolved); err != nil {
+		t.Fatal(err)
+	}
+	if !closed {
+		t.Errorf("old OSConfigurator wasn't closed")
+	}
+
+	// Later configs go to the new OSConfigurator only.
+	direct.OSConfig = OSConfig{}
+	cfg.SearchDomains = fqdns("universe.tf")
+	if err := m.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if !direct.OSConfig.IsZero() {
+		t.Errorf("old OSConfigurator got config %+v after switch", direct.OSConfig)
+	}
+	if got, want := resolved.OSConfig.SearchDomains, fqdns("universe.tf"); !cmp.Equal(got, want) {
+		t.Errorf("new OSConfigurator search domains = %v; want %v", got, want)
+	}
+
+	// A switch that fails leaves the current OSConfigurator in
+	// charge, with its config reapplied, and closes the new one.
+	want.SearchDomains = fqdns("universe.tf")
+	resolved.OSConfig = OSConfig{}
+	broken := &fakeOSConfigurator{SetErr: errors.New("broken")}
+	brokenClosed := false
+	broken.OnClose = func() { brokenClosed = true }
+	if err := m.SwitchManager(broken); err == nil {
+		t.Fatal("SwitchManager to a failing OSConfigurator succeeded")
+	}
+	if !brokenClosed {
+		t.Errorf("failed OSConfigurator wasn't closed")
+	}
+	if diff := cmp.Diff(resolved.OSConfig, want, trIP, cmpopts.EquateEmpty()); diff != "" {
+		t.Errorf("config not reapplied to the current OSConfigurator (-got+want)\n%s", diff)
+	}
+}
+
+func TestBuildSearchList(t *testing.T) {
+	got := BuildSearchList(
+		fqdns("corp.example.com", "user.example"),
+		fqdns("tail-scale.ts.net", "CORP.example.com", "magic.example"),
+		fqdns("user.example", "lan", "home.arpa", "office.example"),
+	)
+	want := fqdns("corp.example.com", "user.example", "tail-scale.ts.net", "magic.example", "lan", "home.arpa")
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("wrong search list (-got+want)\n%s", diff)
+	}
+}
+
+func TestBuildSearchListWithOrigins(t *testing.T) {
+	got, origins := BuildSearchListWithOrigins(
+		fqdns("corp.example.com", "user.example"),
+		fqdns("tail-scale.ts.net", "CORP.example.com", "magic.example"),
+		fqdns("user.example", "lan", "home.arpa", "office.example"),
+	)
+	if want := BuildSearchList(
+		fqdns("corp.example.com", "user.example"),
+		fqdns("tail-scale.ts.net", "CORP.example.com", "magic.example"),
+		fqdns("user.example", "lan", "home.arpa", "office.example"),
+	); !cmp.Equal(got, want) {
+		t.Errorf("search list = %v; want %v, as from BuildSearchList", got, want)
+	}
+	wantOrigins := map[dnsname.FQDN]SearchDomainOrigin{
+		"corp.example.com.":  SearchDomainFromUser,
+		"user.example.":      SearchDomainFromUser,
+		"tail-scale.ts.net.": SearchDomainFromMagicDNS,
+		"magic.example.":     SearchDomainFromMagicDNS,
+		"lan.":               SearchDomainFromBase,
+		"home.arpa.":         SearchDomainFromBase,
+	}
+	if diff := cmp.Diff(origins, wantOrigins); diff != "" {
+		t.Errorf("wrong origins (-got+want)\n%s", diff)
+	}
+
+	// The manager records origins of what it last applied.
+	f := &fakeOSConfigurator{BaseConfig: OSConfig{SearchDomains: fqdns("lan", "tail-scale.ts.net")}}
+	m := NewManager(t.Logf, f, nil, nil)
+	if err := m.Set(Config{
+		Routes:        upstreams("corp.com", "2.2.2.2:53"),
+		SearchDomains: fqdns("tail-scale.ts.net"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	wantOrigins = map[dnsname.FQDN]SearchDomainOrigin{
+		"tail-scale.ts.net.": SearchDomainFromMagicDNS,
+		"lan.":               SearchDomainFromBase,
+	}
+	if diff := cmp.Diff(m.SearchDomainOrigins(), wantOrigins); diff != "" {
+		t.Errorf("wrong manager origins (-got+want)\n%s", diff)
+	}
+}
+
 func mustIPs(strs ...string) (ret []netaddr.IP) {
 	for _, s := range strs {
 		ret = append(ret, netaddr.MustParseIP(s))
@@ -463,3 +688,69 @@ func upstreams(strs ...string) (ret map[dnsname.FQDN][]netaddr.IPPort) {
 	}
 	return ret
 }
+
+func TestOSConfigRoutes(t *testing.T) {
+	corp, lab := dnsname.FQDN("corp.example.com."), dnsname.FQDN("lab.example.com.")
+	cfg := OSConfig{
+		Nameservers: []netaddr.IP{netaddr.MustParseIP("8.8.8.8")},
+		Routes: map[dnsname.FQDN][]netaddr.IP{
+			corp: {netaddr.MustParseIP("10.0.0.53")},
+			lab:  {netaddr.MustParseIP("10.1.0.53"), netaddr.MustParseIP("10.1.0.54")},
+		},
+	}
+	split := &fakeOSConfigurator{SplitDNS: true}
+	if err := split.SetDNS(cfg); err != nil {
+		t.Fatal(err)
+	}
+	for domain, want := range cfg.Routes {
+		if got := split.OSConfig.Routes[domain]; !reflect.DeepEqual(got, want) {
+			t.Errorf("route for %s = %v; want %v", domain, got, want)
+		}
+	}
+	if !split.OSConfig.Equal(cfg) {
+		t.Errorf("registered config %+v isn't Equal to %+v", split.OSConfig, cfg)
+	}
+
+	var logs []string
+	logf := func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	fs := newMemFS()
+	m := newDirectManagerOnFS(logf, fs)
+	m.restartResolved = func() {}
+	if err := m.SetDNS(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if all := strings.Join(logs, "\n"); !strings.Contains(all, "ignoring routes for 2 domains") {
+		t.Errorf("directManager didn't log ignoring routes; logs:\n%s", all)
+	}
+	if b := fs.files[resolvConf]; bytes.Contains(b, []byte("10.0.0.53")) {
+		t.Errorf("resolv.conf contains a route's nameserver:\n%s", b)
+	}
+}
+
+func TestConfigToOSConfigUncappedSearch(t *testing.T) {
+	// Blending in the base config merges search domains but, unlike
+	// BuildSearchList, doesn't cap them; that's left to the writer.
+	cfg := Config{
+		Routes:        upstreams("corp.com", "2.2.2.2:53", "ts.com", ""),
+		SearchDomains: fqdns("a.ts.com", "b.ts.com", "c.ts.com", "d.ts.com"),
+	}
+	base := func() (OSConfig, error) {
+		return OSConfig{
+			Nameservers:   mustIPs("8.8.8.8"),
+			SearchDomains: fqdns("B.ts.com", "lan", "home.arpa", "office.example"),
+		}, nil
+	}
+	_, got, origins, err := configToOSConfig(cfg, 0, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fqdns("a.ts.com", "b.ts.com", "c.ts.com", "d.ts.com", "lan", "home.arpa", "office.example")
+	if diff := cmp.Diff(got.SearchDomains, want); diff != "" {
+		t.Errorf("wrong search domains (-got+want)\n%s", diff)
+	}
+	if o := origins["office.example."]; o != SearchDomainFromBase {
+		t.Errorf("origin of office.example = %q; want %q", o, SearchDomainFromBase)
+	}
+}
@@ -41,12 +41,14 @@ type windowsManager struct {
 	wslManager *wslManager
 }
 
-func NewOSConfigurator(logf logger.Logf, interfaceName string) (OSConfigurator, error) {
+func diagnoseOSConfigurator(logger.Logf) error { return nil }
+
+func newOSConfigurator(logf logger.Logf, interfaceName string, opts DirectOptions) (OSConfigurator, error) {
 	ret := windowsManager{
 		logf:       logf,
 		guid:       interfaceName,
 		nrptWorks:  isWindows10OrBetter(),
-		wslManager: newWSLManager(logf),
+		wslManager: newWSLManager(logf, opts),
 	}
 
 	// Best-effort: if our NRPT rule exists, try to delete it. Unlike
@@ -322,6 +324,18 @@ func (m windowsManager) SupportsSplitDNS() bool {
 	return m.nrptWorks
 }
 
+func (m windowsManager) Features() ManagerFeatures {
+	f := FeatureMultiInterface
+	if m.SupportsSplitDNS() {
+		f |= FeatureSplitDNS
+	}
+	return f
+}
+
+func (m windowsManager) CanRepresent(cfg OSConfig) bool {
+	return m.Features().CanRepresent(cfg)
+}
+
 func (m windowsManager) Close() error {
 	return m.SetDNS(OSConfig{})
 }
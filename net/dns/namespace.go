@@ -0,0 +1,113 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"fmt"
+	"os"
+)
+
+// nsFS is a WholeFileFS that performs every operation on fs from
+// within another namespace, for DirectOptions.Namespace. The optional
+// interfaces are forwarded too, and fail if fs doesn't implement
+// them.
+type nsFS struct {
+	fs WholeFileFS
+	// enter calls f from within the namespace and returns its error,
+	// or an error if the namespace can't be entered.
+	enter func(f func() error) error
+}
+
+func (fs nsFS) Stat(name string) (isRegular bool, err error) {
+	err = fs.enter(func() (err error) {
+		isRegular, err = fs.fs.Stat(name)
+		return err
+	})
+	return isRegular, err
+}
+
+func (fs nsFS) Rename(oldName, newName string) error {
+	return fs.enter(func() error { return fs.fs.Rename(oldName, newName) })
+}
+
+func (fs nsFS) Remove(name string) error {
+	return fs.enter(func() error { return fs.fs.Remove(name) })
+}
+
+func (fs nsFS) ReadFile(name string, maxSize int64) (b []byte, err error) {
+	err = fs.enter(func() (err error) {
+		b, err = fs.fs.ReadFile(name, maxSize)
+		return err
+	})
+	return b, err
+}
+
+func (fs nsFS) WriteFile(name string, contents []byte, perm os.FileMode) error {
+	return fs.enter(func() error { return fs.fs.WriteFile(name, contents, perm) })
+}
+
+func (fs nsFS) ReadDir(dir string) (names []string, err error) {
+	dl, ok := fs.fs.(dirLister)
+	if !ok {
+		return nil, fmt.Errorf("%T can't list directories", fs.fs)
+	}
+	err = fs.enter(func() (err error) {
+		names, err = dl.ReadDir(dir)
+		return err
+	})
+	return names, err
+}
+
+func (fs nsFS) Readlink(name string) (target string, err error) {
+	rl, ok := fs.fs.(symlinkReader)
+	if !ok {
+		return "", fmt.Errorf("%T can't read symlinks", fs.fs)
+	}
+	err = fs.enter(func() (err error) {
+		target, err = rl.Readlink(name)
+		return err
+	})
+	return target, err
+}
+
+func (fs nsFS) Symlink(target, name string) error {
+	sl, ok := fs.fs.(symlinker)
+	if !ok {
+		return fmt.Errorf("%T can't make symlinks", fs.fs)
+	}
+	return fs.enter(func() error { return sl.Symlink(target, name) })
+}
+
+func (fs nsFS) SameFile(a, b string) (same bool, err error) {
+	sf, ok := fs.fs.(sameFiler)
+	if !ok {
+		return false, fmt.Errorf("%T can't compare files", fs.fs)
+	}
+	err = fs.enter(func() (err error) {
+		same, err = sf.SameFile(a, b)
+		return err
+	})
+	return same, err
+}
+
+func (fs nsFS) FileMeta(name string) (meta fileMeta, err error) {
+	mfs, ok := fs.fs.(metaFS)
+	if !ok {
+		return fileMeta{}, fmt.Errorf("%T can't read file metadata", fs.fs)
+	}
+	err = fs.enter(func() (err error) {
+		meta, err = mfs.FileMeta(name)
+		return err
+	})
+	return meta, err
+}
+
+func (fs nsFS) SetFileMeta(name string, meta fileMeta) error {
+	mfs, ok := fs.fs.(metaFS)
+	if !ok {
+		return fmt.Errorf("%T can't set file metadata", fs.fs)
+	}
+	return fs.enter(func() error { return mfs.SetFileMeta(name, meta) })
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// enterNamespace returns a function that calls f from within the
+// namespace at path, such as "/proc/1234/ns/mnt".
+//
+// f runs on a goroutine of its own, locked to an OS thread that first
+// stops sharing file system attributes with the rest of the process,
+// as the kernel won't move a thread that shares them into another
+// mount namespace. That thread can't safely be reused afterwards, so
+// the goroutine exits still locked to it, which makes the runtime
+// discard it. Each call therefore costs a thread, which is fine for
+// the handful of file operations a DNS change makes.
+func enterNamespace(path string) func(f func() error) error {
+	return func(f func() error) error {
+		errc := make(chan error, 1)
+		go func() {
+			runtime.LockOSThread()
+			// Deliberately no UnlockOSThread; see above.
+			ns, err := os.Open(path)
+			if err != nil {
+				errc <- fmt.Errorf("entering namespace: %w", err)
+				return
+			}
+			defer ns.Close()
+			if err := unix.Unshare(unix.CLONE_FS); err != nil {
+				errc <- fmt.Errorf("entering namespace %s: unshare: %w", path, err)
+				return
+			}
+			if err := unix.Setns(int(ns.Fd()), 0); err != nil {
+				errc <- fmt.Errorf("entering namespace %s: setns: %w", path, err)
+				return
+			}
+			errc <- f()
+		}()
+		return <-errc
+	}
+}
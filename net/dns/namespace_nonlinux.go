@@ -0,0 +1,21 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package dns
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// enterNamespace returns a function that fails: namespaces are
+// Linux-only.
+func enterNamespace(path string) func(f func() error) error {
+	return func(func() error) error {
+		return fmt.Errorf("entering namespace %s: not supported on %s", path, runtime.GOOS)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"os"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+// insideFS is a memFS that fails the test if it's used while *inside
+// is false.
+type insideFS struct {
+	*memFS
+	t      *testing.T
+	inside *bool
+}
+
+func (fs insideFS) check(op, name string) {
+	if !*fs.inside {
+		fs.t.Errorf("%s(%q) outside the namespace", op, name)
+	}
+}
+
+func (fs insideFS) Stat(name string) (bool, error) {
+	fs.check("Stat", name)
+	return fs.memFS.Stat(name)
+}
+
+func (fs insideFS) Rename(oldName, newName string) error {
+	fs.check("Rename", oldName)
+	return fs.memFS.Rename(oldName, newName)
+}
+
+func (fs insideFS) Remove(name string) error {
+	fs.check("Remove", name)
+	return fs.memFS.Remove(name)
+}
+
+func (fs insideFS) ReadFile(name string, maxSize int64) ([]byte, error) {
+	fs.check("ReadFile", name)
+	return fs.memFS.ReadFile(name, maxSize)
+}
+
+func (fs insideFS) WriteFile(name string, contents []byte, perm os.FileMode) error {
+	fs.check("WriteFile", name)
+	return fs.memFS.WriteFile(name, contents, perm)
+}
+
+func TestNamespaceFS(t *testing.T) {
+	const orig = "nameserver 9.9.9.9\n"
+	var inside bool
+	entered := 0
+	enter := func(f func() error) error {
+		entered++
+		inside = true
+		defer func() { inside = false }()
+		return f()
+	}
+	mem := newMemFS()
+	mem.files[resolvConf] = []byte(orig)
+	m := newDirectManagerOnFS(t.Logf, nsFS{fs: insideFS{mem, t, &inside}, enter: enter})
+	m.readTimeout = 0 // keep FS calls on the test goroutine
+	m.restartResolved = func() {}
+
+	if err := m.SetDNS(OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.GetBaseConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if entered == 0 {
+		t.Error("namespace never entered")
+	}
+	if got := string(mem.files[resolvConf]); got != orig {
+		t.Errorf("after Close, resolv.conf = %q; want %q", got, orig)
+	}
+}
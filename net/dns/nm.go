@@ -173,6 +173,10 @@ func (m *nmManager) trySet(ctx context.Context, config OSConfig) error {
 		// Non-split routing requested, add an all-domains match.
 		search = append(search, "~.")
 	}
+	// A catch-all match domain (added as "~." above) routes
+	// everything to us, as non-split routing does.
+	_, catchAll := config.splitMatchDomains()
+	split := len(config.MatchDomains) > 0 && !catchAll
 
 	// Ideally we would like to disable LLMNR and mdns on the
 	// interface here, but older NetworkManagers don't understand
@@ -187,7 +191,7 @@ func (m *nmManager) trySet(ctx context.Context, config OSConfig) error {
 	// We should only request priority if we have nameservers to set.
 	if len(dnsv4) == 0 {
 		ipv4Map["dns-priority"] = dbus.MakeVariant(lowerPriority)
-	} else if len(config.MatchDomains) > 0 {
+	} else if split {
 		// Set a fairly high priority, but don't override all other
 		// configs when in split-DNS mode.
 		ipv4Map["dns-priority"] = dbus.MakeVariant(mediumPriority)
@@ -225,7 +229,7 @@ func (m *nmManager) trySet(ctx context.Context, config OSConfig) error {
 	ipv6Map["dns-search"] = dbus.MakeVariant(search)
 	if len(dnsv6) == 0 {
 		ipv6Map["dns-priority"] = dbus.MakeVariant(lowerPriority)
-	} else if len(config.MatchDomains) > 0 {
+	} else if split {
 		// Set a fairly high priority, but don't override all other
 		// configs when in split-DNS mode.
 		ipv6Map["dns-priority"] = dbus.MakeVariant(mediumPriority)
@@ -272,6 +276,18 @@ func (m *nmManager) SupportsSplitDNS() bool {
 	return mode == "dnsmasq" || mode == "systemd-resolved"
 }
 
+func (m *nmManager) Features() ManagerFeatures {
+	f := FeatureMultiInterface
+	if m.SupportsSplitDNS() {
+		f |= FeatureSplitDNS | FeatureCatchAllMatch
+	}
+	return f
+}
+
+func (m *nmManager) CanRepresent(cfg OSConfig) bool {
+	return m.Features().CanRepresent(cfg)
+}
+
 func (m *nmManager) GetBaseConfig() (OSConfig, error) {
 	conn, err := dbus.SystemBus()
 	if err != nil {
@@ -6,13 +6,18 @@ package dns
 
 type noopManager struct{}
 
-func (m noopManager) SetDNS(OSConfig) error  { return nil }
-func (m noopManager) SupportsSplitDNS() bool { return false }
-func (m noopManager) Close() error           { return nil }
+func (m noopManager) SetDNS(OSConfig) error     { return nil }
+func (m noopManager) SupportsSplitDNS() bool    { return false }
+func (m noopManager) Features() ManagerFeatures { return 0 }
+func (m noopManager) Close() error              { return nil }
 func (m noopManager) GetBaseConfig() (OSConfig, error) {
 	return OSConfig{}, ErrGetBaseConfigNotSupported
 }
 
+// CanRepresent reports whether cfg is zero, as noopManager applies
+// nothing else.
+func (m noopManager) CanRepresent(cfg OSConfig) bool { return cfg.IsZero() }
+
 func NewNoopManager() (noopManager, error) {
 	return noopManager{}, nil
 }
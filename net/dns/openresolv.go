@@ -37,7 +37,7 @@ func (m openresolvManager) SetDNS(config OSConfig) error {
 	}
 
 	var stdin bytes.Buffer
-	writeResolvConf(&stdin, config.Nameservers, config.SearchDomains)
+	writeResolvConf(&stdin, config.Nameservers, config.NameserverSources, config.SearchDomains, config.resolvOptions(), LineEndingLF)
 
 	cmd := exec.Command("resolvconf", "-m", "0", "-x", "-a", "tailscale")
 	cmd.Stdin = &stdin
@@ -52,6 +52,14 @@ func (m openresolvManager) SupportsSplitDNS() bool {
 	return false
 }
 
+func (m openresolvManager) Features() ManagerFeatures {
+	return FeatureResolvConf | FeatureMultiInterface
+}
+
+func (m openresolvManager) CanRepresent(cfg OSConfig) bool {
+	return m.Features().CanRepresent(cfg)
+}
+
 func (m openresolvManager) GetBaseConfig() (OSConfig, error) {
 	// List the names of all config snippets openresolv is aware
 	// of. Snippets get listed in priority order (most to least),
@@ -5,7 +5,11 @@
 package dns
 
 import (
+	"crypto/sha256"
 	"errors"
+	"fmt"
+	"sort"
+	"strings"
 
 	"inet.af/netaddr"
 	"tailscale.com/util/dnsname"
@@ -22,6 +26,15 @@ type OSConfigurator interface {
 	// installing a resolver only for specific DNS suffixes. If false,
 	// the configurator can only set a global resolver.
 	SupportsSplitDNS() bool
+	// Features reports the optional capabilities of the
+	// configurator, so that callers can tailor the configuration
+	// they generate. FeatureSplitDNS must be consistent with
+	// SupportsSplitDNS.
+	Features() ManagerFeatures
+	// CanRepresent reports whether SetDNS(cfg) would apply all of
+	// cfg, losing none of its information, so that callers can pick
+	// a richer configurator if not.
+	CanRepresent(cfg OSConfig) bool
 	// GetBaseConfig returns the OS's "base" configuration, i.e. the
 	// resolver settings the OS would use without Tailscale
 	// contributing any configuration.
@@ -36,24 +49,303 @@ type OSConfigurator interface {
 	Close() error
 }
 
+// ManagerFeatures is a set of optional OSConfigurator capabilities.
+type ManagerFeatures uint32
+
+const (
+	// FeatureResolvConf means the configurator applies settings by
+	// writing resolv.conf(5), directly or via a helper tool.
+	FeatureResolvConf ManagerFeatures = 1 << iota
+	// FeatureSplitDNS means the configurator can install resolvers
+	// for specific DNS suffixes only. See SupportsSplitDNS.
+	FeatureSplitDNS
+	// FeatureReverseZones means reverse lookup zones (in-addr.arpa,
+	// ip6.arpa) can be routed to specific resolvers.
+	FeatureReverseZones
+	// FeatureMultiInterface means the OS keeps DNS settings per
+	// network interface and merges them, rather than having a single
+	// global configuration.
+	FeatureMultiInterface
+	// FeatureCatchAllMatch means the configurator understands the
+	// root domain "." in OSConfig.MatchDomains as a catch-all, next
+	// to the other match domains. Without it, the manager never
+	// sends one.
+	FeatureCatchAllMatch
+)
+
+// Has reports whether f includes all features in x.
+func (f ManagerFeatures) Has(x ManagerFeatures) bool {
+	return f&x == x
+}
+
+// CanRepresent reports whether a configurator with features f can
+// apply cfg without losing information, as far as its features tell.
+// It's the basis of most OSConfigurator.CanRepresent implementations.
+func (f ManagerFeatures) CanRepresent(cfg OSConfig) bool {
+	// No configurator can yet forward to per-domain resolvers or
+	// query nameservers on other ports.
+	if len(cfg.Routes) > 0 {
+		return false
+	}
+	for _, port := range cfg.NameserverPorts {
+		if port != 53 {
+			return false
+		}
+	}
+	match, _ := cfg.splitMatchDomains()
+	if len(match) > 0 && !f.Has(FeatureSplitDNS) {
+		return false
+	}
+	if !f.Has(FeatureReverseZones) {
+		for _, d := range match {
+			if isReverseZone(d) {
+				return false
+			}
+		}
+	}
+	if len(cfg.resolvOptions()) > 0 && !f.Has(FeatureResolvConf) {
+		return false
+	}
+	return true
+}
+
 // OSConfig is an OS DNS configuration.
 type OSConfig struct {
 	// Nameservers are the IP addresses of the nameservers to use.
+	// Order is significant: resolvers generally try nameservers in
+	// order, so callers merging several sources must put the
+	// preferred ones first. OSConfigurators keep the order as given.
 	Nameservers []netaddr.IP
 	// SearchDomains are the domain suffixes to use when expanding
 	// single-label name queries. SearchDomains is additive to
 	// whatever non-Tailscale search domains the OS has.
+	// Like Nameservers, they're tried in order.
 	SearchDomains []dnsname.FQDN
 	// MatchDomains are the DNS suffixes for which Nameservers should
 	// be used. If empty, Nameservers is installed as the "primary" resolver.
 	// A non-empty MatchDomains requests a "split DNS" configuration
 	// from the OS, which will only work with OSConfigurators that
-	// report SupportsSplitDNS()=true.
+	// report SupportsSplitDNS()=true. The root domain "." is a
+	// catch-all, making Nameservers a default route for all queries
+	// without dropping the specific domains. Manager only sends it
+	// to configurators with FeatureCatchAllMatch; configurators that
+	// write resolv.conf ignore it.
 	MatchDomains []dnsname.FQDN
+	// Routes are conditional forwarders: queries for names under
+	// each domain go to its nameservers, and everything else to
+	// Nameservers, e.g. corp.example.com -> 10.0.0.53. Like
+	// MatchDomains, it's a split DNS configuration, so only
+	// OSConfigurators that report SupportsSplitDNS()=true can use it;
+	// others ignore it.
+	Routes map[dnsname.FQDN][]netaddr.IP
+	// NameserverPorts maps entries of Nameservers to the UDP port
+	// to query them on, for those not listening on port 53.
+	// resolv.conf can't express ports, so only split-DNS-capable
+	// configurators honor it; others use port 53 regardless.
+	NameserverPorts map[netaddr.IP]uint16
+	// NameserverSources optionally labels entries of Nameservers
+	// with where they came from, such as "MagicDNS", for humans
+	// reading resolv.conf. Configurators that write resolv.conf add
+	// them as comments; others ignore them. They're cosmetic, so
+	// Equal and Hash ignore them too.
+	NameserverSources map[netaddr.IP]string
+	// Options are resolv.conf(5) "options" settings, such as
+	// "ndots:2" or "trust-ad". Only configurators that write
+	// resolv.conf honor them; others ignore them.
+	Options []string
+	// TrustAD requests the "trust-ad" resolver option, which makes
+	// glibc trust the AD (authenticated data) bit in responses from
+	// DNSSEC-validating nameservers. Like Options, it's only honored
+	// by configurators that write resolv.conf.
+	TrustAD bool
+	// NoAAAA requests the "no-aaaa" resolver option (glibc 2.36+),
+	// which suppresses AAAA queries, for networks where IPv6 lookups
+	// cause trouble. Like Options, it's only honored by
+	// configurators that write resolv.conf.
+	NoAAAA bool
+	// SingleRequest and SingleRequestReopen request the
+	// "single-request" and "single-request-reopen" resolver options,
+	// which make glibc send A and AAAA queries one after the other
+	// (from a fresh socket, for the latter) instead of in parallel,
+	// for networks whose middleboxes drop one of a parallel pair.
+	// Like Options, they're only honored by configurators that write
+	// resolv.conf.
+	SingleRequest       bool
+	SingleRequestReopen bool
+	// Debug requests the "debug" resolver option, which makes glibc
+	// trace its queries to stderr, when built with debugging support.
+	// It's for troubleshooting, not for everyday use. Like Options,
+	// it's only honored by configurators that write resolv.conf.
+	Debug bool
 }
 
+// splitMatchDomains returns o.MatchDomains without the root domain
+// ".", and whether it was there. A root match domain is a catch-all:
+// it asks for all queries to be routed through Nameservers, which
+// split-DNS configurators express as their default-route setting for
+// the interface rather than as a match domain.
+func (o OSConfig) splitMatchDomains() (domains []dnsname.FQDN, catchAll bool) {
+	for _, d := range o.MatchDomains {
+		if d == "." {
+			catchAll = true
+			continue
+		}
+		domains = append(domains, d)
+	}
+	return domains, catchAll
+}
+
+// IsZero reports whether o configures no nameservers or domains.
+// Options and flags alone don't make a config non-zero, since there's
+// nothing for them to apply to.
 func (o OSConfig) IsZero() bool {
-	return len(o.Nameservers) == 0 && len(o.SearchDomains) == 0 && len(o.MatchDomains) == 0
+	return len(o.Nameservers) == 0 && len(o.SearchDomains) == 0 && len(o.MatchDomains) == 0 && len(o.Routes) == 0
+}
+
+// resolvOptions returns the resolv.conf options for o: o.Options,
+// followed by any options requested by o's flags that aren't already
+// present.
+func (o OSConfig) resolvOptions() []string {
+	ret := o.Options
+	addFlag := func(set bool, opt string) {
+		if !set {
+			return
+		}
+		for _, have := range ret {
+			if have == opt {
+				return
+			}
+		}
+		ret = append(ret[:len(ret):len(ret)], opt)
+	}
+	addFlag(o.TrustAD, "trust-ad")
+	addFlag(o.NoAAAA, "no-aaaa")
+	addFlag(o.SingleRequest, "single-request")
+	addFlag(o.SingleRequestReopen, "single-request-reopen")
+	addFlag(o.Debug, "debug")
+	return ret
+}
+
+// Hash returns a hash of o, for cheap change detection. Configs that
+// differ only in ways that don't change their meaning hash equally:
+// domains and nameservers are normalized first (see Normalize), and the order of
+// MatchDomains, NameserverPorts and Routes doesn't matter. The order of
+// Nameservers, SearchDomains and Options does, as resolvers honor it.
+func (o OSConfig) Hash() [32]byte {
+	o = o.Normalize()
+	h := sha256.New()
+	// Each value is length-prefixed and each list is prefixed with
+	// its name and length, so different configs can't run together
+	// into the same byte stream.
+	list := func(name string, vals []string) {
+		fmt.Fprintf(h, "%s:%d;", name, len(vals))
+		for _, v := range vals {
+			fmt.Fprintf(h, "%d:%s;", len(v), v)
+		}
+	}
+
+	var vals []string
+	for _, ip := range o.Nameservers {
+		vals = append(vals, ip.String())
+	}
+	list("ns", vals)
+
+	vals = vals[:0]
+	for _, d := range o.SearchDomains {
+		vals = append(vals, string(d))
+	}
+	list("search", vals)
+
+	vals = vals[:0]
+	for _, d := range o.MatchDomains {
+		vals = append(vals, string(d))
+	}
+	sort.Strings(vals)
+	list("match", vals)
+
+	vals = vals[:0]
+	for ip, port := range o.NameserverPorts {
+		vals = append(vals, fmt.Sprintf("%v/%d", ip, port))
+	}
+	sort.Strings(vals)
+	list("ports", vals)
+
+	// Each route's nameservers are in order of preference, but the
+	// routes themselves aren't ordered.
+	vals = vals[:0]
+	for domain, ips := range o.Routes {
+		v := string(domain) + "="
+		for _, ip := range ips {
+			v += ip.String() + ","
+		}
+		vals = append(vals, v)
+	}
+	sort.Strings(vals)
+	list("routes", vals)
+
+	list("options", o.Options)
+	fmt.Fprintf(h, "trust-ad:%v;no-aaaa:%v;single-request:%v;single-request-reopen:%v;debug:%v;",
+		o.TrustAD, o.NoAAAA, o.SingleRequest, o.SingleRequestReopen, o.Debug)
+
+	var sum [32]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// Normalize returns a copy of o with its domains in canonical form:
+// lowercased, fully qualified with a single trailing dot, and with
+// duplicates removed (keeping the first occurrence). Nameservers are
+// likewise deduplicated, with IPv4-mapped IPv6 addresses unmapped, so
+// that "::ffff:10.0.0.1" and "10.0.0.1" count as the same server.
+func (o OSConfig) Normalize() OSConfig {
+	o.Nameservers = normalizeNameservers(o.Nameservers)
+	o.SearchDomains = normalizeDomains(o.SearchDomains)
+	o.MatchDomains = normalizeDomains(o.MatchDomains)
+	return o
+}
+
+// normalizeNameservers returns ips unmapped and without duplicates.
+// netaddr.IP values are already canonical, however they were spelled
+// when parsed, so this is all it takes for each to be written in its
+// canonical form exactly once.
+func normalizeNameservers(ips []netaddr.IP) []netaddr.IP {
+	if len(ips) == 0 {
+		return ips
+	}
+	ret := make([]netaddr.IP, 0, len(ips))
+	seen := make(map[netaddr.IP]bool, len(ips))
+	for _, ip := range ips {
+		ip = ip.Unmap()
+		if seen[ip] {
+			continue
+		}
+		seen[ip] = true
+		ret = append(ret, ip)
+	}
+	return ret
+}
+
+func normalizeDomains(domains []dnsname.FQDN) []dnsname.FQDN {
+	if len(domains) == 0 {
+		return domains
+	}
+	ret := make([]dnsname.FQDN, 0, len(domains))
+	seen := make(map[dnsname.FQDN]bool, len(domains))
+	for _, domain := range domains {
+		lower := strings.ToLower(string(domain))
+		fqdn, err := dnsname.ToFQDN(lower)
+		if err != nil {
+			// Not something we can canonicalize; keep it as-is
+			// (modulo case) rather than silently dropping it.
+			fqdn = dnsname.FQDN(lower)
+		}
+		if seen[fqdn] {
+			continue
+		}
+		seen[fqdn] = true
+		ret = append(ret, fqdn)
+	}
+	return ret
 }
 
 func (a OSConfig) Equal(b OSConfig) bool {
@@ -66,6 +358,36 @@ func (a OSConfig) Equal(b OSConfig) bool {
 	if len(a.MatchDomains) != len(b.MatchDomains) {
 		return false
 	}
+	if len(a.Options) != len(b.Options) {
+		return false
+	}
+	if a.TrustAD != b.TrustAD || a.NoAAAA != b.NoAAAA ||
+		a.SingleRequest != b.SingleRequest || a.SingleRequestReopen != b.SingleRequestReopen ||
+		a.Debug != b.Debug {
+		return false
+	}
+	if len(a.NameserverPorts) != len(b.NameserverPorts) {
+		return false
+	}
+	if len(a.Routes) != len(b.Routes) {
+		return false
+	}
+	for domain, ips := range a.Routes {
+		bips, ok := b.Routes[domain]
+		if !ok || len(bips) != len(ips) {
+			return false
+		}
+		for i := range ips {
+			if ips[i] != bips[i] {
+				return false
+			}
+		}
+	}
+	for ip, port := range a.NameserverPorts {
+		if bport, ok := b.NameserverPorts[ip]; !ok || bport != port {
+			return false
+		}
+	}
 
 	for i := range a.Nameservers {
 		if a.Nameservers[i] != b.Nameservers[i] {
@@ -82,6 +404,11 @@ func (a OSConfig) Equal(b OSConfig) bool {
 			return false
 		}
 	}
+	for i := range a.Options {
+		if a.Options[i] != b.Options[i] {
+			return false
+		}
+	}
 
 	return true
 }
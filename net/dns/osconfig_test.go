@@ -0,0 +1,116 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"reflect"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/util/dnsname"
+)
+
+func TestOSConfigNormalize(t *testing.T) {
+	in := OSConfig{
+		Nameservers: []netaddr.IP{
+			netaddr.MustParseIP("::ffff:10.0.0.1"),
+			netaddr.MustParseIP("2001:db8::1"),
+			netaddr.MustParseIP("10.0.0.1"),
+		},
+		SearchDomains: []dnsname.FQDN{"Example.COM.", "example.com", "ts.net."},
+		MatchDomains:  []dnsname.FQDN{"Corp.Example.", "corp.example."},
+	}
+	got := in.Normalize()
+	want := OSConfig{
+		Nameservers:   []netaddr.IP{netaddr.MustParseIP("10.0.0.1"), netaddr.MustParseIP("2001:db8::1")},
+		SearchDomains: []dnsname.FQDN{"example.com.", "ts.net."},
+		MatchDomains:  []dnsname.FQDN{"corp.example."},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Normalize = %+v; want %+v", got, want)
+	}
+	if in.SearchDomains[0] != "Example.COM." {
+		t.Errorf("Normalize modified its receiver")
+	}
+}
+
+func TestOSConfigHash(t *testing.T) {
+	base := OSConfig{
+		Nameservers:     []netaddr.IP{netaddr.MustParseIP("100.100.100.100"), netaddr.MustParseIP("8.8.8.8")},
+		SearchDomains:   []dnsname.FQDN{"example.com.", "ts.net."},
+		MatchDomains:    []dnsname.FQDN{"corp.example.", "ts.net."},
+		NameserverPorts: map[netaddr.IP]uint16{netaddr.MustParseIP("8.8.8.8"): 5353},
+		Options:         []string{"ndots:2"},
+	}
+	same := OSConfig{
+		Nameservers:     []netaddr.IP{netaddr.MustParseIP("100.100.100.100"), netaddr.MustParseIP("8.8.8.8")},
+		SearchDomains:   []dnsname.FQDN{"Example.COM", "example.com.", "ts.net"},
+		MatchDomains:    []dnsname.FQDN{"ts.net.", "CORP.example"},
+		NameserverPorts: map[netaddr.IP]uint16{netaddr.MustParseIP("8.8.8.8"): 5353},
+		Options:         []string{"ndots:2"},
+	}
+	if base.Hash() != same.Hash() {
+		t.Errorf("equivalent configs hash differently")
+	}
+
+	changes := map[string]func(*OSConfig){
+		"nameserver-order": func(c *OSConfig) {
+			c.Nameservers = []netaddr.IP{c.Nameservers[1], c.Nameservers[0]}
+		},
+		"search-order": func(c *OSConfig) {
+			c.SearchDomains = []dnsname.FQDN{"ts.net.", "example.com."}
+		},
+		"port": func(c *OSConfig) { c.NameserverPorts = nil },
+		"routes": func(c *OSConfig) {
+			c.Routes = map[dnsname.FQDN][]netaddr.IP{"corp.example.": {netaddr.MustParseIP("10.0.0.53")}}
+		},
+		"options":               func(c *OSConfig) { c.Options = []string{"ndots:1"} },
+		"trustad":               func(c *OSConfig) { c.TrustAD = true },
+		"noaaaa":                func(c *OSConfig) { c.NoAAAA = true },
+		"single-request":        func(c *OSConfig) { c.SingleRequest = true },
+		"single-request-reopen": func(c *OSConfig) { c.SingleRequestReopen = true },
+		"debug":                 func(c *OSConfig) { c.Debug = true },
+		// A domain moving between lists changes the config.
+		"match-to-search": func(c *OSConfig) {
+			c.SearchDomains = []dnsname.FQDN{"example.com.", "ts.net.", "corp.example."}
+			c.MatchDomains = []dnsname.FQDN{"ts.net."}
+		},
+	}
+	for name, change := range changes {
+		c := base
+		change(&c)
+		if c.Hash() == base.Hash() {
+			t.Errorf("%s: changed config hashes the same", name)
+		}
+	}
+}
+
+func TestManagerFeaturesCanRepresent(t *testing.T) {
+	ns := []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}
+	tests := []struct {
+		name string
+		f    ManagerFeatures
+		cfg  OSConfig
+		want bool
+	}{
+		{"plain", 0, OSConfig{Nameservers: ns, SearchDomains: []dnsname.FQDN{"ts.net."}}, true},
+		{"catch-all", 0, OSConfig{Nameservers: ns, MatchDomains: []dnsname.FQDN{"."}}, true},
+		{"split", FeatureSplitDNS, OSConfig{Nameservers: ns, MatchDomains: []dnsname.FQDN{"corp.example."}}, true},
+		{"split-unsupported", FeatureResolvConf, OSConfig{Nameservers: ns, MatchDomains: []dnsname.FQDN{"corp.example."}}, false},
+		{"reverse", FeatureSplitDNS | FeatureReverseZones, OSConfig{Nameservers: ns, MatchDomains: []dnsname.FQDN{"64.100.in-addr.arpa."}}, true},
+		{"reverse-unsupported", FeatureSplitDNS, OSConfig{Nameservers: ns, MatchDomains: []dnsname.FQDN{"64.100.in-addr.arpa."}}, false},
+		{"options", FeatureResolvConf, OSConfig{Nameservers: ns, TrustAD: true}, true},
+		{"options-unsupported", FeatureSplitDNS, OSConfig{Nameservers: ns, Options: []string{"ndots:2"}}, false},
+		{"routes", FeatureSplitDNS | FeatureReverseZones, OSConfig{
+			Nameservers: ns,
+			Routes:      map[dnsname.FQDN][]netaddr.IP{"corp.example.": ns},
+		}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.f.CanRepresent(tt.cfg); got != tt.want {
+			t.Errorf("%s: CanRepresent = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"inet.af/netaddr"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/dnsname"
+)
+
+// recoveryManifest is where directManager records what it has done
+// to resolv.conf, so that a process started after a crash can undo
+// it. It's on the same file system as resolv.conf and its backup, as
+// it must survive a reboot just like they do.
+const recoveryManifest = "/etc/resolv.tailscale-recovery.json"
+
+// manifest is the content of recoveryManifest.
+type manifest struct {
+	// Mode is the way DNS was being managed. Only "direct" is
+	// written so far.
+	Mode string
+	// ResolvConf is the file Tailscale took over.
+	ResolvConf string
+	// Backup is where the pre-Tailscale ResolvConf was saved.
+	Backup string
+	// The config that was written, for debugging.
+	Nameservers   []netaddr.IP   `json:",omitempty"`
+	SearchDomains []dnsname.FQDN `json:",omitempty"`
+	Options       []string       `json:",omitempty"`
+}
+
+// writeManifestLocked records in m.manifestPath that resolv.conf now
+// holds config. It's best effort: without it, Close still restores
+// the backup. m.mu must be held.
+func (m *directManager) writeManifestLocked(config OSConfig) {
+	if m.manifestPath == "" || m.noBackup {
+		// Nothing to recover.
+		return
+	}
+	b, err := json.Marshal(manifest{
+		Mode:          "direct",
+		ResolvConf:    m.resolvConfPath,
+		Backup:        m.backupPath,
+		Nameservers:   config.Nameservers,
+		SearchDomains: config.SearchDomains,
+		Options:       config.resolvOptions(),
+	})
+	if err == nil {
+		err = m.atomicWriteFile(m.manifestPath, b, 0644)
+	}
+	if err != nil {
+		m.logf("writing recovery manifest %s: %v", m.manifestPath, err)
+	}
+}
+
+// RecoverFromManifest finishes the restore that Close would have done,
+// if a previous process took over resolv.conf and exited without
+// closing its manager, as recorded in its recovery manifest. It's
+// meant to run once at startup, before any SetDNS. It does nothing if
+// there's no manifest.
+func (m *directManager) RecoverFromManifest() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.manifestPath == "" {
+		return nil
+	}
+	b, err := m.readFile(m.manifestPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var man manifest
+	if err := json.Unmarshal(b, &man); err != nil {
+		return fmt.Errorf("parsing %s: %w", m.manifestPath, err)
+	}
+	if man.Mode != "direct" {
+		return fmt.Errorf("%s: unknown mode %q", m.manifestPath, man.Mode)
+	}
+	if man.ResolvConf != m.resolvConfPath {
+		return fmt.Errorf("%s is for %s, not %s", m.manifestPath, man.ResolvConf, m.resolvConfPath)
+	}
+	if man.Backup != "" && man.Backup != m.backupPath {
+		// The crashed process backed up elsewhere; look there too.
+		m.otherBackups = append([]string{man.Backup}, m.otherBackups...)
+	}
+	m.logf("recovering from unclean exit: restoring %s", m.resolvConfPath)
+	restored, err := m.restoreBackup()
+	if err != nil {
+		return err
+	}
+	if !restored {
+		m.logf("no backup of %s to restore, or it's no longer ours", m.resolvConfPath)
+	}
+	m.removeManifest()
+	return nil
+}
+
+// removeManifest removes the recovery manifest, once resolv.conf has
+// been handed back.
+func (m *directManager) removeManifest() {
+	if m.manifestPath != "" {
+		m.fs.Remove(m.manifestPath)
+	}
+}
+
+// RecoverFromManifest runs directManager.RecoverFromManifest on the
+// real file system, for use at startup.
+func RecoverFromManifest(logf logger.Logf) error {
+	return newDirectManager(logf).RecoverFromManifest()
+}
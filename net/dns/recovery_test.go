@@ -0,0 +1,80 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestRecoverFromManifest(t *testing.T) {
+	const orig = "nameserver 9.9.9.9\n"
+	fs := newMemFS()
+	fs.files[resolvConf] = []byte(orig)
+
+	m := newDirectManagerOnFS(t.Logf, fs)
+	m.restartResolved = func() {}
+	cfg := OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}}
+	if err := m.SetDNS(cfg); err != nil {
+		t.Fatal(err)
+	}
+	var man manifest
+	if err := json.Unmarshal(fs.files[recoveryManifest], &man); err != nil {
+		t.Fatalf("reading manifest: %v", err)
+	}
+	want := manifest{
+		Mode:        "direct",
+		ResolvConf:  resolvConf,
+		Backup:      backupConf,
+		Nameservers: cfg.Nameservers,
+	}
+	if !reflect.DeepEqual(man, want) {
+		t.Errorf("manifest = %+v; want %+v", man, want)
+	}
+
+	// The process dies here, without Close. A fresh one recovers.
+	m = newDirectManagerOnFS(t.Logf, fs)
+	if err := m.RecoverFromManifest(); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(fs.files[resolvConf]); got != orig {
+		t.Errorf("recovered resolv.conf = %q; want %q", got, orig)
+	}
+	for _, name := range []string{backupConf, recoveryManifest} {
+		if _, ok := fs.files[name]; ok {
+			t.Errorf("%s left behind after recovery", name)
+		}
+	}
+
+	// With nothing to recover, it's a no-op.
+	if err := m.RecoverFromManifest(); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(fs.files[resolvConf]); got != orig {
+		t.Errorf("resolv.conf after second recovery = %q; want %q", got, orig)
+	}
+}
+
+func TestCloseRemovesManifest(t *testing.T) {
+	fs := newMemFS()
+	fs.files[resolvConf] = []byte("nameserver 9.9.9.9\n")
+	m := newDirectManagerOnFS(t.Logf, fs)
+	m.restartResolved = func() {}
+	if err := m.SetDNS(OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fs.files[recoveryManifest]; !ok {
+		t.Fatalf("SetDNS wrote no manifest")
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fs.files[recoveryManifest]; ok {
+		t.Errorf("manifest left behind after Close")
+	}
+}
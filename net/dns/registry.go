@@ -0,0 +1,41 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"fmt"
+	"sync"
+
+	"tailscale.com/types/logger"
+)
+
+var (
+	registryMu sync.Mutex
+	registry   = map[string]func(logger.Logf) OSConfigurator{}
+)
+
+// RegisterManager makes a custom OSConfigurator available under name,
+// for embedders with DNS backends of their own. It's selected by
+// setting DirectOptions.Backend to name, and is consulted before the
+// built-in OSConfigurators. RegisterManager panics if name is empty
+// or already registered; it's meant to be called from init functions.
+func RegisterManager(name string, factory func(logger.Logf) OSConfigurator) {
+	if name == "" || factory == nil {
+		panic("dns: RegisterManager needs a name and a factory")
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, dup := registry[name]; dup {
+		panic(fmt.Sprintf("dns: RegisterManager called twice for %q", name))
+	}
+	registry[name] = factory
+}
+
+// registeredManager returns the factory registered under name, or nil.
+func registeredManager(name string) func(logger.Logf) OSConfigurator {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	return registry[name]
+}
@@ -0,0 +1,33 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"testing"
+
+	"tailscale.com/types/logger"
+)
+
+func TestRegisterManager(t *testing.T) {
+	fake := &fakeOSConfigurator{}
+	RegisterManager("test-fake", func(logger.Logf) OSConfigurator { return fake })
+	defer func() {
+		registryMu.Lock()
+		delete(registry, "test-fake")
+		registryMu.Unlock()
+	}()
+
+	got, err := NewOSConfiguratorWithOptions(t.Logf, "tailscale0", DirectOptions{Backend: "test-fake"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != fake {
+		t.Errorf("NewOSConfiguratorWithOptions = %T %p; want the registered fake %p", got, got, fake)
+	}
+
+	if _, err := NewOSConfiguratorWithOptions(t.Logf, "tailscale0", DirectOptions{Backend: "no-such-backend"}); err == nil {
+		t.Error("unregistered backend: got nil error")
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//go:build gofuzz
+// +build gofuzz
+
+package dns
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// FuzzReadResolv checks that readResolv doesn't panic, and that
+// whatever it parses survives a trip through writeResolvConf.
+// Seed inputs are in testdata/resolv-corpus.
+func FuzzReadResolv(data []byte) int {
+	if len(data) > defaultMaxFileSize {
+		// directManager never parses anything bigger.
+		return -1
+	}
+	cfg, err := readResolv(bytes.NewReader(data))
+	if err != nil {
+		return 0
+	}
+	var buf bytes.Buffer
+	writeResolvConf(&buf, cfg.Nameservers, nil, cfg.SearchDomains, cfg.Options, LineEndingLF)
+	cfg2, err := readResolv(&buf)
+	if err != nil {
+		panic(fmt.Sprintf("re-reading %q: %v", buf.Bytes(), err))
+	}
+	if !cfg.Equal(cfg2) {
+		panic(fmt.Sprintf("round trip of %q: got %+v; want %+v", data, cfg2, cfg))
+	}
+	return 1
+}
@@ -68,7 +68,7 @@ func isResolvedActive() bool {
 		return false
 	}
 
-	config, err := newDirectManager().readResolvConf()
+	config, err := newDirectManager(logger.Discard).readResolvConf()
 	if err != nil {
 		return false
 	}
@@ -81,11 +81,17 @@ func isResolvedActive() bool {
 	return false
 }
 
+// resolvedCaller is the part of dbus.BusObject that resolvedManager
+// uses, so that tests can fake resolved.
+type resolvedCaller interface {
+	CallWithContext(ctx context.Context, method string, flags dbus.Flags, args ...interface{}) *dbus.Call
+}
+
 // resolvedManager is an OSConfigurator which uses the systemd-resolved DBus API.
 type resolvedManager struct {
 	logf     logger.Logf
 	ifidx    int
-	resolved dbus.BusObject
+	resolved resolvedCaller
 }
 
 func newResolvedManager(logf logger.Logf, interfaceName string) (*resolvedManager, error) {
@@ -134,7 +140,8 @@ func (m *resolvedManager) SetDNS(config OSConfig) error {
 		return fmt.Errorf("setLinkDNS: %w", err)
 	}
 
-	linkDomains := make([]resolvedLinkDomain, 0, len(config.SearchDomains)+len(config.MatchDomains))
+	matchDomains, catchAll := config.splitMatchDomains()
+	linkDomains := make([]resolvedLinkDomain, 0, len(config.SearchDomains)+len(matchDomains))
 	seenDomains := map[dnsname.FQDN]bool{}
 	for _, domain := range config.SearchDomains {
 		if seenDomains[domain] {
@@ -146,7 +153,7 @@ func (m *resolvedManager) SetDNS(config OSConfig) error {
 			RoutingOnly: false,
 		})
 	}
-	for _, domain := range config.MatchDomains {
+	for _, domain := range matchDomains {
 		if seenDomains[domain] {
 			// Search domains act as both search and match in
 			// resolved, so it's correct to skip.
@@ -175,7 +182,14 @@ func (m *resolvedManager) SetDNS(config OSConfig) error {
 		return fmt.Errorf("setLinkDomains: %w", err)
 	}
 
-	if call := m.resolved.CallWithContext(ctx, "org.freedesktop.resolve1.Manager.SetLinkDefaultRoute", 0, m.ifidx, len(config.MatchDomains) == 0); call.Err != nil {
+	// A catch-all match domain makes us a default route like the
+	// other links that are, rather than one that overrides them as
+	// the "~." domain above does.
+	defaultRoute := len(config.MatchDomains) == 0 || catchAll
+	if catchAll {
+		m.logf("[v1] catch-all match domain requested; making %d a default DNS route", m.ifidx)
+	}
+	if call := m.resolved.CallWithContext(ctx, "org.freedesktop.resolve1.Manager.SetLinkDefaultRoute", 0, m.ifidx, defaultRoute); call.Err != nil {
 		return fmt.Errorf("setLinkDefaultRoute: %w", err)
 	}
 
@@ -214,6 +228,14 @@ func (m *resolvedManager) SupportsSplitDNS() bool {
 	return true
 }
 
+func (m *resolvedManager) Features() ManagerFeatures {
+	return FeatureSplitDNS | FeatureReverseZones | FeatureMultiInterface | FeatureCatchAllMatch
+}
+
+func (m *resolvedManager) CanRepresent(cfg OSConfig) bool {
+	return m.Features().CanRepresent(cfg)
+}
+
 func (m *resolvedManager) GetBaseConfig() (OSConfig, error) {
 	return OSConfig{}, ErrGetBaseConfigNotSupported
 }
@@ -0,0 +1,86 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package dns
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+	"inet.af/netaddr"
+	"tailscale.com/util/dnsname"
+)
+
+// fakeResolved records the resolved DBus calls made through it, all
+// of which succeed.
+type fakeResolved struct {
+	calls map[string][]interface{} // method suffix => args of the last call
+}
+
+func (f *fakeResolved) CallWithContext(ctx context.Context, method string, flags dbus.Flags, args ...interface{}) *dbus.Call {
+	f.calls[strings.TrimPrefix(method, "org.freedesktop.resolve1.Manager.")] = args
+	return &dbus.Call{}
+}
+
+func TestResolvedCatchAllMatchDomain(t *testing.T) {
+	tests := []struct {
+		name             string
+		match            []dnsname.FQDN
+		wantDomains      []resolvedLinkDomain
+		wantDefaultRoute bool
+	}{
+		{
+			name:  "split",
+			match: []dnsname.FQDN{"corp.example."},
+			wantDomains: []resolvedLinkDomain{
+				{Domain: "ts.net.", RoutingOnly: false},
+				{Domain: "corp.example.", RoutingOnly: true},
+			},
+			wantDefaultRoute: false,
+		},
+		{
+			name:  "catch-all",
+			match: []dnsname.FQDN{".", "corp.example."},
+			wantDomains: []resolvedLinkDomain{
+				{Domain: "ts.net.", RoutingOnly: false},
+				{Domain: "corp.example.", RoutingOnly: true},
+			},
+			wantDefaultRoute: true,
+		},
+		{
+			name:  "catch-all-only",
+			match: []dnsname.FQDN{"."},
+			wantDomains: []resolvedLinkDomain{
+				{Domain: "ts.net.", RoutingOnly: false},
+			},
+			wantDefaultRoute: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeResolved{calls: map[string][]interface{}{}}
+			m := &resolvedManager{logf: t.Logf, ifidx: 7, resolved: fake}
+			err := m.SetDNS(OSConfig{
+				Nameservers:   []netaddr.IP{netaddr.MustParseIP("100.100.100.100")},
+				SearchDomains: []dnsname.FQDN{"ts.net."},
+				MatchDomains:  tt.match,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fake.calls["SetLinkDomains"]; !reflect.DeepEqual(got, []interface{}{7, tt.wantDomains}) {
+				t.Errorf("SetLinkDomains args = %+v; want %+v", got, tt.wantDomains)
+			}
+			if got := fake.calls["SetLinkDefaultRoute"]; !reflect.DeepEqual(got, []interface{}{7, tt.wantDefaultRoute}) {
+				t.Errorf("SetLinkDefaultRoute args = %v; want [7 %v]", got, tt.wantDefaultRoute)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"strings"
+	"sync"
+
+	"tailscale.com/types/logger"
+)
+
+// shadowManager is an OSConfigurator that only logs the DNS
+// configuration it's given, leaving the system's existing DNS manager
+// in control. See NewShadowManager.
+type shadowManager struct {
+	logf logger.Logf
+	base OSConfigurator // consulted for GetBaseConfig only; may be nil
+
+	mu       sync.Mutex
+	lastHash [32]byte
+	logged   bool
+}
+
+// NewShadowManager returns an OSConfigurator for trialling Tailscale
+// DNS without enabling it: SetDNS logs the resolv.conf it would have
+// written, but changes nothing. If base is non-nil, its GetBaseConfig
+// supplies the system's own settings so the logged configuration
+// matches what base would be asked to apply; base's SetDNS and Close
+// are never called.
+func NewShadowManager(logf logger.Logf, base OSConfigurator) OSConfigurator {
+	return &shadowManager{
+		logf: logger.WithPrefix(logf, "dns: shadow: "),
+		base: base,
+	}
+}
+
+func (m *shadowManager) SetDNS(config OSConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Don't repeat ourselves on every reconfig.
+	h := config.Hash()
+	if m.logged && h == m.lastHash {
+		return nil
+	}
+	m.lastHash, m.logged = h, true
+
+	if config.IsZero() {
+		m.logf("would restore the original resolv.conf")
+		return nil
+	}
+	m.logf("would write resolv.conf:\n%s", strings.TrimSuffix(string(RenderResolvConf(config)), "\n"))
+	return nil
+}
+
+func (m *shadowManager) SupportsSplitDNS() bool { return false }
+
+func (m *shadowManager) Features() ManagerFeatures { return FeatureResolvConf }
+
+func (m *shadowManager) CanRepresent(cfg OSConfig) bool { return m.Features().CanRepresent(cfg) }
+
+func (m *shadowManager) GetBaseConfig() (OSConfig, error) {
+	if m.base == nil {
+		return OSConfig{}, ErrGetBaseConfigNotSupported
+	}
+	return m.base.GetBaseConfig()
+}
+
+func (m *shadowManager) Close() error { return nil }
@@ -0,0 +1,73 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/util/dnsname"
+)
+
+func TestShadowManager(t *testing.T) {
+	const orig = "nameserver 9.9.9.9\nsearch corp.example\n"
+	fs := newMemFS()
+	fs.files[resolvConf] = []byte(orig)
+	direct := newDirectManagerOnFS(t.Logf, fs)
+	direct.restartResolved = func() { t.Error("shadow manager restarted resolved") }
+
+	var logs []string
+	logf := func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	m := NewShadowManager(logf, direct)
+
+	base, err := m.GetBaseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []netaddr.IP{netaddr.MustParseIP("9.9.9.9")}; !reflect.DeepEqual(base.Nameservers, want) {
+		t.Errorf("base nameservers = %v; want %v", base.Nameservers, want)
+	}
+
+	cfg := OSConfig{
+		Nameservers:   []netaddr.IP{netaddr.MustParseIP("100.100.100.100")},
+		SearchDomains: []dnsname.FQDN{"ts.net."},
+	}
+	for i := 0; i < 2; i++ {
+		if err := m.SetDNS(cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(logs) != 1 {
+		t.Fatalf("got %d log lines for two identical SetDNS calls; want 1:\n%s", len(logs), strings.Join(logs, "\n"))
+	}
+	if !strings.Contains(logs[0], "nameserver 100.100.100.100\nsearch ts.net") {
+		t.Errorf("log doesn't contain the intended resolv.conf:\n%s", logs[0])
+	}
+
+	if err := m.SetDNS(OSConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 2 || !strings.Contains(logs[1], "restore") {
+		t.Errorf("logs after clearing config:\n%s", strings.Join(logs, "\n"))
+	}
+
+	// Nothing on disk changed: no backup, no rewrite.
+	want := map[string]string{resolvConf: orig}
+	got := map[string]string{}
+	for name, b := range fs.files {
+		got[name] = string(b)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("files after shadowing = %q; want %q", got, want)
+	}
+}
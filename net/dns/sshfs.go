@@ -0,0 +1,153 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// SSHRunner runs cmd on a remote host the way an SSH session's Run
+// method does: cmd is a command line for the remote user's shell,
+// with stdin (which may be nil), stdout and stderr connected to it.
+// If the command runs but fails, the returned error should have an
+// ExitStatus() int method reporting its exit status, as
+// golang.org/x/crypto/ssh's *ExitError does.
+type SSHRunner func(cmd string, stdin io.Reader, stdout, stderr io.Writer) error
+
+// Exit statuses the sshFS scripts use to report conditions that
+// WholeFileFS callers need to tell apart from plain failure.
+const (
+	sshStatusNotExist   = 100 // the file doesn't exist
+	sshStatusNotRegular = 101 // the file exists but isn't a regular file
+)
+
+// NewSSHFS returns a WholeFileFS that operates on a remote host's
+// files by running shell commands with run, so that a directManager
+// can manage that host's resolv.conf. This package opens no
+// connections itself; run is typically a thin wrapper around a new
+// session on an existing SSH client, logged in as root.
+func NewSSHFS(run SSHRunner) WholeFileFS {
+	return sshFS{run: run}
+}
+
+// sshFS is a WholeFileFS implemented by running commands over SSH.
+//
+// Unlike wslFS, whose commands are exec'd directly, SSH hands a
+// command line to the remote shell, so every name is single-quoted
+// with shellQuote. Names must be absolute: relative ones would
+// resolve against the remote user's home directory.
+type sshFS struct {
+	run SSHRunner
+}
+
+func (fs sshFS) Stat(name string) (isRegular bool, err error) {
+	if err := checkSSHPath(name); err != nil {
+		return false, err
+	}
+	q := shellQuote(name)
+	_, err = fs.runScript(fmt.Sprintf("[ -e %s ] || exit %d; [ -f %s ] || exit %d", q, sshStatusNotExist, q, sshStatusNotRegular), nil)
+	if sshExitStatus(err) == sshStatusNotRegular {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (fs sshFS) Rename(oldName, newName string) error {
+	if err := checkSSHPath(oldName, newName); err != nil {
+		return err
+	}
+	_, err := fs.runScript(fmt.Sprintf("[ -e %s ] || exit %d; mv -- %s %s",
+		shellQuote(oldName), sshStatusNotExist, shellQuote(oldName), shellQuote(newName)), nil)
+	return err
+}
+
+func (fs sshFS) Remove(name string) error {
+	if err := checkSSHPath(name); err != nil {
+		return err
+	}
+	q := shellQuote(name)
+	_, err := fs.runScript(fmt.Sprintf("[ -e %s ] || [ -L %s ] || exit %d; rm -- %s", q, q, sshStatusNotExist, q), nil)
+	return err
+}
+
+func (fs sshFS) ReadFile(name string, maxSize int64) ([]byte, error) {
+	if err := checkSSHPath(name); err != nil {
+		return nil, err
+	}
+	q := shellQuote(name)
+	read := "cat -- " + q
+	if maxSize > 0 {
+		read = fmt.Sprintf("head -c %s -- %s", strconv.FormatInt(maxSize+1, 10), q)
+	}
+	b, err := fs.runScript(fmt.Sprintf("[ -e %s ] || exit %d; %s", q, sshStatusNotExist, read), nil)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize > 0 && int64(len(b)) > maxSize {
+		return nil, ErrFileTooLarge
+	}
+	return b, nil
+}
+
+func (fs sshFS) WriteFile(name string, contents []byte, perm os.FileMode) error {
+	if err := checkSSHPath(name); err != nil {
+		return err
+	}
+	q := shellQuote(name)
+	_, err := fs.runScript(fmt.Sprintf("cat > %s && chmod %04o %s", q, perm.Perm(), q), bytes.NewReader(contents))
+	return err
+}
+
+// runScript runs script remotely and returns its stdout. An exit
+// status of sshStatusNotExist is mapped to os.ErrNotExist, and other
+// failures include the command's stderr.
+func (fs sshFS) runScript(script string, stdin io.Reader) ([]byte, error) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	err := fs.run(script, stdin, stdout, stderr)
+	if sshExitStatus(err) == sshStatusNotExist {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sshFS: running %q: %w: %q", script, err, stderr.Bytes())
+	}
+	return stdout.Bytes(), nil
+}
+
+// sshExitStatus returns the remote exit status that err reports, or
+// -1 if it reports none.
+func sshExitStatus(err error) int {
+	var es interface{ ExitStatus() int }
+	if errors.As(err, &es) {
+		return es.ExitStatus()
+	}
+	return -1
+}
+
+// shellQuote returns s quoted for a POSIX shell, as a single word
+// with no expansions.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// checkSSHPath returns an error if any of names isn't an absolute,
+// clean path that can be passed through a shell.
+func checkSSHPath(names ...string) error {
+	for _, name := range names {
+		if !path.IsAbs(name) || path.Clean(name) != name || strings.ContainsAny(name, "\x00\n") {
+			return fmt.Errorf("sshFS: %q is not a clean absolute path", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeExitError is an error with an exit status, like ssh.ExitError.
+type fakeExitError int
+
+func (e fakeExitError) Error() string   { return fmt.Sprintf("Process exited with status %d", int(e)) }
+func (e fakeExitError) ExitStatus() int { return int(e) }
+
+// fakeSSHRunner records the commands run by an sshFS and answers them
+// with canned output.
+type fakeSSHRunner struct {
+	cmds   []string
+	stdin  []string
+	stdout string // written to each command's stdout
+	stderr string // written to each command's stderr
+	status int    // if non-zero, each command fails with this exit status
+}
+
+func (f *fakeSSHRunner) run(cmd string, stdin io.Reader, stdout, stderr io.Writer) error {
+	f.cmds = append(f.cmds, cmd)
+	var in string
+	if stdin != nil {
+		b, err := ioutil.ReadAll(stdin)
+		if err != nil {
+			return err
+		}
+		in = string(b)
+	}
+	f.stdin = append(f.stdin, in)
+	io.WriteString(stdout, f.stdout)
+	io.WriteString(stderr, f.stderr)
+	if f.status != 0 {
+		return fakeExitError(f.status)
+	}
+	return nil
+}
+
+func TestSSHFSCommands(t *testing.T) {
+	tests := []struct {
+		name      string
+		do        func(fs WholeFileFS) error
+		wantCmd   string
+		wantStdin string
+	}{
+		{
+			name: "Stat",
+			do: func(fs WholeFileFS) error {
+				isRegular, err := fs.Stat("/etc/resolv.conf")
+				if err == nil && !isRegular {
+					t.Errorf("Stat = false; want true")
+				}
+				return err
+			},
+			wantCmd: "[ -e '/etc/resolv.conf' ] || exit 100; [ -f '/etc/resolv.conf' ] || exit 101",
+		},
+		{
+			name: "Rename",
+			do: func(fs WholeFileFS) error {
+				return fs.Rename("/etc/resolv.conf", "/etc/resolv.pre-tailscale-backup.conf")
+			},
+			wantCmd: "[ -e '/etc/resolv.conf' ] || exit 100; mv -- '/etc/resolv.conf' '/etc/resolv.pre-tailscale-backup.conf'",
+		},
+		{
+			name:    "Remove",
+			do:      func(fs WholeFileFS) error { return fs.Remove("/etc/resolv.conf") },
+			wantCmd: "[ -e '/etc/resolv.conf' ] || [ -L '/etc/resolv.conf' ] || exit 100; rm -- '/etc/resolv.conf'",
+		},
+		{
+			name: "ReadFile",
+			do: func(fs WholeFileFS) error {
+				_, err := fs.ReadFile("/etc/resolv.conf", 0)
+				return err
+			},
+			wantCmd: "[ -e '/etc/resolv.conf' ] || exit 100; cat -- '/etc/resolv.conf'",
+		},
+		{
+			name: "ReadFile-limited",
+			do: func(fs WholeFileFS) error {
+				_, err := fs.ReadFile("/etc/resolv.conf", 1024)
+				return err
+			},
+			wantCmd: "[ -e '/etc/resolv.conf' ] || exit 100; head -c 1025 -- '/etc/resolv.conf'",
+		},
+		{
+			name: "WriteFile",
+			do: func(fs WholeFileFS) error {
+				return fs.WriteFile("/etc/resolv.conf", []byte("nameserver 100.100.100.100\n"), 0644)
+			},
+			wantCmd:   "cat > '/etc/resolv.conf' && chmod 0644 '/etc/resolv.conf'",
+			wantStdin: "nameserver 100.100.100.100\n",
+		},
+		{
+			name:    "quoting",
+			do:      func(fs WholeFileFS) error { return fs.Remove("/tmp/it's $HOME") },
+			wantCmd: `[ -e '/tmp/it'\''s $HOME' ] || [ -L '/tmp/it'\''s $HOME' ] || exit 100; rm -- '/tmp/it'\''s $HOME'`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeSSHRunner{}
+			if err := tt.do(NewSSHFS(f.run)); err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{tt.wantCmd}; !reflect.DeepEqual(f.cmds, want) {
+				t.Errorf("commands = %q; want %q", f.cmds, want)
+			}
+			if want := []string{tt.wantStdin}; !reflect.DeepEqual(f.stdin, want) {
+				t.Errorf("stdin = %q; want %q", f.stdin, want)
+			}
+		})
+	}
+}
+
+func TestSSHFSErrors(t *testing.T) {
+	f := &fakeSSHRunner{status: 100}
+	fs := NewSSHFS(f.run)
+	if _, err := fs.Stat("/etc/resolv.conf"); !os.IsNotExist(err) {
+		t.Errorf("Stat of a missing file: %v; want not-exist", err)
+	}
+	if _, err := fs.ReadFile("/etc/resolv.conf", 0); !os.IsNotExist(err) {
+		t.Errorf("ReadFile of a missing file: %v; want not-exist", err)
+	}
+	if err := fs.Remove("/etc/resolv.conf"); !os.IsNotExist(err) {
+		t.Errorf("Remove of a missing file: %v; want not-exist", err)
+	}
+
+	f.status = 101
+	if isRegular, err := fs.Stat("/etc/resolv.conf"); err != nil || isRegular {
+		t.Errorf("Stat of a directory = %v, %v; want false, nil", isRegular, err)
+	}
+
+	f.status, f.stderr = 1, "mv: cannot move: Read-only file system"
+	err := fs.Rename("/etc/resolv.conf", "/etc/resolv.bak")
+	if err == nil || os.IsNotExist(err) || !strings.Contains(err.Error(), "Read-only file system") {
+		t.Errorf("failed Rename error = %v; want one with the remote stderr", err)
+	}
+	var exit fakeExitError
+	if !errors.As(err, &exit) || exit != 1 {
+		t.Errorf("failed Rename error %v doesn't wrap the exit status", err)
+	}
+
+	f.status, f.stderr, f.stdout = 0, "", strings.Repeat("x", 11)
+	if _, err := fs.ReadFile("/etc/resolv.conf", 10); !errors.Is(err, ErrFileTooLarge) {
+		t.Errorf("ReadFile over the limit: %v; want %v", err, ErrFileTooLarge)
+	}
+
+	for _, bad := range []string{"etc/resolv.conf", "/etc/../etc/resolv.conf", "/etc/resolv\n.conf"} {
+		before := len(f.cmds)
+		if _, err := fs.Stat(bad); err == nil {
+			t.Errorf("Stat(%q) succeeded; want error", bad)
+		}
+		if len(f.cmds) != before {
+			t.Errorf("Stat(%q) ran a command", bad)
+		}
+	}
+}
@@ -6,10 +6,13 @@ package dns
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"os/user"
+	"path"
+	"strconv"
 	"strings"
 	"syscall"
 	"unicode/utf16"
@@ -83,11 +86,13 @@ func decodeUTF16(b []byte) (string, error) {
 // It configures /etc/wsl.conf and /etc/resolv.conf.
 type wslManager struct {
 	logf logger.Logf
+	opts DirectOptions
 }
 
-func newWSLManager(logf logger.Logf) *wslManager {
+func newWSLManager(logf logger.Logf, opts DirectOptions) *wslManager {
 	m := &wslManager{
 		logf: logf,
+		opts: opts,
 	}
 	return m
 }
@@ -99,12 +104,12 @@ func (wm *wslManager) SetDNS(cfg OSConfig) error {
 	} else if len(distros) == 0 {
 		return nil
 	}
-	managers := make(map[string]directManager)
+	managers := make(map[string]*directManager)
 	for _, distro := range distros {
-		managers[distro] = newDirectManagerOnFS(wslFS{
+		managers[distro] = newDirectManagerWithOptions(wm.logf, wslFS{
 			user:   "root",
 			distro: distro,
-		})
+		}, wm.opts)
 	}
 
 	if !cfg.IsZero() {
@@ -141,9 +146,9 @@ generateResolvConf = false
 
 // setWSLConf attempts to disable generateResolvConf in each WSL2 linux.
 // If any are changed, it reports true.
-func (wm *wslManager) setWSLConf(managers map[string]directManager) (changed bool) {
+func (wm *wslManager) setWSLConf(managers map[string]*directManager) (changed bool) {
 	for distro, m := range managers {
-		b, err := m.fs.ReadFile(wslConf)
+		b, err := m.readFile(wslConf)
 		if err != nil && !os.IsNotExist(err) {
 			wm.logf("WSL(%q) wsl.conf: read: %v", distro, err)
 			continue
@@ -164,47 +169,101 @@ func (wm *wslManager) setWSLConf(managers map[string]directManager) (changed boo
 func (m *wslManager) SupportsSplitDNS() bool { return false }
 func (m *wslManager) Close() error           { return m.SetDNS(OSConfig{}) }
 
-// wslFS is a pinholeFS implemented on top of wsl.exe.
+// wslFS is a WholeFileFS implemented on top of wsl.exe.
 //
 // We access WSL2 file systems via wsl.exe instead of \\wsl$\ because
 // the netpath appears to operate as the standard user, not root.
+//
+// Commands are run with wsl.exe -e, which execs them directly rather
+// than through a shell, so names need no quoting. They do need to be
+// absolute Linux paths, as relative ones would resolve against
+// whatever directory wsl.exe happens to start in.
 type wslFS struct {
 	user   string
 	distro string
+
+	// run, if non-nil, is used instead of wslRun to run commands.
+	// Tests use it to inspect commands without running wsl.exe.
+	run func(*exec.Cmd) error
+	// eol, if non-empty, is the line ending for files written
+	// through fs, such as LineEndingCRLF for ones read on the
+	// Windows side.
+	eol LineEnding
+}
+
+// LineEnding implements lineEndingFS.
+func (fs wslFS) LineEnding() LineEnding {
+	if fs.eol == "" {
+		return LineEndingLF
+	}
+	return fs.eol
 }
 
 func (fs wslFS) Stat(name string) (isRegular bool, err error) {
-	err = wslRun(fs.cmd("test", "-f", name))
-	if ee, _ := err.(*exec.ExitError); ee != nil {
-		if ee.ExitCode() == 1 {
-			return false, os.ErrNotExist
-		}
+	if err := checkWSLPath(name); err != nil {
+		return false, err
+	}
+	err = fs.runCmd(fs.cmd("test", "-f", name))
+	if exitCode(err) == 1 {
+		return false, os.ErrNotExist
+	}
+	if err != nil {
 		return false, err
 	}
 	return true, nil
 }
 
 func (fs wslFS) Rename(oldName, newName string) error {
-	return wslRun(fs.cmd("mv", "--", oldName, newName))
+	if err := checkWSLPath(oldName, newName); err != nil {
+		return err
+	}
+	return fs.runCmd(fs.cmd("mv", "--", oldName, newName))
+}
+
+func (fs wslFS) Remove(name string) error {
+	if err := checkWSLPath(name); err != nil {
+		return err
+	}
+	return fs.runCmd(fs.cmd("rm", "--", name))
 }
-func (fs wslFS) Remove(name string) error { return wslRun(fs.cmd("rm", "--", name)) }
 
-func (fs wslFS) ReadFile(name string) ([]byte, error) {
-	b, err := wslCombinedOutput(fs.cmd("cat", "--", name))
-	if ee, _ := err.(*exec.ExitError); ee != nil && ee.ExitCode() == 1 {
+func (fs wslFS) ReadFile(name string, maxSize int64) ([]byte, error) {
+	if err := checkWSLPath(name); err != nil {
+		return nil, err
+	}
+	// Keep stderr out of the returned contents; it's only useful in
+	// errors.
+	cmd := fs.cmd("cat", "--", name)
+	if maxSize > 0 {
+		cmd = fs.cmd("head", "-c", strconv.FormatInt(maxSize+1, 10), "--", name)
+	}
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err := fs.runCmd(cmd)
+	if exitCode(err) == 1 {
 		return nil, os.ErrNotExist
 	}
-	return b, err
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q", err, stderr.Bytes())
+	}
+	if maxSize > 0 && int64(stdout.Len()) > maxSize {
+		return nil, ErrFileTooLarge
+	}
+	return stdout.Bytes(), nil
 }
 
 func (fs wslFS) WriteFile(name string, contents []byte, perm os.FileMode) error {
+	if err := checkWSLPath(name); err != nil {
+		return err
+	}
 	cmd := fs.cmd("tee", "--", name)
 	cmd.Stdin = bytes.NewReader(contents)
 	cmd.Stdout = nil
-	if err := wslRun(cmd); err != nil {
+	if err := fs.runCmd(cmd); err != nil {
 		return err
 	}
-	return wslRun(fs.cmd("chmod", "--", fmt.Sprintf("%04o", perm), name))
+	return fs.runCmd(fs.cmd("chmod", "--", fmt.Sprintf("%04o", perm), name))
 }
 
 func (fs wslFS) cmd(args ...string) *exec.Cmd {
@@ -213,6 +272,35 @@ func (fs wslFS) cmd(args ...string) *exec.Cmd {
 	return cmd
 }
 
+func (fs wslFS) runCmd(cmd *exec.Cmd) error {
+	if fs.run != nil {
+		return fs.run(cmd)
+	}
+	return wslRun(cmd)
+}
+
+// exitCode returns the exit code of the process that failed with err,
+// or -1 if err isn't (or doesn't wrap) an *exec.ExitError. wslRun
+// wraps its errors, so a plain type assertion isn't enough.
+func exitCode(err error) int {
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		return ee.ExitCode()
+	}
+	return -1
+}
+
+// checkWSLPath returns an error if any of names isn't an absolute,
+// clean Linux path.
+func checkWSLPath(names ...string) error {
+	for _, name := range names {
+		if !path.IsAbs(name) || path.Clean(name) != name || strings.ContainsAny(name, "\\\x00") {
+			return fmt.Errorf("wslFS: %q is not a clean absolute Linux path", name)
+		}
+	}
+	return nil
+}
+
 func wslCommand(args ...string) *exec.Cmd {
 	cmd := exec.Command("wsl.exe", args...)
 	return cmd
@@ -0,0 +1,140 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeWSLExec records the commands run by a wslFS.
+type fakeWSLExec struct {
+	args   [][]string
+	stdin  []string
+	stdout string // written to each command's Stdout, if set
+}
+
+func (f *fakeWSLExec) run(cmd *exec.Cmd) error {
+	f.args = append(f.args, cmd.Args)
+	var stdin string
+	if cmd.Stdin != nil {
+		b, err := ioutil.ReadAll(cmd.Stdin)
+		if err != nil {
+			return err
+		}
+		stdin = string(b)
+	}
+	f.stdin = append(f.stdin, stdin)
+	if cmd.Stdout != nil {
+		io.WriteString(cmd.Stdout, f.stdout)
+	}
+	return nil
+}
+
+func TestWSLFSCommands(t *testing.T) {
+	prefix := []string{"wsl.exe", "-u", "root", "-d", "Ubuntu 20.04", "-e"}
+	cmd := func(args ...string) []string {
+		return append(append([]string(nil), prefix...), args...)
+	}
+
+	tests := []struct {
+		name      string
+		do        func(fs wslFS) error
+		wantArgs  [][]string
+		wantStdin []string
+	}{
+		{
+			name: "Stat",
+			do: func(fs wslFS) error {
+				isRegular, err := fs.Stat("/etc/resolv.conf")
+				if err == nil && !isRegular {
+					t.Errorf("Stat = false; want true")
+				}
+				return err
+			},
+			wantArgs:  [][]string{cmd("test", "-f", "/etc/resolv.conf")},
+			wantStdin: []string{""},
+		},
+		{
+			name:      "Rename",
+			do:        func(fs wslFS) error { return fs.Rename("/etc/resolv.conf", "/etc/-odd name.conf") },
+			wantArgs:  [][]string{cmd("mv", "--", "/etc/resolv.conf", "/etc/-odd name.conf")},
+			wantStdin: []string{""},
+		},
+		{
+			name:      "Remove",
+			do:        func(fs wslFS) error { return fs.Remove("/etc/resolv.conf") },
+			wantArgs:  [][]string{cmd("rm", "--", "/etc/resolv.conf")},
+			wantStdin: []string{""},
+		},
+		{
+			name: "ReadFile",
+			do: func(fs wslFS) error {
+				b, err := fs.ReadFile("/etc/resolv.conf", 0)
+				if err == nil && string(b) != "nameserver 1.2.3.4\n" {
+					t.Errorf("ReadFile = %q; want fake output", b)
+				}
+				return err
+			},
+			wantArgs:  [][]string{cmd("cat", "--", "/etc/resolv.conf")},
+			wantStdin: []string{""},
+		},
+		{
+			name: "ReadFile-limited",
+			do: func(fs wslFS) error {
+				if _, err := fs.ReadFile("/etc/resolv.conf", 10); err != ErrFileTooLarge {
+					t.Errorf("ReadFile over limit = %v; want %v", err, ErrFileTooLarge)
+				}
+				return nil
+			},
+			wantArgs:  [][]string{cmd("head", "-c", "11", "--", "/etc/resolv.conf")},
+			wantStdin: []string{""},
+		},
+		{
+			name: "WriteFile",
+			do:   func(fs wslFS) error { return fs.WriteFile("/etc/resolv.conf", []byte("nameserver 1.2.3.4\n"), 0644) },
+			wantArgs: [][]string{
+				cmd("tee", "--", "/etc/resolv.conf"),
+				cmd("chmod", "--", "0644", "/etc/resolv.conf"),
+			},
+			wantStdin: []string{"nameserver 1.2.3.4\n", ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeWSLExec{stdout: "nameserver 1.2.3.4\n"}
+			fs := wslFS{user: "root", distro: "Ubuntu 20.04", run: fake.run}
+			if err := tt.do(fs); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(fake.args, tt.wantArgs) {
+				t.Errorf("commands = %q; want %q", fake.args, tt.wantArgs)
+			}
+			if !reflect.DeepEqual(fake.stdin, tt.wantStdin) {
+				t.Errorf("stdin = %q; want %q", fake.stdin, tt.wantStdin)
+			}
+		})
+	}
+}
+
+func TestWSLFSRejectsNonLinuxPaths(t *testing.T) {
+	fake := &fakeWSLExec{}
+	fs := wslFS{user: "root", distro: "Ubuntu", run: fake.run}
+	for _, name := range []string{"resolv.conf", `C:\etc\resolv.conf`, "/etc/../etc/resolv.conf", "/etc/resolv.conf/"} {
+		if _, err := fs.Stat(name); err == nil || !strings.Contains(err.Error(), "not a clean absolute Linux path") {
+			t.Errorf("Stat(%q) = %v; want path error", name, err)
+		}
+		if err := fs.Rename("/etc/resolv.conf", name); err == nil {
+			t.Errorf("Rename to %q succeeded; want path error", name)
+		}
+	}
+	if len(fake.args) != 0 {
+		t.Errorf("ran commands for invalid paths: %q", fake.args)
+	}
+}
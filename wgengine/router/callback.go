@@ -49,6 +49,19 @@ func (r *CallbackRouter) SupportsSplitDNS() bool {
 	return r.SplitDNS
 }
 
+// Features implements dns.OSConfigurator.
+func (r *CallbackRouter) Features() dns.ManagerFeatures {
+	if r.SplitDNS {
+		return dns.FeatureSplitDNS
+	}
+	return 0
+}
+
+// CanRepresent implements dns.OSConfigurator.
+func (r *CallbackRouter) CanRepresent(cfg dns.OSConfig) bool {
+	return r.Features().CanRepresent(cfg)
+}
+
 func (r *CallbackRouter) GetBaseConfig() (dns.OSConfig, error) {
 	return dns.OSConfig{}, dns.ErrGetBaseConfigNotSupported
 }
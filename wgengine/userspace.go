@@ -8,12 +8,14 @@ import (
 	"bufio"
 	"bytes"
 	crand "crypto/rand"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"reflect"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -85,10 +87,13 @@ type userspaceEngine struct {
 	reqCh             chan struct{}
 	waitCh            chan struct{} // chan is closed when first Close call completes; contrast with closing bool
 	timeNow           func() mono.Time
+	peerIdleThreshold time.Duration // idle time after which trimmable peers are removed; normally lazyPeerIdleThreshold
 	tundev            *tstun.Wrapper
 	wgdev             *device.Device
 	router            router.Router
-	confListenPort    uint16 // original conf.ListenPort
+	confListenPort    uint16          // original conf.ListenPort
+	strictDebug       bool            // reject Reconfig debug flags we don't implement
+	interfaceUp       <-chan struct{} // if non-nil, closed once the tunnel interface is up; see Config.InterfaceUp
 	dns               *dns.Manager
 	magicConn         *magicsock.Conn
 	linkMon           *monitor.Mon
@@ -112,8 +117,11 @@ type userspaceEngine struct {
 	lastEngineSigFull   deephash.Sum // of full wireguard config
 	lastEngineSigTrim   deephash.Sum // of trimmed wireguard config
 	lastDNSConfig       *dns.Config
+	pendingDNS          *dns.Config // DNS config waiting for interfaceUp, or nil
+	waitingForUp        bool        // whether applyDNSWhenUp is running
 	recvActivityAt      map[tailcfg.DiscoKey]mono.Time
 	trimmedDisco        map[tailcfg.DiscoKey]bool // set of disco keys of peers currently excluded from wireguard config
+	noTrimDisco         map[tailcfg.DiscoKey]bool // disco keys of peers pinned by SetPeerNoTrim; never trimmed
 	sentActivityAt      map[netaddr.IP]*mono.Time // value is accessed atomically
 	destIPActivityFuncs map[netaddr.IP]func()
 	statusBufioReader   *bufio.Reader // reusable for UAPI
@@ -123,6 +131,7 @@ type userspaceEngine struct {
 	netMap              *netmap.NetworkMap // or nil
 	closing             bool               // Close was called (even if we're still closing)
 	statusCallback      StatusCallback
+	reconfigCallback    ReconfigCallback
 	peerSequence        []wgkey.Key
 	endpoints           []tailcfg.Endpoint
 	pendOpen            map[flowtrack.Tuple]*pendingOpenFlow // see pendopen.go
@@ -173,14 +182,71 @@ type Config struct {
 	// reply to ICMP pings, without involving the OS.
 	// Used in "fake" mode for development.
 	RespondToPing bool
+
+	// StrictDebug makes Reconfig return an error if its
+	// *tailcfg.Debug argument sets any field that the engine
+	// doesn't implement, rather than silently ignoring it.
+	// Callers should pass only the fields meant for the engine.
+	StrictDebug bool
+
+	// InterfaceUp, if non-nil, is closed once the Tun interface is
+	// up. Until then, Reconfig holds back DNS configuration, applying
+	// the latest one when InterfaceUp is closed, so that the OS isn't
+	// pointed at resolvers it can't reach yet. If nil, DNS
+	// configuration is applied immediately.
+	InterfaceUp <-chan struct{}
 }
 
 func NewFakeUserspaceEngine(logf logger.Logf, listenPort uint16) (Engine, error) {
+	return NewFakeUserspaceEngineWithOpts(logf, FakeOpts{ListenPort: listenPort})
+}
+
+// FakeOpts are the options for NewFakeUserspaceEngineWithOpts.
+type FakeOpts struct {
+	// ListenPort is the port on which the engine will listen.
+	// If zero, a port is automatically selected.
+	ListenPort uint16
+
+	// DNS is the OSConfigurator to use.
+	// If nil, a fake OSConfigurator that does nothing is used.
+	DNS dns.OSConfigurator
+
+	// TimeNow, if non-nil, replaces the engine's monotonic clock.
+	TimeNow func() mono.Time
+
+	// PeerIdleThreshold, if non-zero, overrides how long a
+	// trimmable peer may be idle before it's removed from the
+	// wireguard config.
+	PeerIdleThreshold time.Duration
+
+	// InterfaceUp is passed to the engine as Config.InterfaceUp.
+	InterfaceUp <-chan struct{}
+}
+
+// NewFakeUserspaceEngineWithOpts is like NewFakeUserspaceEngine, but
+// allows tests to inject a DNS configurator, a clock, and a peer idle
+// threshold.
+func NewFakeUserspaceEngineWithOpts(logf logger.Logf, opts FakeOpts) (Engine, error) {
 	logf("Starting userspace wireguard engine (with fake TUN device)")
-	return NewUserspaceEngine(logf, Config{
-		ListenPort:    listenPort,
+	e, err := NewUserspaceEngine(logf, Config{
+		ListenPort:    opts.ListenPort,
 		RespondToPing: true,
+		DNS:           opts.DNS,
+		InterfaceUp:   opts.InterfaceUp,
 	})
+	if err != nil {
+		return nil, err
+	}
+	ue := e.(*userspaceEngine)
+	ue.wgLock.Lock()
+	defer ue.wgLock.Unlock()
+	if opts.TimeNow != nil {
+		ue.timeNow = opts.TimeNow
+	}
+	if opts.PeerIdleThreshold != 0 {
+		ue.peerIdleThreshold = opts.PeerIdleThreshold
+	}
+	return e, nil
 }
 
 // NetstackRouterType is a gross cross-package init-time registration
@@ -248,13 +314,16 @@ func NewUserspaceEngine(logf logger.Logf, conf Config) (_ Engine, reterr error)
 	closePool.add(tsTUNDev)
 
 	e := &userspaceEngine{
-		timeNow:        mono.Now,
-		logf:           logf,
-		reqCh:          make(chan struct{}, 1),
-		waitCh:         make(chan struct{}),
-		tundev:         tsTUNDev,
-		router:         conf.Router,
-		confListenPort: conf.ListenPort,
+		timeNow:           mono.Now,
+		peerIdleThreshold: lazyPeerIdleThreshold,
+		logf:              logf,
+		reqCh:             make(chan struct{}, 1),
+		waitCh:            make(chan struct{}),
+		tundev:            tsTUNDev,
+		router:            conf.Router,
+		confListenPort:    conf.ListenPort,
+		strictDebug:       conf.StrictDebug,
+		interfaceUp:       conf.InterfaceUp,
 	}
 	e.isLocalAddr.Store(tsaddr.NewContainsIPFunc(nil))
 	e.isDNSIPOverTailscale.Store(tsaddr.NewContainsIPFunc(nil))
@@ -572,6 +641,160 @@ func (e *userspaceEngine) noteReceiveActivity(dk tailcfg.DiscoKey) {
 	}
 }
 
+// LastRecvActivity reports when a packet was last received from the
+// peer with disco key dk. The boolean result is false if dk isn't a
+// peer whose activity is tracked (see isTrimmablePeer). A tracked peer
+// that hasn't sent anything yet returns a zero time and true.
+func (e *userspaceEngine) LastRecvActivity(dk tailcfg.DiscoKey) (mono.Time, bool) {
+	e.wgLock.Lock()
+	defer e.wgLock.Unlock()
+	t, ok := e.recvActivityAt[dk]
+	return t, ok
+}
+
+// ConfiguredDiscoKeys returns the disco keys of the trimmable peers
+// (see isTrimmablePeer) in the current wireguard config, whether or
+// not they're currently trimmed, sorted.
+func (e *userspaceEngine) ConfiguredDiscoKeys() []tailcfg.DiscoKey {
+	e.wgLock.Lock()
+	defer e.wgLock.Unlock()
+	ret := make([]tailcfg.DiscoKey, 0, len(e.recvActivityAt))
+	for dk := range e.recvActivityAt {
+		ret = append(ret, dk)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return bytes.Compare(ret[i][:], ret[j][:]) < 0
+	})
+	return ret
+}
+
+// activityState is the serialized form of the engine's per-peer
+// receive activity, as produced by ExportActivityState.
+type activityState struct {
+	// SavedAt is the wall time the state was exported. Import uses
+	// it to age the entries by however long the engine was down.
+	SavedAt time.Time
+	// Peers is sorted by disco key so the encoding is stable.
+	Peers []peerActivity
+}
+
+type peerActivity struct {
+	DiscoKey tailcfg.DiscoKey
+	Idle     time.Duration `json:",omitempty"` // time since last receive; zero if never
+	Never    bool          `json:",omitempty"` // tracked, but nothing received yet
+	Trimmed  bool          `json:",omitempty"`
+}
+
+// ExportActivityState returns the engine's recvActivityAt and
+// trimmedDisco state in a form suitable for persisting across
+// restarts with ImportActivityState.
+//
+// Monotonic times don't mean anything in another process, so each
+// receive time is recorded as an idle duration relative to the time
+// of export.
+func (e *userspaceEngine) ExportActivityState() ([]byte, error) {
+	e.wgLock.Lock()
+	defer e.wgLock.Unlock()
+
+	now := e.timeNow()
+	st := activityState{SavedAt: time.Now()}
+	seen := make(map[tailcfg.DiscoKey]bool, len(e.recvActivityAt))
+	add := func(dk tailcfg.DiscoKey) {
+		if seen[dk] {
+			return
+		}
+		seen[dk] = true
+		pa := peerActivity{DiscoKey: dk, Trimmed: e.trimmedDisco[dk]}
+		if at := e.recvActivityAt[dk]; at.IsZero() {
+			pa.Never = true
+		} else {
+			pa.Idle = now.Sub(at)
+		}
+		st.Peers = append(st.Peers, pa)
+	}
+	for dk := range e.recvActivityAt {
+		add(dk)
+	}
+	for dk := range e.trimmedDisco {
+		add(dk)
+	}
+	sort.Slice(st.Peers, func(i, j int) bool {
+		return bytes.Compare(st.Peers[i].DiscoKey[:], st.Peers[j].DiscoKey[:]) < 0
+	})
+	return json.Marshal(st)
+}
+
+// ImportActivityState replaces the engine's recvActivityAt and
+// trimmedDisco state with that from a previous ExportActivityState.
+// Receive times are moved back by the wall time elapsed since the
+// export.
+//
+// It's meant to be called before the first Reconfig; entries for
+// peers that aren't in the next config are dropped by that Reconfig.
+func (e *userspaceEngine) ImportActivityState(b []byte) error {
+	var st activityState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return fmt.Errorf("wgengine: parsing activity state: %w", err)
+	}
+	var downtime time.Duration
+	if !st.SavedAt.IsZero() {
+		if d := time.Since(st.SavedAt); d > 0 {
+			downtime = d
+		}
+	}
+
+	e.wgLock.Lock()
+	defer e.wgLock.Unlock()
+
+	now := e.timeNow()
+	recv := make(map[tailcfg.DiscoKey]mono.Time, len(st.Peers))
+	trimmed := map[tailcfg.DiscoKey]bool{}
+	for _, pa := range st.Peers {
+		if pa.Never {
+			recv[pa.DiscoKey] = 0
+		} else {
+			recv[pa.DiscoKey] = now.Add(-(pa.Idle + downtime))
+		}
+		if pa.Trimmed {
+			trimmed[pa.DiscoKey] = true
+		}
+	}
+	e.recvActivityAt = recv
+	e.trimmedDisco = trimmed
+	return nil
+}
+
+// SetPeerNoTrim sets whether the peer with disco key dk is pinned in
+// the wireguard config, never to be trimmed for inactivity, which can
+// help when debugging a flaky peer. Pins outlive the peer's presence
+// in the config.
+//
+// If the peer is configured, the change is applied to wireguard right
+// away, and an error doing so is returned. The pin itself is recorded
+// either way.
+func (e *userspaceEngine) SetPeerNoTrim(dk tailcfg.DiscoKey, noTrim bool) error {
+	e.wgLock.Lock()
+	defer e.wgLock.Unlock()
+	if e.noTrimDisco[dk] == noTrim {
+		return nil
+	}
+	if noTrim {
+		if e.noTrimDisco == nil {
+			e.noTrimDisco = map[tailcfg.DiscoKey]bool{}
+		}
+		e.noTrimDisco[dk] = true
+	} else {
+		delete(e.noTrimDisco, dk)
+	}
+	if _, ok := e.recvActivityAt[dk]; ok {
+		// A configured, trimmable peer. Apply the change now.
+		if err := e.maybeReconfigWireguardLocked(nil); err != nil {
+			return fmt.Errorf("wgengine: applying no-trim for %v: %w", dk.ShortString(), err)
+		}
+	}
+	return nil
+}
+
 // isActiveSince reports whether the peer identified by (dk, ip) has
 // had a packet sent to or received from it since t.
 //
@@ -612,7 +835,7 @@ func (e *userspaceEngine) maybeReconfigWireguardLocked(discoChanged map[key.Publ
 	// the past 5 minutes. That's more than WireGuard's key
 	// rotation time anyway so it's no harm if we remove it
 	// later if it's been inactive.
-	activeCutoff := e.timeNow().Add(-lazyPeerIdleThreshold)
+	activeCutoff := e.timeNow().Add(-e.peerIdleThreshold)
 
 	// Not all peers can be trimmed from the network map (see
 	// isTrimmablePeer).  For those are are trimmable, keep track
@@ -636,7 +859,7 @@ func (e *userspaceEngine) maybeReconfigWireguardLocked(discoChanged map[key.Publ
 		}
 		dk := p.Endpoints.DiscoKey
 		trackDisco = append(trackDisco, dk)
-		recentlyActive := false
+		recentlyActive := e.noTrimDisco[dk]
 		for _, cidr := range p.AllowedIPs {
 			trackIPs = append(trackIPs, cidr.IP())
 			recentlyActive = recentlyActive || e.isActiveSince(dk, cidr.IP(), activeCutoff)
@@ -754,19 +977,140 @@ func (e *userspaceEngine) updateActivityMapsLocked(trackDisco []tailcfg.DiscoKey
 	e.tundev.SetDestIPActivityFuncs(e.destIPActivityFuncs)
 }
 
+// pruneActivityLocked removes recvActivityAt and trimmedDisco entries
+// for disco keys that are no longer in e.lastCfgFull, so peers that
+// leave the network map don't accumulate across reconfigs.
+//
+// maybeReconfigWireguardLocked rebuilds both maps too, but only when
+// the trimmed config changes; this makes the eviction unconditional.
+//
+// e.wgLock must be held.
+func (e *userspaceEngine) pruneActivityLocked() {
+	present := make(map[tailcfg.DiscoKey]bool, len(e.lastCfgFull.Peers))
+	for i := range e.lastCfgFull.Peers {
+		if dk := e.lastCfgFull.Peers[i].Endpoints.DiscoKey; !dk.IsZero() {
+			present[dk] = true
+		}
+	}
+	for dk := range e.recvActivityAt {
+		if !present[dk] {
+			delete(e.recvActivityAt, dk)
+		}
+	}
+	for dk := range e.trimmedDisco {
+		if !present[dk] {
+			delete(e.trimmedDisco, dk)
+		}
+	}
+}
+
+// engineDebugFields is the set of tailcfg.Debug fields that Reconfig
+// acts on. Fields handled by other layers (controlclient, ipnlocal)
+// should be cleared by the caller before Reconfig, or strict mode
+// rejects them. See checkDebugFlags.
+var engineDebugFields = map[string]bool{
+	"RandomizeClientPort": true,
+}
+
+// checkDebugFlags returns an error naming any fields set in debug
+// that aren't in known.
+func checkDebugFlags(debug *tailcfg.Debug, known map[string]bool) error {
+	if debug == nil {
+		return nil
+	}
+	var unknown []string
+	v := reflect.ValueOf(debug).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		if !known[name] && !v.Field(i).IsZero() {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("wgengine: unsupported debug flags: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
 func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config, dnsCfg *dns.Config, debug *tailcfg.Debug) error {
+	var sum ReconfigSummary
+	if err := e.reconfig(cfg, routerCfg, dnsCfg, debug, &sum); err != nil {
+		return err
+	}
+	// Called without wgLock held, so the callback may call back
+	// into the engine.
+	if cb := e.getReconfigCallback(); cb != nil {
+		cb(sum)
+	}
+	return nil
+}
+
+// deferDNSLocked reports whether cfg must wait for e.interfaceUp
+// before being applied, and if so, arranges for it to be applied
+// then. e.wgLock must be held.
+func (e *userspaceEngine) deferDNSLocked(cfg *dns.Config) bool {
+	if e.interfaceUp == nil {
+		return false
+	}
+	select {
+	case <-e.interfaceUp:
+		return false
+	default:
+	}
+	e.pendingDNS = cfg
+	if !e.waitingForUp {
+		e.waitingForUp = true
+		go e.applyDNSWhenUp()
+	}
+	return true
+}
+
+// applyDNSWhenUp waits for e.interfaceUp and then applies the DNS
+// config deferred by deferDNSLocked.
+func (e *userspaceEngine) applyDNSWhenUp() {
+	select {
+	case <-e.interfaceUp:
+	case <-e.waitCh:
+		return
+	}
+	e.wgLock.Lock()
+	defer e.wgLock.Unlock()
+	e.mu.Lock()
+	closing := e.closing
+	e.mu.Unlock()
+	cfg := e.pendingDNS
+	e.pendingDNS = nil
+	if closing || cfg == nil {
+		return
+	}
+	e.logf("wgengine: interface up; configuring DNS")
+	err := e.dns.Set(*cfg)
+	health.SetDNSHealth(err)
+	if err != nil {
+		e.logf("wgengine: configuring DNS: %v", err)
+	}
+}
+
+// reconfig implements Reconfig. On success, it fills in *sum.
+func (e *userspaceEngine) reconfig(cfg *wgcfg.Config, routerCfg *router.Config, dnsCfg *dns.Config, debug *tailcfg.Debug, sum *ReconfigSummary) error {
 	if routerCfg == nil {
 		panic("routerCfg must not be nil")
 	}
-	if dnsCfg == nil {
-		panic("dnsCfg must not be nil")
+	if e.strictDebug {
+		if err := checkDebugFlags(debug, engineDebugFields); err != nil {
+			return err
+		}
 	}
 
 	e.isLocalAddr.Store(tsaddr.NewContainsIPFunc(routerCfg.LocalAddrs))
 
 	e.wgLock.Lock()
 	defer e.wgLock.Unlock()
-	e.lastDNSConfig = dnsCfg
+	// A nil dnsCfg means to leave DNS configuration as it is. From
+	// here on, e.lastDNSConfig is the effective DNS config.
+	if dnsCfg != nil {
+		e.lastDNSConfig = dnsCfg
+	}
 
 	peerSet := make(map[key.Public]struct{}, len(cfg.Peers))
 	e.mu.Lock()
@@ -781,9 +1125,10 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 	if debug != nil && debug.RandomizeClientPort {
 		listenPort = 0
 	}
+	oldPort := e.magicConn.LocalPort()
 
 	engineChanged := deephash.Update(&e.lastEngineSigFull, cfg)
-	routerChanged := deephash.Update(&e.lastRouterSig, routerCfg, dnsCfg)
+	routerChanged := deephash.Update(&e.lastRouterSig, routerCfg, e.lastDNSConfig)
 	if !engineChanged && !routerChanged && listenPort == e.magicConn.LocalPort() {
 		return ErrNoChanges
 	}
@@ -793,7 +1138,7 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 	// instead have ipnlocal populate a map of DNS IP => linkName and
 	// put that in the *dns.Config instead, and plumb it down to the
 	// dns.Manager. Maybe also with isLocalAddr above.
-	e.isDNSIPOverTailscale.Store(tsaddr.NewContainsIPFunc(dnsIPsOverTailscale(dnsCfg, routerCfg)))
+	e.isDNSIPOverTailscale.Store(tsaddr.NewContainsIPFunc(dnsIPsOverTailscale(e.lastDNSConfig, routerCfg)))
 
 	// See if any peers have changed disco keys, which means they've restarted.
 	// If so, we need to update the wireguard-go/device.Device in two phases:
@@ -821,6 +1166,10 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 	}
 
 	e.lastCfgFull = *cfg.Clone()
+	e.pruneActivityLocked()
+
+	var wgTime, routerTime, dnsTime time.Duration
+	stageStart := e.timeNow()
 
 	// Tell magicsock about the new (or initial) private key
 	// (which is needed by DERP) before wgdev gets it, as wgdev
@@ -833,31 +1182,63 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 	e.magicConn.SetPreferredPort(listenPort)
 
 	if err := e.maybeReconfigWireguardLocked(discoChanged); err != nil {
-		return err
+		return &ReconfigError{Stage: "wireguard", Err: err}
 	}
+	wgTime = e.timeNow().Sub(stageStart)
 
 	if routerChanged {
 		e.logf("wgengine: Reconfig: configuring router")
+		stageStart = e.timeNow()
 		err := e.router.Set(routerCfg)
+		routerTime = e.timeNow().Sub(stageStart)
 		health.SetRouterHealth(err)
 		if err != nil {
-			return err
+			return &ReconfigError{Stage: "router", Err: err}
 		}
 		// Keep DNS configuration after router configuration, as some
 		// DNS managers refuse to apply settings if the device has no
 		// assigned address.
-		e.logf("wgengine: Reconfig: configuring DNS")
-		err = e.dns.Set(*dnsCfg)
-		health.SetDNSHealth(err)
-		if err != nil {
-			return err
+		if dnsCfg != nil && e.deferDNSLocked(dnsCfg) {
+			e.logf("wgengine: Reconfig: deferring DNS until the interface is up")
+		} else if dnsCfg != nil {
+			e.logf("wgengine: Reconfig: configuring DNS")
+			stageStart = e.timeNow()
+			err = e.dns.Set(*dnsCfg)
+			dnsTime = e.timeNow().Sub(stageStart)
+			health.SetDNSHealth(err)
+			if err != nil {
+				return &ReconfigError{Stage: "dns", Err: err}
+			}
 		}
 	}
 
+	*sum = ReconfigSummary{
+		Peers:         len(cfg.Peers),
+		ListenPort:    e.magicConn.LocalPort(),
+		DNSServers:    numDNSServers(e.lastDNSConfig),
+		WireguardTime: wgTime,
+		RouterTime:    routerTime,
+		DNSTime:       dnsTime,
+	}
+	sum.PortChanged = sum.ListenPort != oldPort
+
 	e.logf("[v1] wgengine: Reconfig done")
 	return nil
 }
 
+// numDNSServers returns the number of resolvers in cfg, counting both
+// default resolvers and per-route ones. cfg may be nil.
+func numDNSServers(cfg *dns.Config) int {
+	if cfg == nil {
+		return 0
+	}
+	n := len(cfg.DefaultResolvers)
+	for _, resolvers := range cfg.Routes {
+		n += len(resolvers)
+	}
+	return n
+}
+
 func (e *userspaceEngine) GetFilter() *filter.Filter {
 	return e.tundev.GetFilter()
 }
@@ -878,6 +1259,18 @@ func (e *userspaceEngine) getStatusCallback() StatusCallback {
 	return e.statusCallback
 }
 
+func (e *userspaceEngine) OnReconfig(cb ReconfigCallback) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.reconfigCallback = cb
+}
+
+func (e *userspaceEngine) getReconfigCallback() ReconfigCallback {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.reconfigCallback
+}
+
 var singleNewline = []byte{'\n'}
 
 var ErrEngineClosing = errors.New("engine closing; no status")
@@ -1420,8 +1813,12 @@ func ipInPrefixes(ip netaddr.IP, pp []netaddr.IPPrefix) bool {
 
 // dnsIPsOverTailscale returns the IPPrefixes of DNS resolver IPs that are
 // routed over Tailscale. The returned value does not contain duplicates is
-// not necessarily sorted.
+// not necessarily sorted. dnsCfg may be nil, in which case there are no
+// resolvers to consider.
 func dnsIPsOverTailscale(dnsCfg *dns.Config, routerCfg *router.Config) (ret []netaddr.IPPrefix) {
+	if dnsCfg == nil {
+		return nil
+	}
 	m := map[netaddr.IP]bool{}
 
 	add := func(resolvers []netaddr.IPPort) {
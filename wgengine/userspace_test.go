@@ -6,9 +6,13 @@ package wgengine
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"go4.org/mem"
 	"inet.af/netaddr"
@@ -17,6 +21,7 @@ import (
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstime/mono"
 	"tailscale.com/types/key"
+	"tailscale.com/types/wgkey"
 	"tailscale.com/wgengine/router"
 	"tailscale.com/wgengine/wgcfg"
 )
@@ -84,6 +89,35 @@ func TestNoteReceiveActivity(t *testing.T) {
 	}
 }
 
+func TestLastRecvActivity(t *testing.T) {
+	now := mono.Time(123456)
+	e := &userspaceEngine{
+		timeNow:               func() mono.Time { return now },
+		recvActivityAt:        map[tailcfg.DiscoKey]mono.Time{},
+		logf:                  t.Logf,
+		tundev:                new(tstun.Wrapper),
+		testMaybeReconfigHook: func() {},
+		trimmedDisco:          map[tailcfg.DiscoKey]bool{},
+	}
+	dk := tailcfg.DiscoKey(key.NewPrivate().Public())
+
+	if _, ok := e.LastRecvActivity(dk); ok {
+		t.Fatalf("LastRecvActivity reported untracked key as tracked")
+	}
+
+	e.recvActivityAt[dk] = 0
+	e.trimmedDisco[dk] = true
+	e.noteReceiveActivity(dk)
+
+	got, ok := e.LastRecvActivity(dk)
+	if !ok {
+		t.Fatalf("LastRecvActivity reported tracked key as untracked")
+	}
+	if got != now {
+		t.Errorf("LastRecvActivity = %v; want %v", got, now)
+	}
+}
+
 func TestUserspaceEngineReconfig(t *testing.T) {
 	e, err := NewFakeUserspaceEngine(t.Logf, 0)
 	if err != nil {
@@ -130,6 +164,414 @@ func TestUserspaceEngineReconfig(t *testing.T) {
 	}
 }
 
+func TestUserspaceEngineReconfigPrunesActivity(t *testing.T) {
+	e, err := NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	ue := e.(*userspaceEngine)
+
+	dkA := dkFromHex("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	dkB := dkFromHex("bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb")
+	peerCfg := func(dk tailcfg.DiscoKey, ip netaddr.IP) *wgcfg.Config {
+		return &wgcfg.Config{
+			Peers: []wgcfg.Peer{
+				{
+					AllowedIPs: []netaddr.IPPrefix{netaddr.IPPrefixFrom(ip, 32)},
+					Endpoints:  wgcfg.Endpoints{DiscoKey: dk},
+				},
+			},
+		}
+	}
+	routerCfg := &router.Config{}
+
+	if err := e.Reconfig(peerCfg(dkA, netaddr.IPv4(100, 100, 99, 1)), routerCfg, &dns.Config{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ue.recvActivityAt[dkA]; !ok {
+		t.Fatalf("peer A not tracked in recvActivityAt after first Reconfig")
+	}
+
+	if err := e.Reconfig(peerCfg(dkB, netaddr.IPv4(100, 100, 99, 2)), routerCfg, &dns.Config{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ue.recvActivityAt[dkA]; ok {
+		t.Errorf("peer A still in recvActivityAt after being removed from config")
+	}
+	if ue.trimmedDisco[dkA] {
+		t.Errorf("peer A still in trimmedDisco after being removed from config")
+	}
+	if _, ok := ue.recvActivityAt[dkB]; !ok {
+		t.Errorf("peer B not tracked in recvActivityAt")
+	}
+}
+
+func TestUserspaceEngineConfiguredDiscoKeys(t *testing.T) {
+	e, err := NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	ue := e.(*userspaceEngine)
+
+	dkA := dkFromHex("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	dkB := dkFromHex("bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb")
+	cfg := &wgcfg.Config{}
+	for i, dk := range []tailcfg.DiscoKey{dkB, dkA} {
+		cfg.Peers = append(cfg.Peers, wgcfg.Peer{
+			PublicKey:  wgkey.Key(key.NewPrivate().Public()),
+			AllowedIPs: []netaddr.IPPrefix{netaddr.IPPrefixFrom(netaddr.IPv4(100, 100, 99, byte(i+1)), 32)},
+			Endpoints:  wgcfg.Endpoints{DiscoKey: dk},
+		})
+	}
+	if err := e.Reconfig(cfg, &router.Config{}, &dns.Config{}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []tailcfg.DiscoKey{dkA, dkB}
+	if got := ue.ConfiguredDiscoKeys(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ConfiguredDiscoKeys = %v; want %v", got, want)
+	}
+}
+
+func TestActivityStateRoundTrip(t *testing.T) {
+	newEngine := func(now mono.Time) *userspaceEngine {
+		return &userspaceEngine{
+			timeNow:        func() mono.Time { return now },
+			recvActivityAt: map[tailcfg.DiscoKey]mono.Time{},
+			trimmedDisco:   map[tailcfg.DiscoKey]bool{},
+			logf:           t.Logf,
+		}
+	}
+	dkA := dkFromHex("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	dkB := dkFromHex("bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb")
+	dkC := dkFromHex("cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc")
+
+	oldNow := mono.Time(int64(time.Hour))
+	e1 := newEngine(oldNow)
+	e1.recvActivityAt[dkA] = oldNow.Add(-time.Minute)
+	e1.recvActivityAt[dkB] = oldNow.Add(-10 * time.Minute)
+	e1.recvActivityAt[dkC] = 0
+	e1.trimmedDisco[dkB] = true
+	e1.trimmedDisco[dkC] = true
+
+	b, err := e1.ExportActivityState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b2, err := e1.ExportActivityState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, b2) {
+		t.Errorf("export not stable:\n%s\n%s", b, b2)
+	}
+	if ia, ib := bytes.Index(b, []byte("aaaa")), bytes.Index(b, []byte("bbbb")); ia < 0 || ib < 0 || ia > ib {
+		t.Errorf("disco keys not sorted in export: %s", b)
+	}
+
+	// A new engine, with an unrelated monotonic clock.
+	newNow := mono.Time(int64(5 * time.Hour))
+	e2 := newEngine(newNow)
+	if err := e2.ImportActivityState(b); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(e2.trimmedDisco, e1.trimmedDisco) {
+		t.Errorf("trimmedDisco = %v; want %v", e2.trimmedDisco, e1.trimmedDisco)
+	}
+	if len(e2.recvActivityAt) != len(e1.recvActivityAt) {
+		t.Fatalf("recvActivityAt has %d entries; want %d", len(e2.recvActivityAt), len(e1.recvActivityAt))
+	}
+	for dk, old := range e1.recvActivityAt {
+		got, ok := e2.recvActivityAt[dk]
+		if !ok {
+			t.Errorf("recvActivityAt missing %v", dk.ShortString())
+			continue
+		}
+		if old.IsZero() {
+			if !got.IsZero() {
+				t.Errorf("recvActivityAt[%v] = %v; want zero", dk.ShortString(), got)
+			}
+			continue
+		}
+		// The idle time carries over, plus the (tiny) wall time
+		// that passed between export and import.
+		wantIdle := oldNow.Sub(old)
+		gotIdle := newNow.Sub(got)
+		if gotIdle < wantIdle || gotIdle > wantIdle+time.Minute {
+			t.Errorf("idle for %v = %v; want ~%v", dk.ShortString(), gotIdle, wantIdle)
+		}
+	}
+
+	if err := e2.ImportActivityState([]byte("not json")); err == nil {
+		t.Errorf("ImportActivityState accepted invalid input")
+	}
+}
+
+func TestUserspaceEngineSetPeerNoTrim(t *testing.T) {
+	const idle = time.Minute
+	var (
+		nowMu sync.Mutex
+		now   = mono.Time(123456)
+	)
+	e, err := NewFakeUserspaceEngineWithOpts(t.Logf, FakeOpts{
+		TimeNow: func() mono.Time {
+			nowMu.Lock()
+			defer nowMu.Unlock()
+			return now
+		},
+		PeerIdleThreshold: idle,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	ue := e.(*userspaceEngine)
+
+	dkA := dkFromHex("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	dkB := dkFromHex("bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb")
+	cfg := &wgcfg.Config{}
+	for i, dk := range []tailcfg.DiscoKey{dkA, dkB} {
+		cfg.Peers = append(cfg.Peers, wgcfg.Peer{
+			PublicKey:  wgkey.Key(key.NewPrivate().Public()),
+			AllowedIPs: []netaddr.IPPrefix{netaddr.IPPrefixFrom(netaddr.IPv4(100, 100, 99, byte(i+1)), 32)},
+			Endpoints:  wgcfg.Endpoints{DiscoKey: dk},
+		})
+	}
+
+	if err := ue.SetPeerNoTrim(dkA, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Reconfig(cfg, &router.Config{}, &dns.Config{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	trimmed := func(dk tailcfg.DiscoKey) bool {
+		ue.wgLock.Lock()
+		defer ue.wgLock.Unlock()
+		return ue.trimmedDisco[dk]
+	}
+	if trimmed(dkA) {
+		t.Errorf("pinned peer trimmed")
+	}
+	if !trimmed(dkB) {
+		t.Errorf("idle unpinned peer not trimmed")
+	}
+
+	// Long past the idle threshold, the pinned peer stays.
+	nowMu.Lock()
+	now = now.Add(10 * idle)
+	nowMu.Unlock()
+	ue.wgLock.Lock()
+	ue.maybeReconfigWireguardLocked(nil)
+	ue.wgLock.Unlock()
+	if trimmed(dkA) {
+		t.Errorf("pinned peer trimmed after idle threshold")
+	}
+
+	// Unpinning lets it be trimmed again, right away.
+	if err := ue.SetPeerNoTrim(dkA, false); err != nil {
+		t.Fatal(err)
+	}
+	if !trimmed(dkA) {
+		t.Errorf("unpinned idle peer not trimmed")
+	}
+}
+
+func TestUserspaceEngineOnReconfig(t *testing.T) {
+	// A stopped clock makes every stage take zero time.
+	e, err := NewFakeUserspaceEngineWithOpts(t.Logf, FakeOpts{
+		TimeNow: func() mono.Time { return 123456 },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	ue := e.(*userspaceEngine)
+
+	var sums []ReconfigSummary
+	e.OnReconfig(func(sum ReconfigSummary) {
+		sums = append(sums, sum)
+	})
+
+	cfg := &wgcfg.Config{
+		Peers: []wgcfg.Peer{
+			{
+				AllowedIPs: []netaddr.IPPrefix{netaddr.IPPrefixFrom(netaddr.IPv4(100, 100, 99, 1), 32)},
+				Endpoints:  wgcfg.Endpoints{DiscoKey: dkFromHex("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")},
+			},
+			{
+				AllowedIPs: []netaddr.IPPrefix{netaddr.IPPrefixFrom(netaddr.IPv4(100, 100, 99, 2), 32)},
+				Endpoints:  wgcfg.Endpoints{DiscoKey: dkFromHex("bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb")},
+			},
+		},
+	}
+	dnsCfg := &dns.Config{
+		DefaultResolvers: []netaddr.IPPort{netaddr.MustParseIPPort("8.8.8.8:53")},
+	}
+	if err := e.Reconfig(cfg, &router.Config{}, dnsCfg, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := []ReconfigSummary{{
+		Peers:      2,
+		ListenPort: ue.magicConn.LocalPort(),
+		DNSServers: 1,
+	}}
+	if !reflect.DeepEqual(sums, want) {
+		t.Errorf("OnReconfig summaries = %+v; want %+v", sums, want)
+	}
+
+	// A Reconfig that changes nothing isn't successful, so shouldn't
+	// fire the callback.
+	if err := e.Reconfig(cfg, &router.Config{}, dnsCfg, nil); err != ErrNoChanges {
+		t.Fatalf("second Reconfig = %v; want ErrNoChanges", err)
+	}
+	if len(sums) != 1 {
+		t.Errorf("OnReconfig fired %d times; want 1", len(sums))
+	}
+}
+
+func TestUserspaceEngineReconfigTiming(t *testing.T) {
+	var (
+		nowMu sync.Mutex
+		now   = mono.Time(123456)
+	)
+	fakeDNS := &fakeOSConfigurator{
+		onSet: func() {
+			nowMu.Lock()
+			defer nowMu.Unlock()
+			now = now.Add(2 * time.Second)
+		},
+	}
+	e, err := NewFakeUserspaceEngineWithOpts(t.Logf, FakeOpts{
+		DNS: fakeDNS,
+		TimeNow: func() mono.Time {
+			nowMu.Lock()
+			defer nowMu.Unlock()
+			return now
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	var sums []ReconfigSummary
+	e.OnReconfig(func(sum ReconfigSummary) {
+		sums = append(sums, sum)
+	})
+	dnsCfg := &dns.Config{
+		DefaultResolvers: []netaddr.IPPort{netaddr.MustParseIPPort("8.8.8.8:53")},
+	}
+	routerCfg := &router.Config{
+		LocalAddrs: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.100.99.1/32")},
+	}
+	if err := e.Reconfig(&wgcfg.Config{}, routerCfg, dnsCfg, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(sums) != 1 {
+		t.Fatalf("got %d OnReconfig summaries; want 1", len(sums))
+	}
+	sum := sums[0]
+	if sum.DNSTime != 2*time.Second {
+		t.Errorf("DNSTime = %v; want 2s", sum.DNSTime)
+	}
+	if sum.DNSTime <= sum.WireguardTime || sum.DNSTime <= sum.RouterTime {
+		t.Errorf("DNS stage (%v) not the slowest: wireguard %v, router %v", sum.DNSTime, sum.WireguardTime, sum.RouterTime)
+	}
+}
+
+func TestUserspaceEngineReconfigNilDNS(t *testing.T) {
+	var fakeDNS fakeOSConfigurator
+	e, err := NewFakeUserspaceEngineWithOpts(t.Logf, FakeOpts{DNS: &fakeDNS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	routerCfg := &router.Config{
+		LocalAddrs: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.100.99.1/32")},
+	}
+	if err := e.Reconfig(&wgcfg.Config{}, routerCfg, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	fakeDNS.mu.Lock()
+	defer fakeDNS.mu.Unlock()
+	if fakeDNS.setCalls != 0 {
+		t.Errorf("SetDNS called %d times for a nil DNS config; want 0", fakeDNS.setCalls)
+	}
+}
+
+func TestUserspaceEngineReconfigError(t *testing.T) {
+	errDNS := errors.New("DNS is broken")
+	fakeDNS := fakeOSConfigurator{err: errDNS}
+	e, err := NewFakeUserspaceEngineWithOpts(t.Logf, FakeOpts{DNS: &fakeDNS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	routerCfg := &router.Config{
+		LocalAddrs: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.100.99.1/32")},
+	}
+	dnsCfg := &dns.Config{
+		DefaultResolvers: []netaddr.IPPort{netaddr.MustParseIPPort("8.8.8.8:53")},
+	}
+	err = e.Reconfig(&wgcfg.Config{}, routerCfg, dnsCfg, nil)
+	var rerr *ReconfigError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("Reconfig error = %v; want a *ReconfigError", err)
+	}
+	if rerr.Stage != "dns" {
+		t.Errorf("Stage = %q; want %q", rerr.Stage, "dns")
+	}
+	if !errors.Is(err, errDNS) {
+		t.Errorf("Reconfig error = %v; want it to wrap %v", err, errDNS)
+	}
+}
+
+func TestUserspaceEngineDeferDNSUntilUp(t *testing.T) {
+	var fakeDNS fakeOSConfigurator
+	up := make(chan struct{})
+	e, err := NewFakeUserspaceEngineWithOpts(t.Logf, FakeOpts{DNS: &fakeDNS, InterfaceUp: up})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	setCalls := func() int {
+		fakeDNS.mu.Lock()
+		defer fakeDNS.mu.Unlock()
+		return fakeDNS.setCalls
+	}
+	before := setCalls()
+	routerCfg := &router.Config{
+		LocalAddrs: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.100.99.1/32")},
+	}
+	dnsCfg := &dns.Config{
+		DefaultResolvers: []netaddr.IPPort{netaddr.MustParseIPPort("8.8.8.8:53")},
+	}
+	if err := e.Reconfig(&wgcfg.Config{}, routerCfg, dnsCfg, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := setCalls(); got != before {
+		t.Fatalf("DNS applied %d times before the interface was up", got-before)
+	}
+
+	close(up)
+	deadline := time.Now().Add(5 * time.Second)
+	for setCalls() == before {
+		if time.Now().After(deadline) {
+			t.Fatal("DNS not applied after the interface came up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if cfg := fakeDNS.lastConfig(); len(cfg.Nameservers) == 0 {
+		t.Errorf("applied DNS config %+v has no nameservers", cfg)
+	}
+}
+
 func TestUserspaceEnginePortReconfig(t *testing.T) {
 	const defaultPort = 49983
 	// Keep making a wgengine until we find an unused port
@@ -195,6 +637,132 @@ func TestUserspaceEnginePortReconfig(t *testing.T) {
 	}
 }
 
+func TestUserspaceEngineStrictDebug(t *testing.T) {
+	cfg := &wgcfg.Config{}
+	routerCfg := &router.Config{}
+	// SleepSeconds is handled by controlclient, not the engine.
+	unsupported := &tailcfg.Debug{SleepSeconds: 1}
+	supported := &tailcfg.Debug{RandomizeClientPort: true}
+
+	lenient, err := NewUserspaceEngine(t.Logf, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lenient.Close()
+	if err := lenient.Reconfig(cfg, routerCfg, &dns.Config{}, unsupported); err != nil && err != ErrNoChanges {
+		t.Errorf("lenient Reconfig with unsupported flag: %v", err)
+	}
+
+	strict, err := NewUserspaceEngine(t.Logf, Config{StrictDebug: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer strict.Close()
+	err = strict.Reconfig(cfg, routerCfg, &dns.Config{}, unsupported)
+	if err == nil || !strings.Contains(err.Error(), "SleepSeconds") {
+		t.Errorf("strict Reconfig with unsupported flag = %v; want error naming SleepSeconds", err)
+	}
+	if err := strict.Reconfig(cfg, routerCfg, &dns.Config{}, supported); err != nil && err != ErrNoChanges {
+		t.Errorf("strict Reconfig with supported flag: %v", err)
+	}
+}
+
+func TestCheckDebugFlags(t *testing.T) {
+	known := map[string]bool{"RandomizeClientPort": true}
+	if err := checkDebugFlags(nil, known); err != nil {
+		t.Errorf("nil Debug: %v", err)
+	}
+	if err := checkDebugFlags(&tailcfg.Debug{RandomizeClientPort: true}, known); err != nil {
+		t.Errorf("known flag: %v", err)
+	}
+	err := checkDebugFlags(&tailcfg.Debug{RandomizeClientPort: true, SleepSeconds: 1}, known)
+	if err == nil || !strings.Contains(err.Error(), "SleepSeconds") {
+		t.Errorf("unknown flag error = %v; want error naming SleepSeconds", err)
+	}
+}
+
+func TestFakeUserspaceEngineWithOpts(t *testing.T) {
+	now := mono.Time(123456)
+	var fakeDNS fakeOSConfigurator
+	e, err := NewFakeUserspaceEngineWithOpts(t.Logf, FakeOpts{
+		DNS:     &fakeDNS,
+		TimeNow: func() mono.Time { return now },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	ue := e.(*userspaceEngine)
+
+	dk := dkFromHex("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	cfg := &wgcfg.Config{
+		Peers: []wgcfg.Peer{
+			{
+				AllowedIPs: []netaddr.IPPrefix{
+					netaddr.IPPrefixFrom(netaddr.IPv4(100, 100, 99, 1), 32),
+				},
+				Endpoints: wgcfg.Endpoints{DiscoKey: dk},
+			},
+		},
+	}
+	dnsCfg := &dns.Config{
+		DefaultResolvers: []netaddr.IPPort{netaddr.MustParseIPPort("8.8.8.8:53")},
+	}
+	if err := e.Reconfig(cfg, &router.Config{}, dnsCfg, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	got := fakeDNS.lastConfig()
+	if want := []netaddr.IP{netaddr.MustParseIP("8.8.8.8")}; !reflect.DeepEqual(got.Nameservers, want) {
+		t.Errorf("fake DNS nameservers = %v; want %v", got.Nameservers, want)
+	}
+
+	ue.noteReceiveActivity(dk)
+	if at, _ := ue.LastRecvActivity(dk); at != now {
+		t.Errorf("LastRecvActivity = %v; want injected time %v", at, now)
+	}
+}
+
+// fakeOSConfigurator is a dns.OSConfigurator that records the configs
+// it's given.
+type fakeOSConfigurator struct {
+	mu       sync.Mutex
+	setCalls int
+	cfg      dns.OSConfig
+	err      error  // if non-nil, returned by SetDNS
+	onSet    func() // if non-nil, called by SetDNS
+}
+
+func (c *fakeOSConfigurator) SetDNS(cfg dns.OSConfig) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setCalls++
+	c.cfg = cfg
+	if c.onSet != nil {
+		c.onSet()
+	}
+	return c.err
+}
+
+func (c *fakeOSConfigurator) lastConfig() dns.OSConfig {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cfg
+}
+
+func (c *fakeOSConfigurator) SupportsSplitDNS() bool        { return false }
+func (c *fakeOSConfigurator) Features() dns.ManagerFeatures { return 0 }
+
+func (c *fakeOSConfigurator) CanRepresent(cfg dns.OSConfig) bool {
+	return c.Features().CanRepresent(cfg)
+}
+
+func (c *fakeOSConfigurator) GetBaseConfig() (dns.OSConfig, error) {
+	return dns.OSConfig{}, dns.ErrGetBaseConfigNotSupported
+}
+
+func (c *fakeOSConfigurator) Close() error { return nil }
+
 func dkFromHex(hex string) tailcfg.DiscoKey {
 	if len(hex) != 64 {
 		panic(fmt.Sprintf("%q is len %d; want 64", hex, len(hex)))
@@ -6,6 +6,8 @@ package wgengine
 
 import (
 	"errors"
+	"fmt"
+	"time"
 
 	"inet.af/netaddr"
 	"tailscale.com/ipn/ipnstate"
@@ -40,6 +42,25 @@ type NetInfoCallback func(*tailcfg.NetInfo)
 // into network map updates.
 type NetworkMapCallback func(*netmap.NetworkMap)
 
+// ReconfigSummary describes the state an Engine reached after a
+// successful Reconfig.
+type ReconfigSummary struct {
+	Peers       int    // number of peers in the full wireguard config
+	ListenPort  uint16 // local UDP port in use after the Reconfig
+	DNSServers  int    // number of resolvers in the DNS config, including per-route ones
+	PortChanged bool   // whether the local port changed, e.g. due to Debug.RandomizeClientPort
+
+	// WireguardTime, RouterTime and DNSTime are how long the
+	// Reconfig spent configuring each, as measured by the engine's
+	// clock. A stage with nothing to do takes zero time.
+	WireguardTime time.Duration
+	RouterTime    time.Duration
+	DNSTime       time.Duration
+}
+
+// ReconfigCallback is the type used by Engine.OnReconfig.
+type ReconfigCallback func(ReconfigSummary)
+
 // someHandle is allocated so its pointer address acts as a unique
 // map key handle. (It needs to have non-zero size for Go to guarantee
 // the pointer is unique.)
@@ -48,6 +69,21 @@ type someHandle struct{ _ byte }
 // ErrNoChanges is returned by Engine.Reconfig if no changes were made.
 var ErrNoChanges = errors.New("no changes made to Engine config")
 
+// ReconfigError is returned by Engine.Reconfig when applying the
+// config to one of the engine's subsystems fails.
+type ReconfigError struct {
+	// Stage is the subsystem that failed: "wireguard", "router"
+	// or "dns".
+	Stage string
+	Err   error
+}
+
+func (e *ReconfigError) Error() string {
+	return fmt.Sprintf("wgengine: configuring %s: %v", e.Stage, e.Err)
+}
+
+func (e *ReconfigError) Unwrap() error { return e.Err }
+
 // Engine is the Tailscale WireGuard engine interface.
 type Engine interface {
 	// Reconfig reconfigures WireGuard and makes sure it's running.
@@ -56,7 +92,9 @@ type Engine interface {
 	// This is called whenever tailcontrol (the control plane)
 	// sends an updated network map.
 	//
-	// The *tailcfg.Debug parameter can be nil.
+	// The *dns.Config parameter can be nil, in which case the DNS
+	// configuration is left as it is. The *tailcfg.Debug parameter
+	// can be nil.
 	//
 	// The returned error is ErrNoChanges if no changes were made.
 	Reconfig(*wgcfg.Config, *router.Config, *dns.Config, *tailcfg.Debug) error
@@ -71,6 +109,12 @@ type Engine interface {
 	// WireGuard status changes.
 	SetStatusCallback(StatusCallback)
 
+	// OnReconfig sets the function to call after each successful
+	// Reconfig, once the new configuration has been applied.
+	// It is not called when Reconfig returns an error, including
+	// ErrNoChanges.
+	OnReconfig(ReconfigCallback)
+
 	// GetLinkMonitor returns the link monitor.
 	GetLinkMonitor() *monitor.Mon
 